@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apart-work-test/proxy/version"
+	"gopkg.in/yaml.v3"
+)
+
+// peerTimeout bounds each call the aggregator makes to a peer
+const peerTimeout = 5 * time.Second
+
+// maxStreamEvent bounds one event line read from a peer's /api/stream
+const maxStreamEvent = 16 << 20
+
+// instanceSep separates the instance name from a peer's own ID in
+// aggregated entry IDs and PCAP names ("sandbox1:3f2a9c1d")
+const instanceSep = ":"
+
+// Peer is one proxy instance the aggregator reads from
+type Peer struct {
+	Name  string
+	URL   string
+	token string
+
+	mu     sync.Mutex
+	status PeerStatus
+}
+
+// PeerStatus is the outcome of the most recent call to a peer
+type PeerStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	OK          bool      `json:"ok"`
+	Error       string    `json:"error,omitempty"`
+	LatencyMs   int64     `json:"latency_ms"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+}
+
+// ParsePeers parses "http://a:8888,b=http://b:8888". Unnamed peers are
+// named after their host.
+func ParsePeers(list string, tokens map[string]string) ([]*Peer, error) {
+	var peers []*Peer
+	seen := make(map[string]bool)
+	for _, item := range splitList(list) {
+		name, rawURL, named := strings.Cut(item, "=")
+		if !named {
+			rawURL = item
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", rawURL)
+		}
+		if !named {
+			name = u.Hostname()
+		}
+		if name == "" || strings.Contains(name, instanceSep) {
+			return nil, fmt.Errorf("invalid peer name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate peer name %q (use name=url to disambiguate)", name)
+		}
+		seen[name] = true
+
+		peer := &Peer{Name: name, URL: strings.TrimSuffix(u.String(), "/"), token: tokens[name]}
+		peer.status = PeerStatus{Name: name, URL: peer.URL}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers given")
+	}
+	for name := range tokens {
+		if !seen[name] {
+			return nil, fmt.Errorf("token given for unknown peer %q", name)
+		}
+	}
+	return peers, nil
+}
+
+// loadPeerTokens reads a YAML mapping of peer name to API token
+func loadPeerTokens(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer tokens: %w", err)
+	}
+	var tokens map[string]string
+	if err := yaml.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse peer tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// Status returns the peer's most recent status
+func (p *Peer) Status() PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *Peer) record(started time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.LastChecked = time.Now().UTC()
+	p.status.LatencyMs = time.Since(started).Milliseconds()
+	p.status.OK = err == nil
+	p.status.Error = ""
+	if err != nil {
+		p.status.Error = err.Error()
+	}
+}
+
+// do sends a request to the peer and records whether it was reachable.
+// Any HTTP response counts as reachable; callers check the status.
+func (p *Peer) do(client *http.Client, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		err = fmt.Errorf("peer rejected token")
+	}
+	p.record(started, err)
+	return resp, err
+}
+
+// getJSON fetches path from the peer and decodes the JSON response into out
+func (p *Peer) getJSON(client *http.Client, path string, out interface{}) error {
+	resp, err := p.do(client, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream opens a long-lived GET of path on the peer, e.g. /api/stream,
+// that lasts until ctx is done or the peer ends it
+func (p *Peer) stream(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("%s returned %s", path, resp.Status)
+		if resp.StatusCode == http.StatusUnauthorized {
+			err = fmt.Errorf("peer rejected token")
+		}
+	}
+	p.record(started, err)
+	return resp, err
+}
+
+// Aggregator serves one web UI over several proxy instances. Reads are
+// fanned out and merged; anything tied to one entry goes to its owner.
+type Aggregator struct {
+	peers        []*Peer
+	byName       map[string]*Peer
+	client       *http.Client
+	streamClient *http.Client // without a timeout, for /api/stream
+	token        string       // if set, API calls must send "Authorization: Bearer <token>"
+	adminToken   string       // also accepted
+}
+
+// NewAggregator creates an aggregator over peers. Its own API takes the
+// same tokens as a single instance's.
+func NewAggregator(peers []*Peer, token, adminToken string) *Aggregator {
+	a := &Aggregator{
+		peers:        peers,
+		byName:       make(map[string]*Peer),
+		client:       &http.Client{Timeout: peerTimeout},
+		streamClient: &http.Client{},
+		token:        token,
+		adminToken:   adminToken,
+	}
+	for _, p := range peers {
+		a.byName[p.Name] = p
+	}
+	return a
+}
+
+// runAggregate implements "proxy aggregate": it starts only the web server
+func runAggregate(args []string) int {
+	fs := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	webAddr := fs.String("web", ":8888", "Web UI listen address")
+	peerList := fs.String("peers", "", "Comma-separated peer web UI URLs, optionally name=url")
+	tokensFile := fs.String("peer-tokens", "", "YAML file mapping peer name to its API token")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	tokens, err := loadPeerTokens(*tokensFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	peers, err := ParsePeers(*peerList, tokens)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -peers: %v\n", err)
+		return 1
+	}
+
+	for _, p := range peers {
+		fmt.Printf("Aggregating %s (%s)\n", p.Name, p.URL)
+	}
+	aggregator := NewAggregator(peers, os.Getenv("PROXY_WEB_TOKEN"), os.Getenv("PROXY_WEB_ADMIN_TOKEN"))
+	if err := aggregator.Start(*webAddr); err != nil {
+		log.Printf("Aggregator failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (a *Aggregator) apiRoutes() []apiRoute {
+	return []apiRoute{
+		{"/api/requests", []string{"GET"}, "Requests from all peers, newest first", a.handleRequests},
+		{"/api/requests/{instance:id}", []string{"GET"}, "Get one request from its owning peer", a.handleRequestDetail},
+		{"/api/requests/{instance:id}/replay", []string{"POST"}, "Replay a request on its owning peer", nil}, // served by handleRequestDetail
+		{"/api/pcap/{instance:file}", []string{"GET"}, "Download a PCAP file from its owning peer", a.handlePcapDownload},
+		{"/api/pcap-list", []string{"GET"}, "PCAP files from all peers", a.handlePcapList},
+		{"/api/stats", []string{"GET"}, "Per-domain stats from each peer", a.handleStats},
+		{"/api/events", []string{"GET"}, "Recent events from all peers", a.handleEvents},
+		{"/api/stream", []string{"GET"}, "Server-sent events: each peer's entries as it publishes them, with instance:id IDs", a.handleStream},
+		{"/api/preferences", []string{"GET"}, "Empty; preferences are per instance and read-only here", a.handlePreferences},
+		{"/api/version", []string{"GET"}, "Aggregator build and peer versions", a.handleVersion},
+		{"/api/health", []string{"GET"}, "Reachability of each peer", a.handleHealth},
+		{"/api/schema", []string{"GET"}, "This description of the API", a.handleSchema},
+	}
+}
+
+// Start starts the aggregator's web server
+func (a *Aggregator) Start(addr string) error {
+	handler, err := a.Handler()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Aggregated web UI available at http://localhost%s\n", addr)
+	return http.ListenAndServe(addr, handler)
+}
+
+// Handler routes the aggregated API and serves the UI
+func (a *Aggregator) Handler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	for _, route := range a.apiRoutes() {
+		if route.handler != nil {
+			mux.HandleFunc(route.muxPattern(), route.handler)
+		}
+	}
+
+	staticFS, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get static files: %w", err)
+	}
+	assets, err := newStaticAssets(staticFS)
+	if err != nil {
+		return nil, err
+	}
+	mux.Handle("/", assets)
+
+	return requireToken(mux, a.token, a.adminToken), nil
+}
+
+// fanOut calls fetch for every peer concurrently and returns the names of
+// peers it failed for. Results are collected by fetch itself.
+func (a *Aggregator) fanOut(fetch func(p *Peer) error) []string {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for _, p := range a.peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			if err := fetch(p); err != nil {
+				mu.Lock()
+				failed = append(failed, p.Name)
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
+
+// owner splits an aggregated "instance:rest" name into its peer and the
+// peer's own name for it
+func (a *Aggregator) owner(qualified string) (*Peer, string, bool) {
+	name, rest, ok := strings.Cut(qualified, instanceSep)
+	if !ok || rest == "" {
+		return nil, "", false
+	}
+	p, ok := a.byName[name]
+	return p, rest, ok
+}
+
+// qualify tags an entry from a peer with its instance
+func qualify(entry *RequestLog, instance string) {
+	entry.Instance = instance
+	entry.ID = instance + instanceSep + entry.ID
+	if entry.PcapFile != "" {
+		entry.PcapFile = instance + instanceSep + entry.PcapFile
+	}
+	if entry.ReplayOf != "" {
+		entry.ReplayOf = instance + instanceSep + entry.ReplayOf
+	}
+}
+
+// writeMerged writes a merged response, listing peers that couldn't be reached
+func writeMerged(rw http.ResponseWriter, failed []string, v interface{}) {
+	writeMergedStatus(rw, http.StatusOK, failed, v)
+}
+
+func writeMergedStatus(rw http.ResponseWriter, status int, failed []string, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(failed) > 0 {
+		rw.Header().Set("X-Aggregate-Unavailable", strings.Join(failed, ","))
+	}
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *Aggregator) handleRequests(rw http.ResponseWriter, r *http.Request) {
+	var (
+		mu     sync.Mutex
+		merged []RequestLog
+	)
+	// Filters (e.g. filter_name) are passed through and resolved by each peer
+	path := "/api/requests"
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	failed := a.fanOut(func(p *Peer) error {
+		var entries []RequestLog
+		if err := p.getJSON(a.client, path, &entries); err != nil {
+			return err
+		}
+		for i := range entries {
+			qualify(&entries[i], p.Name)
+		}
+		mu.Lock()
+		merged = append(merged, entries...)
+		mu.Unlock()
+		return nil
+	})
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp.After(merged[j].Timestamp)
+	})
+	if merged == nil {
+		merged = []RequestLog{}
+	}
+	writeMerged(rw, failed, merged)
+}
+
+func (a *Aggregator) handleRequestDetail(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/requests/")
+	replayID, isReplay := strings.CutSuffix(id, "/replay")
+	if isReplay {
+		id = replayID
+		if r.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	p, peerID, ok := a.owner(id)
+	if !ok {
+		http.Error(rw, "Request IDs in aggregate mode look like instance:id", http.StatusNotFound)
+		return
+	}
+
+	path := "/api/requests/" + url.PathEscape(peerID)
+	method := http.MethodGet
+	if isReplay {
+		path += "/replay"
+		method = http.MethodPost
+	}
+	resp, err := p.do(a.client, method, path, nil)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("peer %s unavailable: %v", p.Name, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		rw.WriteHeader(resp.StatusCode)
+		io.Copy(rw, resp.Body)
+		return
+	}
+
+	var entry RequestLog
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		http.Error(rw, fmt.Sprintf("bad response from peer %s: %v", p.Name, err), http.StatusBadGateway)
+		return
+	}
+	qualify(&entry, p.Name)
+
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *Aggregator) handlePcapDownload(rw http.ResponseWriter, r *http.Request) {
+	p, filename, ok := a.owner(strings.TrimPrefix(r.URL.Path, "/api/pcap/"))
+	if !ok {
+		http.Error(rw, "PCAP names in aggregate mode look like instance:file", http.StatusNotFound)
+		return
+	}
+
+	resp, err := p.do(a.client, http.MethodGet, "/api/pcap/"+url.PathEscape(filename), nil)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("peer %s unavailable: %v", p.Name, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Content-Type", "Content-Disposition", "Content-Length"} {
+		if v := resp.Header.Get(name); v != "" {
+			rw.Header().Set(name, v)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
+
+func (a *Aggregator) handlePcapList(rw http.ResponseWriter, r *http.Request) {
+	var (
+		mu     sync.Mutex
+		merged = []string{}
+	)
+	failed := a.fanOut(func(p *Peer) error {
+		var files []string
+		if err := p.getJSON(a.client, "/api/pcap-list", &files); err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, f := range files {
+			merged = append(merged, p.Name+instanceSep+f)
+		}
+		mu.Unlock()
+		return nil
+	})
+	sort.Strings(merged)
+	writeMerged(rw, failed, merged)
+}
+
+func (a *Aggregator) handleStats(rw http.ResponseWriter, r *http.Request) {
+	var (
+		mu     sync.Mutex
+		merged = []DomainStats{}
+		since  *time.Time
+	)
+	path := "/api/stats"
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	failed := a.fanOut(func(p *Peer) error {
+		var stats struct {
+			Domains []DomainStats `json:"domains"`
+			Since   *time.Time    `json:"since"`
+		}
+		if err := p.getJSON(a.client, path, &stats); err != nil {
+			return err
+		}
+		mu.Lock()
+		if stats.Since != nil && (since == nil || stats.Since.Before(*since)) {
+			since = stats.Since
+		}
+		for _, s := range stats.Domains {
+			s.Instance = p.Name
+			merged = append(merged, s)
+		}
+		mu.Unlock()
+		return nil
+	})
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Requests != merged[j].Requests {
+			return merged[i].Requests > merged[j].Requests
+		}
+		return merged[i].Instance < merged[j].Instance
+	})
+	resp := map[string]interface{}{"domains": merged}
+	if since != nil {
+		resp["since"] = since
+	}
+	writeMerged(rw, failed, resp)
+}
+
+func (a *Aggregator) handleEvents(rw http.ResponseWriter, r *http.Request) {
+	var (
+		mu     sync.Mutex
+		merged = []Event{}
+	)
+	failed := a.fanOut(func(p *Peer) error {
+		var events []Event
+		if err := p.getJSON(a.client, "/api/events", &events); err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, e := range events {
+			e.Instance = p.Name
+			merged = append(merged, e)
+		}
+		mu.Unlock()
+		return nil
+	})
+
+	// Oldest first, like a single instance
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	writeMerged(rw, failed, merged)
+}
+
+// handleStream fans in every peer's /api/stream, passing filters through
+// like handleRequests. Peers that can't be reached when the stream starts
+// are listed in X-Aggregate-Unavailable and not retried; the stream ends
+// once every peer's has.
+func (a *Aggregator) handleStream(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	path := "/api/stream"
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	var (
+		mu      sync.Mutex
+		streams = make(map[*Peer]io.ReadCloser)
+	)
+	failed := a.fanOut(func(p *Peer) error {
+		resp, err := p.stream(r.Context(), a.streamClient, path)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		streams[p] = resp.Body
+		mu.Unlock()
+		return nil
+	})
+	if len(streams) == 0 {
+		http.Error(rw, "No peer stream available", http.StatusBadGateway)
+		return
+	}
+
+	entries := make(chan RequestLog)
+	var wg sync.WaitGroup
+	for p, body := range streams {
+		wg.Add(1)
+		go func(p *Peer, body io.ReadCloser) {
+			defer wg.Done()
+			defer body.Close()
+			readStream(r.Context(), body, p.Name, entries)
+		}(p, body)
+	}
+	go func() {
+		wg.Wait()
+		close(entries)
+	}()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(failed) > 0 {
+		rw.Header().Set("X-Aggregate-Unavailable", strings.Join(failed, ","))
+	}
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "id: %s\nevent: entry\ndata: %s\n\n", entry.ID, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// readStream sends each entry event in a peer's stream to entries, tagged
+// with the peer's instance, until the stream or ctx ends
+func readStream(ctx context.Context, body io.Reader, instance string, entries chan<- RequestLog) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), maxStreamEvent)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var entry RequestLog
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		qualify(&entry, instance)
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Aggregator) handlePreferences(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Preferences are per instance and can't be changed through the aggregator", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Write([]byte("{}"))
+}
+
+func (a *Aggregator) handleVersion(rw http.ResponseWriter, r *http.Request) {
+	var (
+		mu    sync.Mutex
+		peers = make(map[string]Fingerprint)
+	)
+	failed := a.fanOut(func(p *Peer) error {
+		var fp Fingerprint
+		if err := p.getJSON(a.client, "/api/version", &fp); err != nil {
+			return err
+		}
+		mu.Lock()
+		peers[p.Name] = fp
+		mu.Unlock()
+		return nil
+	})
+	writeMerged(rw, failed, map[string]interface{}{
+		"build": version.Get(),
+		"peers": peers,
+	})
+}
+
+func (a *Aggregator) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	failed := a.fanOut(func(p *Peer) error {
+		var health map[string]interface{}
+		return p.getJSON(a.client, "/api/health", &health)
+	})
+
+	statuses := make([]PeerStatus, len(a.peers))
+	for i, p := range a.peers {
+		statuses[i] = p.Status()
+	}
+
+	status, code := "ok", http.StatusOK
+	switch {
+	case len(failed) == len(a.peers):
+		status, code = "down", http.StatusServiceUnavailable
+	case len(failed) > 0:
+		status = "degraded"
+	}
+	writeMergedStatus(rw, code, failed, map[string]interface{}{
+		"status": status,
+		"peers":  statuses,
+	})
+}
+
+func (a *Aggregator) handleSchema(rw http.ResponseWriter, r *http.Request) {
+	schema := apiSchema{
+		SchemaVersion: apiSchemaVersion,
+		Build:         version.Get(),
+		Endpoints:     a.apiRoutes(),
+		RequestFields: describeFields(reflect.TypeOf(RequestLog{})),
+		Features:      map[string]bool{"aggregate": true, "replay": true},
+	}
+	writeMerged(rw, nil, schema)
+}
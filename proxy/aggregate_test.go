@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAggregator runs an aggregator with its own API token over two
+// proxies, a and b, that each require theirs
+func startAggregator(t *testing.T, token string) (*httptest.Server, *Server, *Server) {
+	t.Helper()
+	a := startServerWithTokens(t, "a-token", "")
+	b := startServerWithTokens(t, "b-token", "")
+	peers, err := ParsePeers("a=http://"+a.WebAddr()+",b=http://"+b.WebAddr(), map[string]string{"a": "a-token", "b": "b-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewAggregator(peers, token, "").Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregator := httptest.NewServer(handler)
+	t.Cleanup(aggregator.Close)
+	return aggregator, a, b
+}
+
+func aggregatorGet(t *testing.T, aggregator *httptest.Server, path, token string) *http.Response {
+	t.Helper()
+	req := newRequest(t, http.MethodGet, aggregator.URL+path, "")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAggregatorRequiresToken(t *testing.T) {
+	aggregator, _, _ := startAggregator(t, "aggregate-token")
+
+	// Peer tokens stay with the aggregator; its callers need its own
+	for _, path := range []string{"/api/requests", "/api/stream", "/api/events"} {
+		for _, token := range []string{"", "a-token"} {
+			if resp := aggregatorGet(t, aggregator, path, token); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET %s with %q: %d, want 401", path, token, resp.StatusCode)
+			}
+		}
+	}
+	if resp := aggregatorGet(t, aggregator, "/api/requests", "aggregate-token"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api/requests with the aggregator's token: %d", resp.StatusCode)
+	}
+	if resp := aggregatorGet(t, aggregator, "/api/health", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api/health without a token: %d", resp.StatusCode)
+	}
+}
+
+func TestAggregatorFansInStream(t *testing.T) {
+	aggregator, a, b := startAggregator(t, "aggregate-token")
+	origin := newOrigin(t, true)
+
+	resp := aggregatorGet(t, aggregator, "/api/stream", "aggregate-token")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Aggregate-Unavailable") != "" {
+		t.Fatalf("stream: %d, unavailable %q", resp.StatusCode, resp.Header.Get("X-Aggregate-Unavailable"))
+	}
+	events := make(chan RequestLog)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var entry RequestLog
+				if json.Unmarshal([]byte(data), &entry) == nil {
+					events <- entry
+				}
+			}
+		}
+		close(events)
+	}()
+
+	// Once the stream is open, each peer's entries arrive tagged with it
+	for _, s := range []*Server{a, b} {
+		fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo", ""))
+	}
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case entry, ok := <-events:
+			if !ok {
+				t.Fatal("stream ended early")
+			}
+			if !strings.HasPrefix(entry.ID, entry.Instance+instanceSep) || entry.Path != "/echo" {
+				t.Errorf("streamed %s from %q for %s", entry.ID, entry.Instance, entry.Path)
+			}
+			seen[entry.Instance] = true
+		case <-timeout:
+			t.Fatalf("streamed entries from %v, want a and b", seen)
+		}
+	}
+}
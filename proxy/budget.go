@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// captureBudgetFraction of detected memory is the default capture budget
+	captureBudgetFraction = 4
+
+	// fallbackCaptureBudget is used when memory can't be detected
+	fallbackCaptureBudget = 256 << 20
+
+	// captureReadChunk is how much budget is reserved at a time for bodies
+	// of unknown length
+	captureReadChunk = 32 << 10
+
+	// captureSkippedMemory marks entries whose bodies weren't captured
+	captureSkippedMemory = "memory_pressure"
+)
+
+// errBudgetExhausted is returned by readAll when a body doesn't fit the budget
+var errBudgetExhausted = errors.New("capture budget exhausted")
+
+// CaptureBudget bounds the memory held by capture buffers across all
+// in-flight requests. Captures that don't fit are skipped rather than
+// queued, so the proxy degrades to metadata-only logging under a burst.
+type CaptureBudget struct {
+	limit  int64
+	source string // how the limit was chosen
+
+	used             atomic.Int64
+	peak             atomic.Int64
+	skippedRequests  atomic.Int64
+	skippedResponses atomic.Int64
+	pressure         atomic.Bool
+}
+
+// CaptureUsage is the response of /api/capture-budget
+type CaptureUsage struct {
+	LimitBytes       int64  `json:"limit_bytes"`
+	Source           string `json:"source"`
+	UsedBytes        int64  `json:"used_bytes"`
+	PeakBytes        int64  `json:"peak_bytes"`
+	Pressure         bool   `json:"pressure"` // the last reservation failed
+	SkippedRequests  int64  `json:"skipped_requests"`
+	SkippedResponses int64  `json:"skipped_responses"`
+}
+
+// NewCaptureBudget creates a budget of limit bytes
+func NewCaptureBudget(limit int64, source string) *CaptureBudget {
+	return &CaptureBudget{limit: limit, source: source}
+}
+
+// acquire reserves n bytes, failing if that would exceed the limit
+func (b *CaptureBudget) acquire(n int64) bool {
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			if !b.pressure.Swap(true) {
+				fmt.Printf("Capture budget of %d bytes exhausted; capturing metadata only until it frees up\n", b.limit)
+			}
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			for peak := b.peak.Load(); used+n > peak && !b.peak.CompareAndSwap(peak, used+n); peak = b.peak.Load() {
+			}
+			if b.pressure.Swap(false) {
+				fmt.Println("Capture budget available again")
+			}
+			return true
+		}
+	}
+}
+
+// release returns n reserved bytes
+func (b *CaptureBudget) release(n int64) {
+	if n > 0 {
+		b.used.Add(-n)
+	}
+}
+
+// Usage reports current usage and skip counts
+func (b *CaptureBudget) Usage() CaptureUsage {
+	return CaptureUsage{
+		LimitBytes:       b.limit,
+		Source:           b.source,
+		UsedBytes:        b.used.Load(),
+		PeakBytes:        b.peak.Load(),
+		Pressure:         b.pressure.Load(),
+		SkippedRequests:  b.skippedRequests.Load(),
+		SkippedResponses: b.skippedResponses.Load(),
+	}
+}
+
+// readAll reads r, reserving budget for it first. size is the body's
+// length if known, or -1. It returns the bytes read and how much budget
+// they hold. With errBudgetExhausted the body didn't fit: data is what was
+// already read, and the caller must forward it followed by the rest of r.
+func (b *CaptureBudget) readAll(r io.Reader, size int64) (data []byte, reserved int64, err error) {
+	if size >= 0 {
+		if !b.acquire(size) {
+			return nil, 0, errBudgetExhausted
+		}
+		data = make([]byte, size)
+		n, err := io.ReadFull(r, data)
+		if err != nil {
+			return data[:n], size, err
+		}
+		// Bodies longer than declared are passed through uncaptured
+		var extra [1]byte
+		if n, _ := r.Read(extra[:]); n > 0 {
+			return append(data, extra[:n]...), size, errBudgetExhausted
+		}
+		return data, size, nil
+	}
+
+	for {
+		if len(data) == cap(data) {
+			if !b.acquire(captureReadChunk) {
+				return data, reserved, errBudgetExhausted
+			}
+			reserved += captureReadChunk
+			grown := make([]byte, len(data), cap(data)+captureReadChunk)
+			copy(grown, data)
+			data = grown
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, reserved, nil
+		}
+		if err != nil {
+			return data, reserved, err
+		}
+	}
+}
+
+// passthroughBody forwards a body that was partly read for capture: the
+// bytes already read, then the rest of the original. The budget held by
+// the prefix is released when the body is closed.
+type passthroughBody struct {
+	io.Reader
+	src      io.Closer
+	budget   *CaptureBudget
+	reserved int64
+	once     sync.Once
+}
+
+func newPassthroughBody(prefix []byte, src io.ReadCloser, budget *CaptureBudget, reserved int64) *passthroughBody {
+	return &passthroughBody{
+		Reader:   io.MultiReader(bytes.NewReader(prefix), src),
+		src:      src,
+		budget:   budget,
+		reserved: reserved,
+	}
+}
+
+func (b *passthroughBody) Close() error {
+	b.once.Do(func() { b.budget.release(b.reserved) })
+	return b.src.Close()
+}
+
+// bufferedRequestBody replays a captured request body to the transport and
+// releases its budget once the transport closes it
+type bufferedRequestBody struct {
+	*bytes.Reader
+	budget   *CaptureBudget
+	reserved int64
+	once     sync.Once
+}
+
+func (b *bufferedRequestBody) Close() error {
+	b.once.Do(func() { b.budget.release(b.reserved) })
+	return nil
+}
+
+// defaultCaptureBudget is a fraction of the memory available to the
+// process, honouring cgroup limits when running in a container
+func defaultCaptureBudget() (int64, string) {
+	mem, source := detectMemory()
+	if mem <= 0 {
+		return fallbackCaptureBudget, "default"
+	}
+	return mem / captureBudgetFraction, fmt.Sprintf("1/%d of %s", captureBudgetFraction, source)
+}
+
+// detectMemory returns the memory limit of the process's cgroup, or the
+// machine's total memory if there is none
+func detectMemory() (int64, string) {
+	// cgroup v2
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return n, "cgroup memory.max"
+		}
+	}
+	total, _ := memTotal()
+	// cgroup v1 reports a number larger than physical memory when unlimited
+	if data, err := os.ReadFile("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && n > 0 && (total <= 0 || n < total) {
+			return n, "cgroup memory.limit_in_bytes"
+		}
+	}
+	if total > 0 {
+		return total, "MemTotal"
+	}
+	return 0, ""
+}
+
+// memTotal reads MemTotal from /proc/meminfo
+func memTotal() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb << 10, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+}
+
+// parseByteSize parses sizes like 512KB, 64MB or 1GiB (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		shift  uint
+	}{
+		{"KiB", 10}, {"MiB", 20}, {"GiB", 30},
+		{"KB", 10}, {"MB", 20}, {"GB", 30},
+		{"K", 10}, {"M", 20}, {"G", 30}, {"B", 0},
+	}
+	for _, u := range units {
+		if num, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+			if err != nil || n < 0 || n > math.MaxInt64>>u.shift {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return n << u.shift, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
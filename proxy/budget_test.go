@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// heldBack is an empty reader that blocks until release is closed
+type heldBack struct{ release <-chan struct{} }
+
+func (h heldBack) Read([]byte) (int, error) {
+	<-h.release
+	return 0, io.EOF
+}
+
+func TestCaptureBudgetHoldsUnderBurst(t *testing.T) {
+	const budget = 256 << 10
+	s := startServer(t, "-capture-budget=256KB")
+	origin := newOrigin(t, true)
+	client := proxiedClient(t, s)
+
+	// Far more concurrent bodies than fit: each request carries 16KB and
+	// each response 64KB that stays in flight for 200ms. Request bodies
+	// hold their second half back until a capture has been skipped, so the
+	// burst overlaps however the goroutines get scheduled, and only if
+	// bodies are read concurrently
+	const burst = 64
+	half := strings.Repeat("x", 8<<10)
+	want := string(largeBody(64))
+	overflowed := make(chan struct{})
+	go func() {
+		defer close(overflowed)
+		deadline := time.Now().Add(5 * time.Second)
+		for s.logger.budget.Usage().SkippedRequests == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan string, burst)
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := io.MultiReader(strings.NewReader(half), heldBack{overflowed}, strings.NewReader(half))
+			req, _ := http.NewRequest(http.MethodPost, origin.URL+"/large?kb=64&ms=200", body)
+			req.ContentLength = int64(2 * len(half))
+			resp, err := client.Do(req)
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || string(got) != want {
+				errs <- "response body corrupted or cut short"
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err) // skipped captures must still relay everything
+	}
+
+	waitFor(t, "every entry to be logged", func() bool { return len(s.Logger().GetRequests()) == burst })
+	waitFor(t, "capture buffers to be released", func() bool { return s.logger.budget.Usage().UsedBytes == 0 })
+	usage := s.logger.budget.Usage()
+	if usage.LimitBytes != budget || usage.PeakBytes > budget {
+		t.Errorf("peak %d bytes exceeds the %d byte limit", usage.PeakBytes, usage.LimitBytes)
+	}
+	if usage.SkippedRequests == 0 {
+		t.Fatalf("no request captures skipped under the burst: %+v", usage)
+	}
+
+	var skipped RequestLog
+	flagged := 0
+	for _, e := range s.Logger().GetRequests() {
+		if e.CaptureSkipped == captureSkippedMemory {
+			flagged++
+			if e.Body == "" {
+				skipped = e
+			}
+		}
+	}
+	if flagged == 0 || skipped.ID == "" {
+		t.Fatalf("%d entries flagged memory_pressure, none of them without a request body", flagged)
+	}
+
+	// A degraded entry can't be replayed faithfully
+	status, body := apiRequest(t, s, http.MethodPost, "/api/requests/"+skipped.ID+"/replay", "", nil)
+	if status != http.StatusConflict || !strings.Contains(body, "weren't captured (memory_pressure)") {
+		t.Errorf("replaying an entry without captured bodies: %d %s", status, body)
+	}
+}
@@ -19,10 +19,13 @@ type CAConfig struct {
 	Key     *rsa.PrivateKey
 	CertPEM []byte
 	KeyPEM  []byte
+
+	Ephemeral bool // generated without persistence; exists only in this process
 }
 
-// LoadOrCreateCA loads existing CA or creates a new one
-func LoadOrCreateCA(logsDir string) (*CAConfig, error) {
+// LoadOrCreateCA loads existing CA or creates a new one. When the logs
+// directory is read-only, a new CA is kept in memory (Ephemeral).
+func LoadOrCreateCA(logsDir string, readOnly bool) (*CAConfig, error) {
 	certPath := filepath.Join(logsDir, "ca.crt")
 	keyPath := filepath.Join(logsDir, "ca.key")
 
@@ -34,7 +37,7 @@ func LoadOrCreateCA(logsDir string) (*CAConfig, error) {
 	}
 
 	// Create new CA
-	return createCA(certPath, keyPath)
+	return createCA(certPath, keyPath, readOnly)
 }
 
 func loadCA(certPath, keyPath string) (*CAConfig, error) {
@@ -76,7 +79,7 @@ func loadCA(certPath, keyPath string) (*CAConfig, error) {
 	}, nil
 }
 
-func createCA(certPath, keyPath string) (*CAConfig, error) {
+func createCA(certPath, keyPath string, readOnly bool) (*CAConfig, error) {
 	// Generate private key
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -120,6 +123,17 @@ func createCA(certPath, keyPath string) (*CAConfig, error) {
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
 
+	ca := &CAConfig{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: certPEM,
+		KeyPEM:  keyPEM,
+	}
+	if readOnly {
+		ca.Ephemeral = true
+		return ca, nil
+	}
+
 	// Write to files
 	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
 		return nil, fmt.Errorf("failed to write CA cert: %w", err)
@@ -129,11 +143,5 @@ func createCA(certPath, keyPath string) (*CAConfig, error) {
 	}
 
 	fmt.Printf("Created new CA certificate at %s\n", certPath)
-
-	return &CAConfig{
-		Cert:    cert,
-		Key:     key,
-		CertPEM: certPEM,
-		KeyPEM:  keyPEM,
-	}, nil
+	return ca, nil
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxAllowPaths bounds how many paths' Allow headers are kept per host
+	maxAllowPaths = 200
+
+	// maxInventoryPath bounds the length of a path used as an inventory key
+	maxInventoryPath = 512
+)
+
+// HostCapabilities is what a host has advertised about itself in response
+// headers: allowed methods, CORS policy and rate limits
+type HostCapabilities struct {
+	Domain     string                           `json:"domain"`
+	Allow      map[string][]string              `json:"allow,omitempty"` // path -> methods from Allow headers
+	CORS       *CORSPolicy                      `json:"cors,omitempty"`
+	RateLimits map[string]*RateLimitObservation `json:"rate_limits,omitempty"` // by bucket
+	Responses  int                              `json:"responses"`
+	UpdatedAt  time.Time                        `json:"updated_at"`
+}
+
+// CORSPolicy is the union of CORS headers a host has sent
+type CORSPolicy struct {
+	AllowOrigins     []string `json:"allow_origins,omitempty"`
+	AllowMethods     []string `json:"allow_methods,omitempty"`
+	AllowHeaders     []string `json:"allow_headers,omitempty"`
+	ExposeHeaders    []string `json:"expose_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAgeSeconds    int      `json:"max_age_seconds,omitempty"`
+}
+
+// RateLimitObservation tracks one rate-limit bucket ("requests", "tokens",
+// "core", ... or "default" when the headers don't name one)
+type RateLimitObservation struct {
+	Bucket          string     `json:"bucket"`
+	Limit           int64      `json:"limit,omitempty"`
+	Remaining       int64      `json:"remaining"`        // most recent value
+	LowestRemaining int64      `json:"lowest_remaining"` // lowest value seen
+	LowestAt        time.Time  `json:"lowest_at"`
+	ResetAt         *time.Time `json:"reset_at,omitempty"` // reset time reported with the lowest value
+	Header          string     `json:"header"`             // header the remaining value came from
+	LastSeen        time.Time  `json:"last_seen"`
+
+	low bool // a rate_limit_low event has fired and hasn't re-armed yet
+}
+
+// rateLimitReading is one bucket's values parsed from a single response
+type rateLimitReading struct {
+	limit, remaining       int64
+	hasLimit, hasRemaining bool
+	reset                  *time.Time
+	header                 string
+}
+
+// Capabilities builds the per-host inventory from observed responses
+type Capabilities struct {
+	mu        sync.Mutex
+	hosts     map[string]*HostCapabilities
+	lowAt     float64 // remaining/limit fraction at or below which a bucket is low
+	events    *EventLog
+	observing bool // events are only emitted once live traffic is observed
+}
+
+// NewCapabilities creates an empty inventory. lowAt is the fraction of a
+// rate limit left at which a rate_limit_low event is emitted (0 disables).
+func NewCapabilities(events *EventLog, lowAt float64) *Capabilities {
+	return &Capabilities{
+		hosts:  make(map[string]*HostCapabilities),
+		lowAt:  lowAt,
+		events: events,
+	}
+}
+
+// Rebuild seeds the inventory from logged entries without emitting events.
+// Only the first value of each logged header is available.
+func (c *Capabilities) Rebuild(entries []RequestLog) {
+	for _, e := range entries {
+		if e.ResponseStatus == 0 {
+			continue
+		}
+		header := make(http.Header)
+		for k, v := range e.ResponseHeaders {
+			header.Set(k, v)
+		}
+		at := e.Timestamp
+		if e.UpstreamDoneAt != nil {
+			at = *e.UpstreamDoneAt
+		}
+		c.observe(e.Domain, e.Path, header, at)
+	}
+
+	c.mu.Lock()
+	c.observing = true
+	c.mu.Unlock()
+}
+
+// Observe records the capabilities advertised by a live response
+func (c *Capabilities) Observe(domain, path string, header http.Header) {
+	c.observe(domain, path, header, time.Now().UTC())
+}
+
+// normalizePath turns a request path into an inventory key: any query is
+// dropped and very long paths are cut short on a UTF-8 boundary, so
+// generated URLs can't bloat the inventory
+func normalizePath(p string) string {
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p = p[:i]
+	}
+	if p == "" {
+		return "/"
+	}
+	if len(p) <= maxInventoryPath {
+		return p
+	}
+	cut := maxInventoryPath
+	for cut > 0 && !utf8.RuneStart(p[cut]) {
+		cut--
+	}
+	return p[:cut] + "..."
+}
+
+// Get returns a copy of a host's inventory
+func (c *Capabilities) Get(domain string) (HostCapabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host, ok := c.hosts[domain]
+	if !ok {
+		return HostCapabilities{}, false
+	}
+	result := *host
+	result.Allow = make(map[string][]string, len(host.Allow))
+	for path, methods := range host.Allow {
+		result.Allow[path] = append([]string(nil), methods...)
+	}
+	if host.CORS != nil {
+		cors := *host.CORS
+		result.CORS = &cors
+	}
+	result.RateLimits = make(map[string]*RateLimitObservation, len(host.RateLimits))
+	for bucket, rl := range host.RateLimits {
+		obs := *rl
+		result.RateLimits[bucket] = &obs
+	}
+	return result, true
+}
+
+func (c *Capabilities) observe(domain, path string, header http.Header, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host, ok := c.hosts[domain]
+	if !ok {
+		host = &HostCapabilities{
+			Domain:     domain,
+			Allow:      make(map[string][]string),
+			RateLimits: make(map[string]*RateLimitObservation),
+		}
+		c.hosts[domain] = host
+	}
+	host.Responses++
+	host.UpdatedAt = at
+
+	if allow := header.Values("Allow"); len(allow) > 0 {
+		path := normalizePath(path)
+		if _, seen := host.Allow[path]; seen || len(host.Allow) < maxAllowPaths {
+			host.Allow[path] = mergeTokens(host.Allow[path], allow, strings.ToUpper)
+		}
+	}
+
+	c.observeCORS(host, header)
+
+	for bucket, reading := range parseRateLimits(header, at) {
+		c.observeRateLimit(host, bucket, reading, at)
+	}
+}
+
+func (c *Capabilities) observeCORS(host *HostCapabilities, header http.Header) {
+	origins := header.Values("Access-Control-Allow-Origin")
+	methods := header.Values("Access-Control-Allow-Methods")
+	headers := header.Values("Access-Control-Allow-Headers")
+	expose := header.Values("Access-Control-Expose-Headers")
+	if len(origins)+len(methods)+len(headers)+len(expose) == 0 {
+		return
+	}
+
+	if host.CORS == nil {
+		host.CORS = &CORSPolicy{}
+	}
+	cors := host.CORS
+	cors.AllowOrigins = mergeTokens(cors.AllowOrigins, origins, strings.TrimSpace)
+	cors.AllowMethods = mergeTokens(cors.AllowMethods, methods, strings.ToUpper)
+	cors.AllowHeaders = mergeTokens(cors.AllowHeaders, headers, strings.ToLower)
+	cors.ExposeHeaders = mergeTokens(cors.ExposeHeaders, expose, strings.ToLower)
+	if strings.EqualFold(header.Get("Access-Control-Allow-Credentials"), "true") {
+		cors.AllowCredentials = true
+	}
+	if age, err := strconv.Atoi(header.Get("Access-Control-Max-Age")); err == nil {
+		cors.MaxAgeSeconds = age
+	}
+}
+
+func (c *Capabilities) observeRateLimit(host *HostCapabilities, bucket string, r rateLimitReading, at time.Time) {
+	obs, ok := host.RateLimits[bucket]
+	if !ok {
+		obs = &RateLimitObservation{Bucket: bucket, LowestRemaining: -1}
+		host.RateLimits[bucket] = obs
+	}
+	if r.hasLimit {
+		obs.Limit = r.limit
+	}
+	obs.LastSeen = at
+	if !r.hasRemaining {
+		return
+	}
+
+	obs.Remaining = r.remaining
+	obs.Header = r.header
+	if obs.LowestRemaining < 0 || r.remaining <= obs.LowestRemaining {
+		obs.LowestRemaining = r.remaining
+		obs.LowestAt = at
+		obs.ResetAt = r.reset
+	}
+
+	if c.lowAt <= 0 || obs.Limit <= 0 {
+		return
+	}
+	low := float64(r.remaining) <= c.lowAt*float64(obs.Limit)
+	if low && !obs.low && c.observing && c.events != nil {
+		c.events.Emit("rate_limit_low", map[string]interface{}{
+			"domain":    host.Domain,
+			"bucket":    bucket,
+			"remaining": r.remaining,
+			"limit":     obs.Limit,
+			"reset_at":  r.reset,
+		})
+	}
+	obs.low = low // re-arms once the bucket refills
+}
+
+// mergeTokens adds the comma-separated tokens in values to set, keeping it sorted
+func mergeTokens(set []string, values []string, normalize func(string) string) []string {
+	seen := make(map[string]bool, len(set))
+	for _, v := range set {
+		seen[v] = true
+	}
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			token = normalize(strings.TrimSpace(token))
+			if token != "" && !seen[token] {
+				seen[token] = true
+				set = append(set, token)
+			}
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+var (
+	// x-ratelimit-remaining, x-ratelimit-remaining-requests (OpenAI),
+	// ratelimit-remaining (IETF draft)
+	rateLimitSuffixed = regexp.MustCompile(`^(?:x-)?rate-?limit-(limit|remaining|reset|used)(?:-(.+))?$`)
+	// anthropic-ratelimit-requests-remaining, x-ratelimit-tokens-remaining
+	rateLimitPrefixed = regexp.MustCompile(`^(?:[a-z0-9]+-)?rate-?limit-(.+)-(limit|remaining|reset)$`)
+)
+
+// parseRateLimits extracts rate-limit readings from response headers,
+// keyed by bucket. It understands GitHub (X-RateLimit-* plus
+// X-RateLimit-Resource), OpenAI (x-ratelimit-remaining-requests),
+// Anthropic (anthropic-ratelimit-tokens-remaining), the IETF draft's
+// RateLimit-* and structured RateLimit headers, and Retry-After.
+func parseRateLimits(header http.Header, now time.Time) map[string]rateLimitReading {
+	readings := make(map[string]rateLimitReading)
+	defaultBucket := "default"
+	if resource := header.Get("X-RateLimit-Resource"); resource != "" {
+		defaultBucket = strings.ToLower(resource)
+	}
+
+	set := func(bucket, field, value, name string) {
+		r := readings[bucket]
+		switch field {
+		case "limit":
+			if n, ok := parseCount(value); ok {
+				r.limit, r.hasLimit = n, true
+			}
+		case "remaining":
+			if n, ok := parseCount(value); ok {
+				r.remaining, r.hasRemaining = n, true
+				r.header = name
+			}
+		case "reset":
+			r.reset = parseReset(value, now)
+		default:
+			return
+		}
+		readings[bucket] = r
+	}
+
+	for name, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		lower := strings.ToLower(name)
+		value := values[0]
+
+		if lower == "ratelimit" {
+			// Structured draft header: limit=100, remaining=50, reset=30
+			for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+				k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+				if ok {
+					set(defaultBucket, strings.ToLower(k), v, name)
+				}
+			}
+			continue
+		}
+		if m := rateLimitSuffixed.FindStringSubmatch(lower); m != nil {
+			bucket := defaultBucket
+			if m[2] != "" {
+				bucket = m[2]
+			}
+			set(bucket, m[1], value, name)
+			continue
+		}
+		if m := rateLimitPrefixed.FindStringSubmatch(lower); m != nil {
+			set(m[1], m[2], value, name)
+		}
+	}
+
+	// A 429's Retry-After is the reset for a bucket that's already empty
+	if retry := header.Get("Retry-After"); retry != "" && len(readings) > 0 {
+		if reset := parseReset(retry, now); reset != nil {
+			for bucket, r := range readings {
+				if r.hasRemaining && r.remaining == 0 && r.reset == nil {
+					r.reset = reset
+					readings[bucket] = r
+				}
+			}
+		}
+	}
+
+	return readings
+}
+
+// parseCount parses a count, tolerating quotes and trailing parameters
+func parseCount(value string) (int64, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if i := strings.IndexAny(value, ";, "); i >= 0 {
+		value = value[:i]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
+
+// parseReset interprets a reset value: Unix seconds (GitHub), delta
+// seconds (IETF draft, Retry-After), a Go-style duration like "6m0s"
+// (OpenAI), RFC 3339 (Anthropic) or an HTTP date
+func parseReset(value string, now time.Time) *time.Time {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	var t time.Time
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if f > 1e9 {
+			t = time.Unix(int64(f), 0).UTC()
+		} else {
+			t = now.Add(time.Duration(f * float64(time.Second)))
+		}
+	} else if d, err := time.ParseDuration(value); err == nil {
+		t = now.Add(d)
+	} else if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		t = parsed.UTC()
+	} else if parsed, err := http.ParseTime(value); err == nil {
+		t = parsed.UTC()
+	} else {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	// reading is what's expected of one bucket; a negative count is absent
+	type reading struct {
+		limit, remaining int64
+		reset            *time.Time
+		header           string
+	}
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		want   map[string]reading
+	}{
+		{"GitHub with a resource",
+			map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "4999", "X-RateLimit-Reset": "1767225900", "X-RateLimit-Used": "1", "X-RateLimit-Resource": "Core"},
+			map[string]reading{"core": {5000, 4999, at(5 * time.Minute), "X-Ratelimit-Remaining"}}},
+		{"GitHub without a resource",
+			map[string]string{"X-RateLimit-Limit": "60", "X-RateLimit-Remaining": "59"},
+			map[string]reading{"default": {60, 59, nil, "X-Ratelimit-Remaining"}}},
+		{"OpenAI requests and tokens",
+			map[string]string{
+				"x-ratelimit-limit-requests": "500", "x-ratelimit-remaining-requests": "499", "x-ratelimit-reset-requests": "120ms",
+				"x-ratelimit-limit-tokens": "30000", "x-ratelimit-remaining-tokens": "29000", "x-ratelimit-reset-tokens": "6m0s",
+			},
+			map[string]reading{
+				"requests": {500, 499, at(120 * time.Millisecond), "X-Ratelimit-Remaining-Requests"},
+				"tokens":   {30000, 29000, at(6 * time.Minute), "X-Ratelimit-Remaining-Tokens"},
+			}},
+		{"Anthropic",
+			map[string]string{
+				"anthropic-ratelimit-tokens-limit": "40000", "anthropic-ratelimit-tokens-remaining": "12000", "anthropic-ratelimit-tokens-reset": "2026-01-01T00:01:00Z",
+				"anthropic-ratelimit-requests-remaining": "49",
+			},
+			map[string]reading{
+				"tokens":   {40000, 12000, at(time.Minute), "Anthropic-Ratelimit-Tokens-Remaining"},
+				"requests": {-1, 49, nil, "Anthropic-Ratelimit-Requests-Remaining"},
+			}},
+		{"IETF draft fields",
+			map[string]string{"RateLimit-Limit": "100", "RateLimit-Remaining": "42", "RateLimit-Reset": "30"},
+			map[string]reading{"default": {100, 42, at(30 * time.Second), "Ratelimit-Remaining"}}},
+		{"IETF draft with a policy parameter and quotes",
+			map[string]string{"RateLimit-Limit": "100; w=60", "RateLimit-Remaining": `"42"`},
+			map[string]reading{"default": {100, 42, nil, "Ratelimit-Remaining"}}},
+		{"structured RateLimit",
+			map[string]string{"RateLimit": "limit=100, remaining=50, reset=30"},
+			map[string]reading{"default": {100, 50, at(30 * time.Second), "Ratelimit"}}},
+		{"structured RateLimit with a resource and semicolons",
+			map[string]string{"RateLimit": "limit=10;remaining=0;reset=5", "X-RateLimit-Resource": "search"},
+			map[string]reading{"search": {10, 0, at(5 * time.Second), "Ratelimit"}}},
+		{"Retry-After resets an empty bucket",
+			map[string]string{"X-RateLimit-Limit": "60", "X-RateLimit-Remaining": "0", "Retry-After": "120"},
+			map[string]reading{"default": {60, 0, at(2 * time.Minute), "X-Ratelimit-Remaining"}}},
+		{"Retry-After as an HTTP date",
+			map[string]string{"X-RateLimit-Remaining": "0", "Retry-After": "Thu, 01 Jan 2026 00:03:00 GMT"},
+			map[string]reading{"default": {-1, 0, at(3 * time.Minute), "X-Ratelimit-Remaining"}}},
+		{"Retry-After doesn't override a reported reset",
+			map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "10", "Retry-After": "120"},
+			map[string]reading{"default": {-1, 0, at(10 * time.Second), "X-Ratelimit-Remaining"}}},
+		{"Retry-After leaves buckets with requests left alone",
+			map[string]string{"X-RateLimit-Remaining": "3", "Retry-After": "120"},
+			map[string]reading{"default": {-1, 3, nil, "X-Ratelimit-Remaining"}}},
+		{"Retry-After alone isn't a bucket",
+			map[string]string{"Retry-After": "120"},
+			map[string]reading{}},
+		{"unparseable values are dropped",
+			map[string]string{"X-RateLimit-Limit": "lots", "X-RateLimit-Remaining": "5", "X-RateLimit-Reset": "soon"},
+			map[string]reading{"default": {-1, 5, nil, "X-Ratelimit-Remaining"}}},
+		{"unrelated headers",
+			map[string]string{"Content-Type": "application/json", "X-Request-Id": "abc"},
+			map[string]reading{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := make(http.Header)
+			for k, v := range tc.header {
+				header.Set(k, v)
+			}
+			got := parseRateLimits(header, now)
+			if len(got) != len(tc.want) {
+				t.Errorf("got buckets %v, want %d", got, len(tc.want))
+			}
+			for bucket, want := range tc.want {
+				r, ok := got[bucket]
+				if !ok {
+					t.Errorf("no %s bucket in %v", bucket, got)
+					continue
+				}
+				if r.hasLimit != (want.limit >= 0) || (r.hasLimit && r.limit != want.limit) {
+					t.Errorf("%s: limit %d (%v), want %d", bucket, r.limit, r.hasLimit, want.limit)
+				}
+				if r.hasRemaining != (want.remaining >= 0) || r.remaining != want.remaining || r.header != want.header {
+					t.Errorf("%s: remaining %d (%v) from %q, want %d from %q", bucket, r.remaining, r.hasRemaining, r.header, want.remaining, want.header)
+				}
+				if (r.reset == nil) != (want.reset == nil) || (r.reset != nil && !r.reset.Equal(*want.reset)) {
+					t.Errorf("%s: reset %v, want %v", bucket, r.reset, want.reset)
+				}
+			}
+		})
+	}
+}
+
+func TestParseReset(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration // from now
+		ok    bool
+	}{
+		{"1767225660", time.Minute, true}, // Unix seconds
+		{"30", 30 * time.Second, true},    // delta seconds
+		{"1.5", 1500 * time.Millisecond, true},
+		{"0", 0, true},
+		{`"30"`, 30 * time.Second, true},
+		{" 30 ", 30 * time.Second, true},
+		{"6m0s", 6 * time.Minute, true}, // Go-style durations
+		{"250ms", 250 * time.Millisecond, true},
+		{"1h2m3s", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"2026-01-01T00:00:45Z", 45 * time.Second, true}, // RFC 3339
+		{"2026-01-01T02:00:45+02:00", 45 * time.Second, true},
+		{"Thu, 01 Jan 2026 00:10:00 GMT", 10 * time.Minute, true}, // HTTP date
+		{"Thursday, 01-Jan-26 00:10:00 GMT", 10 * time.Minute, true},
+		{"", 0, false},
+		{"soon", 0, false},
+		{"2026-01-01", 0, false},
+	} {
+		got := parseReset(tc.value, now)
+		switch {
+		case !tc.ok && got != nil:
+			t.Errorf("%q: parsed as %v, want nothing", tc.value, got)
+		case tc.ok && got == nil:
+			t.Errorf("%q: not parsed, want now+%v", tc.value, tc.want)
+		case tc.ok && (!got.Equal(now.Add(tc.want)) || got.Location() != time.UTC):
+			t.Errorf("%q: parsed as %v, want %v", tc.value, got, now.Add(tc.want))
+		}
+	}
+}
+
+func TestRateLimitLowRearms(t *testing.T) {
+	events, err := NewEventLog(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	lowEvents := func() []Event {
+		var low []Event
+		for _, e := range events.Recent() {
+			if e.Type == "rate_limit_low" {
+				low = append(low, e)
+			}
+		}
+		return low
+	}
+	remaining := func(n string) http.Header {
+		return http.Header{"X-Ratelimit-Limit": {"100"}, "X-Ratelimit-Remaining": {n}, "X-Ratelimit-Resource": {"core"}}
+	}
+
+	// Rebuilding from the log never emits, even for a bucket that was low
+	caps := NewCapabilities(events, 0.1)
+	caps.Rebuild([]RequestLog{{Domain: "api.github.com", ResponseStatus: 200, ResponseHeaders: map[string]string{"X-Ratelimit-Limit": "100", "X-Ratelimit-Remaining": "50"}}})
+	if n := len(lowEvents()); n != 0 {
+		t.Fatalf("%d events while rebuilding", n)
+	}
+
+	// Crossing the threshold fires once, staying low doesn't fire again,
+	// and a refill re-arms it for the next drop
+	for i, step := range []struct {
+		remaining string
+		events    int
+	}{
+		{"50", 0},
+		{"11", 0},
+		{"10", 1}, // at the threshold counts as low
+		{"3", 1},
+		{"0", 1},
+		{"60", 1}, // refilled
+		{"9", 2},
+	} {
+		caps.Observe("api.github.com", "/user", remaining(step.remaining))
+		if n := len(lowEvents()); n != step.events {
+			t.Fatalf("step %d (%s left): %d events, want %d", i, step.remaining, n, step.events)
+		}
+	}
+	data, _ := lowEvents()[0].Data.(map[string]interface{})
+	if data["domain"] != "api.github.com" || data["bucket"] != "core" || data["remaining"] != int64(10) || data["limit"] != int64(100) {
+		t.Errorf("event data %v", data)
+	}
+
+	// The lowest value seen is kept alongside the latest
+	host, _ := caps.Get("api.github.com")
+	if obs := host.RateLimits["core"]; obs.Remaining != 9 || obs.LowestRemaining != 0 || obs.Header != "X-Ratelimit-Remaining" {
+		t.Errorf("observation %+v", obs)
+	}
+
+	// A threshold of 0 disables the event, as does a bucket without a limit
+	quiet := NewCapabilities(events, 0)
+	quiet.Rebuild(nil)
+	quiet.Observe("api.github.com", "/user", remaining("0"))
+	unlimited := NewCapabilities(events, 0.1)
+	unlimited.Rebuild(nil)
+	unlimited.Observe("api.example.com", "/", http.Header{"X-Ratelimit-Remaining": {"0"}})
+	if n := len(lowEvents()); n != 2 {
+		t.Errorf("%d events, want no more than the 2 before", n)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCertificates bounds the certificate inventory; certificates first
+// seen after it fills are still identified on entries but not inventoried
+const maxCertificates = 5000
+
+// unrecognizedProvider is reported for certificates that match no provider
+const unrecognizedProvider = "unrecognized"
+
+// certProviders recognizes CDNs and hosting providers from the SANs and
+// issuers of the certificates they serve. SANs are checked first, since
+// public CAs like Let's Encrypt sign for everyone.
+var certProviders = []struct {
+	name        string
+	sanSuffixes []string
+	issuerOrgs  []string
+}{
+	{"cloudflare", []string{".cloudflaressl.com", ".cloudflare.com", ".cloudflare.net"}, []string{"Cloudflare"}},
+	{"fastly", []string{".fastly.net", ".fastlylb.net"}, []string{"Fastly"}},
+	{"akamai", []string{".akamaized.net", ".akamaihd.net", ".akamai.net", ".edgekey.net", ".edgesuite.net"}, []string{"Akamai"}},
+	{"cloudfront", []string{".cloudfront.net"}, nil},
+	{"aws", []string{".amazonaws.com"}, []string{"Amazon"}},
+	{"google", []string{".google.com", ".googleapis.com", ".gstatic.com", ".googleusercontent.com", ".appspot.com"}, nil},
+	{"azure", []string{".azureedge.net", ".azurefd.net", ".azurewebsites.net", ".windows.net"}, []string{"Microsoft"}},
+	{"vercel", []string{".vercel.app", ".vercel.com"}, nil},
+	{"netlify", []string{".netlify.app", ".netlify.com"}, nil},
+	{"github", []string{".github.io", ".githubusercontent.com"}, nil},
+}
+
+// ServerIdentity is the identity the upstream certificate proved for a request
+type ServerIdentity struct {
+	MatchedSAN string `json:"matched_san,omitempty"` // the SAN covering the requested host; empty if none does
+	Provider   string `json:"provider"`              // CDN or hosting provider, or "unrecognized"
+	CertSHA256 string `json:"cert_sha256"`           // leaf certificate, see /api/hosts/{domain}/certificates
+}
+
+// ServerCertificate is an upstream leaf certificate and the hosts it served
+type ServerCertificate struct {
+	SHA256      string            `json:"sha256"`
+	Subject     string            `json:"subject"`
+	Issuer      string            `json:"issuer"`
+	Provider    string            `json:"provider"`
+	DNSNames    []string          `json:"dns_names,omitempty"`
+	IPAddresses []string          `json:"ip_addresses,omitempty"`
+	NotBefore   time.Time         `json:"not_before"`
+	NotAfter    time.Time         `json:"not_after"`
+	Hosts       map[string]string `json:"hosts"` // requested host -> matched SAN, "" if none matched
+	FirstSeen   time.Time         `json:"first_seen"`
+}
+
+// certFingerprint is the hex SHA-256 of a certificate's DER encoding
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// matchSAN returns the SAN of cert that covers host, or "" if none does.
+// A wildcard covers exactly one leftmost label, as in certificate
+// verification; the subject CN is ignored, as Go's verifier does.
+func matchSAN(cert *x509.Certificate, host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, san := range cert.IPAddresses {
+			if san.Equal(ip) {
+				return san.String()
+			}
+		}
+		return ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, san := range cert.DNSNames {
+		name := strings.ToLower(san)
+		if name == host {
+			return san
+		}
+		if parent, ok := strings.CutPrefix(name, "*."); ok {
+			if _, rest, found := strings.Cut(host, "."); found && rest == parent {
+				return san
+			}
+		}
+	}
+	return ""
+}
+
+// certProvider names the provider behind cert, or "unrecognized"
+func certProvider(cert *x509.Certificate) string {
+	for _, p := range certProviders {
+		for _, san := range cert.DNSNames {
+			name := strings.TrimPrefix(strings.ToLower(san), "*.")
+			for _, suffix := range p.sanSuffixes {
+				if strings.HasSuffix(name, suffix) || name == suffix[1:] {
+					return p.name
+				}
+			}
+		}
+	}
+	for _, p := range certProviders {
+		for _, org := range cert.Issuer.Organization {
+			for _, issuer := range p.issuerOrgs {
+				if strings.Contains(strings.ToLower(org), strings.ToLower(issuer)) {
+					return p.name
+				}
+			}
+		}
+	}
+	return unrecognizedProvider
+}
+
+// serverIdentity identifies the certificate that served resp, or returns
+// nil for responses that didn't come over TLS
+func serverIdentity(resp *http.Response) *ServerIdentity {
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 || resp.Request == nil {
+		return nil
+	}
+	leaf := resp.TLS.PeerCertificates[0]
+	return &ServerIdentity{
+		MatchedSAN: matchSAN(leaf, resp.Request.URL.Hostname()),
+		Provider:   certProvider(leaf),
+		CertSHA256: certFingerprint(leaf),
+	}
+}
+
+// serverProvider is the provider behind an entry's upstream certificate
+func serverProvider(e *RequestLog) string {
+	if e.Server == nil {
+		return ""
+	}
+	return e.Server.Provider
+}
+
+// CertInventory records the upstream certificates that served each host,
+// persisted to certificates.json so the full SAN lists outlive the run
+type CertInventory struct {
+	mu       sync.Mutex
+	path     string
+	readOnly bool                          // the logs directory can't be written; keep the inventory in memory
+	certs    map[string]*ServerCertificate // by fingerprint
+	warned   bool                          // the inventory full warning has been printed
+}
+
+// NewCertInventory loads the certificate inventory from logsDir
+func NewCertInventory(logsDir string, readOnly bool) (*CertInventory, error) {
+	inv := &CertInventory{
+		path:     filepath.Join(logsDir, "certificates.json"),
+		readOnly: readOnly,
+		certs:    make(map[string]*ServerCertificate),
+	}
+	data, err := os.ReadFile(inv.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate inventory: %w", err)
+	}
+	var certs []*ServerCertificate
+	if err := json.Unmarshal(data, &certs); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate inventory: %w", err)
+	}
+	for _, c := range certs {
+		inv.certs[c.SHA256] = c
+	}
+	return inv, nil
+}
+
+// Observe records the leaf certificate of a TLS connection to domain. The
+// inventory is only saved when it gains a certificate or host.
+func (c *CertInventory) Observe(domain string, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	leaf := state.PeerCertificates[0]
+	sum := certFingerprint(leaf)
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cert, ok := c.certs[sum]
+	if !ok {
+		if len(c.certs) >= maxCertificates {
+			if !c.warned {
+				fmt.Printf("Warning: certificate inventory is full (%d certificates); new ones are no longer recorded\n", maxCertificates)
+				c.warned = true
+			}
+			return
+		}
+		cert = &ServerCertificate{
+			SHA256:    sum,
+			Subject:   leaf.Subject.String(),
+			Issuer:    leaf.Issuer.String(),
+			Provider:  certProvider(leaf),
+			DNSNames:  leaf.DNSNames,
+			NotBefore: leaf.NotBefore.UTC(),
+			NotAfter:  leaf.NotAfter.UTC(),
+			Hosts:     make(map[string]string),
+			FirstSeen: time.Now().UTC(),
+		}
+		for _, ip := range leaf.IPAddresses {
+			cert.IPAddresses = append(cert.IPAddresses, ip.String())
+		}
+		c.certs[sum] = cert
+	} else if _, seen := cert.Hosts[domain]; seen {
+		return
+	}
+	cert.Hosts[domain] = matchSAN(leaf, host)
+
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save certificate inventory: %v\n", err)
+	}
+}
+
+// save writes the inventory, oldest certificate first. Callers must hold c.mu.
+func (c *CertInventory) save() error {
+	certs := make([]*ServerCertificate, 0, len(c.certs))
+	for _, cert := range c.certs {
+		certs = append(certs, cert)
+	}
+	sortCertificates(certs)
+	data, err := json.MarshalIndent(certs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if c.readOnly {
+		return nil
+	}
+	return writeFileAtomic(c.path, data, 0o644)
+}
+
+// ForHost returns copies of the certificates that served domain, oldest first
+func (c *CertInventory) ForHost(domain string) []*ServerCertificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var certs []*ServerCertificate
+	for _, cert := range c.certs {
+		if _, ok := cert.Hosts[domain]; ok {
+			copied := *cert
+			copied.Hosts = make(map[string]string, len(cert.Hosts))
+			for h, san := range cert.Hosts {
+				copied.Hosts[h] = san
+			}
+			certs = append(certs, &copied)
+		}
+	}
+	sortCertificates(certs)
+	return certs
+}
+
+func sortCertificates(certs []*ServerCertificate) {
+	sort.Slice(certs, func(i, j int) bool {
+		if !certs[i].FirstSeen.Equal(certs[j].FirstSeen) {
+			return certs[i].FirstSeen.Before(certs[j].FirstSeen)
+		}
+		return certs[i].SHA256 < certs[j].SHA256
+	})
+}
+
+// ProviderStats counts the requests to a domain served by one provider's
+// certificates, by the SAN that covered the requested host
+type ProviderStats struct {
+	Provider   string         `json:"provider"`
+	Requests   int            `json:"requests"`
+	Identities map[string]int `json:"identities,omitempty"` // matched SAN -> requests
+	Unmatched  int            `json:"unmatched,omitempty"`  // served by a certificate with no SAN covering the host
+}
+
+// identityKey is how a request's server identity is counted in domainCounters
+func identityKey(id *ServerIdentity) string {
+	return id.Provider + "/" + id.MatchedSAN
+}
+
+// servedBy groups counted identities by provider, busiest first
+func servedBy(identities map[string]int) []ProviderStats {
+	byProvider := make(map[string]*ProviderStats)
+	for key, n := range identities {
+		if n <= 0 {
+			continue
+		}
+		provider, san, _ := strings.Cut(key, "/")
+		p, ok := byProvider[provider]
+		if !ok {
+			p = &ProviderStats{Provider: provider}
+			byProvider[provider] = p
+		}
+		p.Requests += n
+		if san == "" {
+			p.Unmatched += n
+			continue
+		}
+		if p.Identities == nil {
+			p.Identities = make(map[string]int)
+		}
+		p.Identities[san] += n
+	}
+
+	stats := make([]ProviderStats, 0, len(byProvider))
+	for _, p := range byProvider {
+		stats = append(stats, *p)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Provider < stats[j].Provider
+	})
+	return stats
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTemplateSize caps the size of a POST /api/compose body
+const maxTemplateSize = 1 << 20
+
+var (
+	errComposeInvalid = errors.New("invalid request template")
+	errComposeLoop    = errors.New("template targets the proxy itself")
+)
+
+// templateVar matches {{name}} and {{env:NAME}}
+var templateVar = regexp.MustCompile(`\{\{\s*(env:)?([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// RequestTemplate is the body of POST /api/compose
+type RequestTemplate struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Vars    map[string]string `json:"vars,omitempty"`
+}
+
+// Composer builds requests from templates and sends them through the
+// proxy's gate and upstream transport, logging and enriching them like
+// proxied traffic
+type Composer struct {
+	logger     *Logger
+	gate       *Gate
+	tracing    *TraceConfig
+	pipeline   *EnrichPipeline
+	transport  http.RoundTripper
+	transforms ReplayTransforms // flag defaults whose env mapping allowlists {{env:NAME}}
+	rules      *RuleStore
+	selfPorts  map[string]bool // ports the proxy and web UI listen on
+}
+
+// NewComposer creates a composer. listenAddrs are the proxy's own listen
+// addresses, which templates may not target.
+func NewComposer(logger *Logger, gate *Gate, tracing *TraceConfig, pipeline *EnrichPipeline, transport http.RoundTripper, transforms ReplayTransforms, rules *RuleStore, listenAddrs ...string) *Composer {
+	c := &Composer{
+		logger:     logger,
+		gate:       gate,
+		tracing:    tracing,
+		pipeline:   pipeline,
+		transport:  transport,
+		transforms: transforms,
+		rules:      rules,
+		selfPorts:  make(map[string]bool),
+	}
+	for _, addr := range listenAddrs {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			c.selfPorts[port] = true
+		}
+	}
+	if tr, ok := transport.(*http.Transport); ok {
+		c.transport = c.guardDial(tr)
+	}
+	return c
+}
+
+// expand substitutes template variables in s. Environment references are
+// only allowed where envOK is set, and only to the variables in env whose
+// mapping lets them be sent to host; missing and disallowed names are
+// collected into problems.
+func (t RequestTemplate) expand(s, where string, envOK bool, env map[string][]EnvHeader, host string, usedEnv *bool, problems *[]string) string {
+	return templateVar.ReplaceAllStringFunc(s, func(match string) string {
+		m := templateVar.FindStringSubmatch(match)
+		name := m[2]
+		if m[1] != "" {
+			if !envOK {
+				*problems = append(*problems, fmt.Sprintf("%s: environment references are only allowed in headers", where))
+				return match
+			}
+			mappings, ok := env[name]
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: environment variable %s is not in the -replay-env mapping", where, name))
+				return match
+			}
+			if !anyAllows(mappings, host) {
+				*problems = append(*problems, fmt.Sprintf("%s: environment variable %s may not be sent to %s", where, name, host))
+				return match
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: environment variable %s is not set", where, name))
+				return match
+			}
+			*usedEnv = true
+			return value
+		}
+		value, ok := t.Vars[name]
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: no value for {{%s}}", where, name))
+			return match
+		}
+		return value
+	})
+}
+
+// build resolves the template into a request. Environment values are only
+// allowed in headers, which are then redacted in the log, so secrets never
+// end up in a logged URL or body. It returns the request and the headers
+// that received environment values.
+func (c *Composer) build(ctx context.Context, t RequestTemplate) (*http.Request, []string, error) {
+	var problems []string
+	var unused bool
+
+	method := strings.ToUpper(strings.TrimSpace(t.Method))
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !validHeaderName(method) {
+		problems = append(problems, fmt.Sprintf("invalid method %q", t.Method))
+	}
+
+	rawURL := t.expand(t.URL, "url", false, nil, "", &unused, &problems)
+	body := t.expand(t.Body, "body", false, nil, "", &unused, &problems)
+
+	// The target decides which credentials may go into the headers
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("url must be an absolute http(s) URL, got %q", rawURL))
+		u = &url.URL{}
+	}
+	env := c.allowedEnv()
+
+	header := make(http.Header)
+	var fromEnv []string
+	names := make([]string, 0, len(t.Headers))
+	for name := range t.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validHeaderName(name) {
+			problems = append(problems, fmt.Sprintf("invalid header name %q", name))
+			continue
+		}
+		var usedEnv bool
+		value := t.expand(t.Headers[name], "header "+name, true, env, u.Hostname(), &usedEnv, &problems)
+		header.Set(name, value)
+		if usedEnv {
+			fromEnv = append(fromEnv, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("%w: %s", errComposeInvalid, strings.Join(problems, "; "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errComposeInvalid, err)
+	}
+	req.Header = header
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	return req, fromEnv, nil
+}
+
+// allowedEnv maps the environment variables templates may read, those the
+// operator already maps into replayed headers, to their mappings
+func (c *Composer) allowedEnv() map[string][]EnvHeader {
+	env := make(map[string][]EnvHeader)
+	for _, h := range c.rules.Get().replayTransforms(c.transforms).EnvHeaders {
+		env[h.Env] = append(env[h.Env], h)
+	}
+	return env
+}
+
+// anyAllows reports whether one of the mappings may be sent to host
+func anyAllows(mappings []EnvHeader, host string) bool {
+	for _, h := range mappings {
+		if h.allows(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardDial wraps the transport's dialer so a connection to one of the
+// proxy's own listeners is refused. It checks the address actually dialed,
+// so a name that resolves differently at connect time can't slip past.
+func (c *Composer) guardDial(tr *http.Transport) *http.Transport {
+	guarded := tr.Clone()
+	dial := guarded.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	guarded.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if c.isSelf(conn.RemoteAddr()) {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %s", errComposeLoop, addr)
+		}
+		return conn, nil
+	}
+	return guarded
+}
+
+// isSelf reports whether addr is one of the proxy's own listeners
+func (c *Composer) isSelf(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !c.selfPorts[strconv.Itoa(tcp.Port)] {
+		return false
+	}
+	return tcp.IP.IsLoopback() || tcp.IP.IsUnspecified() || localIPs()[tcp.IP.String()]
+}
+
+// localIPs returns the addresses of this machine's interfaces
+func localIPs() map[string]bool {
+	ips := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips[ipnet.IP.String()] = true
+		}
+	}
+	return ips
+}
+
+// Compose sends the request described by t and returns its log entry
+func (c *Composer) Compose(t RequestTemplate) (RequestLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+
+	req, fromEnv, err := c.build(ctx, t)
+	if err != nil {
+		return RequestLog{}, err
+	}
+
+	trace := c.tracing.Start(req)
+	decision := c.gate.Check(req, trace)
+	entry := c.logger.LogRequest(req, LogOptions{
+		Trace:    trace,
+		Redact:   fromEnv,
+		Composed: true,
+		Policy:   decision.Policy,
+	})
+	fmt.Printf("[%s] composed: %s %s%s\n", entry.ID, req.Method, req.Host, req.URL.Path)
+
+	// Refused like a proxied request: the refusal is logged as the response
+	if refusal := decision.Refuse(c.logger, entry.ID, req); refusal != nil {
+		c.logger.LogResponse(entry.ID, refusal)
+		io.Copy(io.Discard, refusal.Body)
+		refusal.Body.Close()
+		c.pipeline.Submit(entry.ID, refusal)
+		refused, _ := c.logger.GetRequest(entry.ID)
+		return refused, decision.Err()
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		reason := "upstream_error: "
+		if errors.Is(err, errComposeLoop) {
+			reason = "compose_loop: "
+		}
+		c.logger.LogError(entry.ID, reason+err.Error())
+		c.pipeline.Submit(entry.ID, nil)
+		failed, _ := c.logger.GetRequest(entry.ID)
+		return failed, fmt.Errorf("composed request failed: %w", err)
+	}
+	c.logger.LogResponse(entry.ID, resp)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	c.pipeline.Submit(entry.ID, resp)
+
+	composed, _ := c.logger.GetRequest(entry.ID)
+	return composed, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestComposeReadsOnlyMappedEnv(t *testing.T) {
+	t.Setenv("COMPOSE_TOKEN", "mapped-secret")
+	t.Setenv("COMPOSE_OTHER", "unmapped-secret")
+	s := startServer(t, "-replay-env=Authorization=COMPOSE_TOKEN@127.0.0.1")
+	origin := newOrigin(t, true)
+
+	template := `{"url": "` + origin.URL + `/echo", "headers": {"Authorization": "Bearer {{env:COMPOSE_TOKEN}}"}}`
+	status, body := compose(t, s, template)
+	if status != http.StatusOK {
+		t.Fatalf("mapped variable: %d %s", status, body)
+	}
+	var entry RequestLog
+	if err := json.Unmarshal([]byte(body), &entry); err != nil {
+		t.Fatal(err)
+	}
+	var seen originRequest
+	if err := json.Unmarshal([]byte(entry.ResponseBody), &seen); err != nil || seen.Header.Get("Authorization") != "Bearer mapped-secret" {
+		t.Errorf("origin got Authorization %q (%v)", seen.Header.Get("Authorization"), err)
+	}
+
+	// Any other variable is refused, and its value never leaves the proxy
+	template = `{"url": "` + origin.URL + `/echo", "headers": {"X-Other": "{{env:COMPOSE_OTHER}}"}}`
+	status, body = compose(t, s, template)
+	if status != http.StatusBadRequest || !strings.Contains(body, "COMPOSE_OTHER is not in the -replay-env mapping") {
+		t.Errorf("unmapped variable: %d %s", status, body)
+	}
+	if strings.Contains(body, "unmapped-secret") {
+		t.Errorf("error leaked the variable's value: %s", body)
+	}
+	if n := len(s.Logger().GetRequests()); n != 1 {
+		t.Errorf("%d entries logged, want only the mapped request", n)
+	}
+}
+
+func TestComposePassesTheGate(t *testing.T) {
+	rules := writeRules(t, "version: 1\npolicy:\n  mode: enforce\n  allow:\n    - host: allowed.example\n")
+	s := startServer(t, "-rules="+rules, "-debug-trace")
+	origin := newOrigin(t, true)
+
+	// Refused like a proxied request, with the refusal logged as its response
+	status, body := compose(t, s, `{"url": "`+origin.URL+`/echo"}`)
+	if status != http.StatusForbidden || !strings.Contains(body, "not allowed by the proxy policy") {
+		t.Fatalf("composed request outside the policy: %d %s", status, body)
+	}
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Composed })
+	if entry.Error != "policy_denied" || entry.Policy != "blocked" || entry.ResponseStatus != http.StatusForbidden {
+		t.Errorf("logged error %q, policy %q, status %d", entry.Error, entry.Policy, entry.ResponseStatus)
+	}
+	if entry.Debug == nil || !hasStep(entry.Debug, "policy", "blocked") {
+		t.Errorf("decision trace %+v has no policy step", entry.Debug)
+	}
+
+	// And enriched like one
+	waitFor(t, "the composed entry to be enriched", func() bool { return s.pipeline.Status().Processed == 1 })
+}
+
+// hasStep reports whether trace recorded subsystem taking action
+func hasStep(trace *DecisionTrace, subsystem, action string) bool {
+	for _, step := range trace.Steps {
+		if step.Subsystem == subsystem && step.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+func TestComposeKeepsCredentialsOnTheirHosts(t *testing.T) {
+	t.Setenv("COMPOSE_TOKEN", "mapped-secret")
+	rules := writeRules(t, "version: 1\nreplay:\n  env:\n    Authorization: {var: COMPOSE_TOKEN, hosts: [api.example.com]}\n")
+	s := startServer(t, "-rules="+rules)
+	origin := newOrigin(t, true)
+
+	// The variable is mapped, but not for this host
+	template := `{"url": "` + origin.URL + `/echo", "headers": {"X-Anything": "{{env:COMPOSE_TOKEN}}"}}`
+	status, body := compose(t, s, template)
+	if status != http.StatusBadRequest || !strings.Contains(body, "COMPOSE_TOKEN may not be sent to 127.0.0.1") {
+		t.Errorf("mapped variable to another host: %d %s", status, body)
+	}
+	if n := len(s.Logger().GetRequests()); n != 0 {
+		t.Errorf("%d entries logged for a refused template", n)
+	}
+}
+
+func TestComposeRefusesOtherPages(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, true)
+	template := `{"url": "` + origin.URL + `/echo"}`
+
+	// A page can POST text/plain without a preflight; a JSON body isn't enough
+	status, body := apiRequest(t, s, http.MethodPost, "/api/compose", template, http.Header{"Content-Type": {"text/plain"}})
+	if status != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain template: %d %s", status, body)
+	}
+	header := http.Header{"Content-Type": {"application/json"}, "Origin": {"http://evil.example"}}
+	if status, body := apiRequest(t, s, http.MethodPost, "/api/compose", template, header); status != http.StatusForbidden {
+		t.Errorf("cross-origin template: %d %s", status, body)
+	}
+	if n := len(s.Logger().GetRequests()); n != 0 {
+		t.Errorf("%d entries logged for refused templates", n)
+	}
+}
+
+func TestComposeRefusesTheProxyItself(t *testing.T) {
+	s := startServer(t)
+
+	// "localhost" is only resolved when the transport dials it
+	_, port, _ := net.SplitHostPort(s.WebAddr())
+	status, body := compose(t, s, `{"url": "http://localhost:`+port+`/api/health"}`)
+	if status != http.StatusForbidden || !strings.Contains(body, "targets the proxy itself") {
+		t.Fatalf("template targeting the web UI: %d %s", status, body)
+	}
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Composed })
+	if !strings.HasPrefix(entry.Error, "compose_loop: ") {
+		t.Errorf("logged error %q", entry.Error)
+	}
+}
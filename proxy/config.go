@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// minHeaderBytes is the smallest -max-header-bytes accepted; anything
+// lower rejects ordinary requests
+const minHeaderBytes = 4 << 10
+
+// Config is the proxy's command-line configuration
+type Config struct {
+	ProxyAddr         string
+	WebAddr           string
+	LogsDir           string
+	AllowReadonlyLogs bool
+	RulesFile         string
+	DebugTrace        bool
+	DebugClients      string
+	ReplayStrip       string
+	ReplayEnv         string
+	ReplayDate        bool
+	ReplayIdempotency bool
+	SlowClientFactor  float64
+	ShutdownGrace     time.Duration
+	RateLimitLow      float64
+	Webhook           string
+	WebhookEvents     string
+	StatsCheckpoint   time.Duration
+	MaxHeaderBytes    int
+	HandshakeHint     int
+	EnrichWorkers     int
+	EnrichQueue       int
+	CaptureBudget     string
+	GenerateTrace     bool
+	LLMBudget         string
+	LLMBudgetWarn     float64
+	LLMBudgetEnforce  bool
+	LLMUnknownCost    float64
+
+	// API tokens, read from PROXY_WEB_TOKEN and PROXY_WEB_ADMIN_TOKEN rather
+	// than flags so they stay out of process listings. They aren't part of
+	// the config hash.
+	WebToken      string `json:"-"`
+	WebAdminToken string `json:"-"`
+
+	// Filled in by Validate
+	traceClients       []*net.IPNet
+	replayEnvHeaders   map[string]EnvHeader
+	captureBudgetBytes int64              // 0 when -capture-budget is unset
+	llmLimits          map[string]float64 // by scope
+}
+
+// registerFlags binds the configuration to fs
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ProxyAddr, "proxy", ":8080", "Proxy listen address")
+	fs.StringVar(&c.WebAddr, "web", ":8888", "Web UI listen address")
+	fs.StringVar(&c.LogsDir, "logs", "/logs", "Directory for logs and PCAP files")
+	fs.BoolVar(&c.AllowReadonlyLogs, "allow-readonly-logs", false, "Start without persistence, keeping state in memory, if the logs directory isn't writable")
+	fs.StringVar(&c.RulesFile, "rules", "", "YAML rules file (reloaded on SIGHUP)")
+	fs.BoolVar(&c.DebugTrace, "debug-trace", false, "Record a decision trace for every request")
+	fs.StringVar(&c.DebugClients, "debug-clients", "", "Comma-separated IPs/CIDRs allowed to request a decision trace via X-Proxy-Debug")
+	fs.StringVar(&c.ReplayStrip, "replay-strip", "Cookie,If-None-Match,If-Modified-Since", "Comma-separated headers to remove when replaying")
+	fs.StringVar(&c.ReplayEnv, "replay-env", "", "Comma-separated Header=ENV_VAR@host|host mappings whose values are read from the environment when replaying, and only sent to those hosts")
+	fs.BoolVar(&c.ReplayDate, "replay-date", true, "Regenerate the Date header when replaying")
+	fs.BoolVar(&c.ReplayIdempotency, "replay-idempotency", true, "Assign a new Idempotency-Key when replaying")
+	fs.Float64Var(&c.SlowClientFactor, "slow-client-factor", 3, "Flag responses whose client drain time exceeds this multiple of the origin time (0 disables)")
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", 5*time.Second, "How long to let in-flight requests finish on shutdown")
+	fs.Float64Var(&c.RateLimitLow, "ratelimit-low", 0.1, "Emit a rate_limit_low event when this fraction of a host's rate limit remains (0 disables)")
+	fs.StringVar(&c.Webhook, "webhook", "", "URL to POST selected events to as JSON")
+	fs.StringVar(&c.WebhookEvents, "webhook-events", "rate_limit_low", "Comma-separated event types sent to -webhook")
+	fs.IntVar(&c.HandshakeHint, "handshake-hint", 3, "Client TLS handshake failures within 10m that raise a hint in /api/health (0 disables)")
+	fs.IntVar(&c.EnrichWorkers, "enrich-workers", 2, "Workers enriching completed entries off the request path")
+	fs.IntVar(&c.EnrichQueue, "enrich-queue", 1000, "Completed entries that can wait for enrichment before it's skipped for new ones")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Largest request line plus headers the proxy listener accepts, in bytes")
+	fs.StringVar(&c.CaptureBudget, "capture-budget", "", "Memory for buffering captured bodies across all in-flight requests, e.g. 256MB (default 1/4 of detected memory)")
+	fs.BoolVar(&c.GenerateTrace, "generate-traceparent", false, "Add a W3C traceparent header to requests that don't carry one")
+	fs.StringVar(&c.LLMBudget, "llm-budget", "", "LLM spend budgets in dollars, e.g. run=5.00,total=50.00")
+	fs.Float64Var(&c.LLMBudgetWarn, "llm-budget-warn", 0.8, "Fraction of an LLM budget at which to warn and mark entries")
+	fs.BoolVar(&c.LLMBudgetEnforce, "llm-budget-enforce", false, "Refuse LLM API calls with 402 once an LLM budget is spent")
+	fs.Float64Var(&c.LLMUnknownCost, "llm-unknown-cost", 0.25, "Dollars charged for an LLM call whose cost can't be estimated")
+	fs.DurationVar(&c.StatsCheckpoint, "stats-checkpoint", time.Minute, "How often to checkpoint stats counters to stats_state.json")
+}
+
+// Validate checks every flag and returns all problems found, not just the first
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.ProxyAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -proxy %q: %v", c.ProxyAddr, err))
+	}
+	if _, _, err := net.SplitHostPort(c.WebAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -web %q: %v", c.WebAddr, err))
+	}
+	if c.LogsDir == "" {
+		errs = append(errs, fmt.Errorf("-logs must not be empty"))
+	}
+
+	clients, err := ParseTraceClients(c.DebugClients)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid -debug-clients: %v", err))
+	}
+	c.traceClients = clients
+
+	envHeaders, err := ParseEnvHeaders(c.ReplayEnv)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid -replay-env: %v", err))
+	}
+	c.replayEnvHeaders = envHeaders
+
+	if c.SlowClientFactor < 0 {
+		errs = append(errs, fmt.Errorf("-slow-client-factor must not be negative"))
+	}
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("-shutdown-grace must not be negative"))
+	}
+	if c.RateLimitLow < 0 || c.RateLimitLow >= 1 {
+		errs = append(errs, fmt.Errorf("-ratelimit-low must be between 0 and 1"))
+	}
+	if c.MaxHeaderBytes < minHeaderBytes {
+		errs = append(errs, fmt.Errorf("-max-header-bytes must be at least %d", minHeaderBytes))
+	}
+	if c.HandshakeHint < 0 {
+		errs = append(errs, fmt.Errorf("-handshake-hint must not be negative"))
+	}
+	if c.EnrichWorkers < 1 {
+		errs = append(errs, fmt.Errorf("-enrich-workers must be at least 1"))
+	}
+	if c.EnrichQueue < 0 {
+		errs = append(errs, fmt.Errorf("-enrich-queue must not be negative"))
+	}
+	if c.CaptureBudget != "" {
+		n, err := parseByteSize(c.CaptureBudget)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("invalid -capture-budget: %v", err))
+		case n == 0:
+			errs = append(errs, fmt.Errorf("-capture-budget must be positive"))
+		}
+		c.captureBudgetBytes = n
+	}
+	limits, err := parseLLMLimits(c.LLMBudget)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid -llm-budget: %v", err))
+	}
+	c.llmLimits = limits
+	if c.LLMBudgetWarn <= 0 || c.LLMBudgetWarn > 1 {
+		errs = append(errs, fmt.Errorf("-llm-budget-warn must be between 0 and 1"))
+	}
+	if c.LLMUnknownCost < 0 {
+		errs = append(errs, fmt.Errorf("-llm-unknown-cost must not be negative"))
+	}
+	if c.StatsCheckpoint <= 0 {
+		errs = append(errs, fmt.Errorf("-stats-checkpoint must be positive"))
+	}
+	if c.Webhook != "" {
+		if u, err := url.Parse(c.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid -webhook %q: must be an http(s) URL", c.Webhook))
+		}
+	}
+
+	return errs
+}
+
+// captureBudget returns the capture budget, sized from -capture-budget or
+// the memory available
+func (c *Config) captureBudget() *CaptureBudget {
+	if c.captureBudgetBytes > 0 {
+		return NewCaptureBudget(c.captureBudgetBytes, "-capture-budget")
+	}
+	return NewCaptureBudget(defaultCaptureBudget())
+}
+
+// replayTransforms returns the replay transforms configured by flags
+func (c *Config) replayTransforms() ReplayTransforms {
+	return ReplayTransforms{
+		RegenerateDate: c.ReplayDate,
+		NewIdempotency: c.ReplayIdempotency,
+		Strip:          splitList(c.ReplayStrip),
+		EnvHeaders:     c.replayEnvHeaders,
+	}
+}
+
+// runValidateConfig implements "proxy validate-config": it checks the flags
+// and the rules file without starting anything, listing every error found
+func runValidateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	var cfg Config
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	errs := cfg.Validate()
+	if cfg.RulesFile != "" {
+		_, ruleErrs := LoadRules(cfg.RulesFile)
+		errs = append(errs, ruleErrs...)
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "%d error(s) found\n", len(errs))
+		return 1
+	}
+
+	if cfg.RulesFile != "" {
+		fmt.Printf("Configuration and %s are valid\n", cfg.RulesFile)
+	} else {
+		fmt.Println("Configuration is valid")
+	}
+	return 0
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// countersStateVersion is bumped when the checkpoint format changes;
+	// older checkpoints are ignored and the counters rebuilt from the log
+	countersStateVersion = 2
+
+	// maxOpenEntries bounds how many recent entries the counters keep so
+	// later updates to them can be folded in. It must exceed the logger's
+	// in-memory window, which is the only source of full-entry rewrites.
+	maxOpenEntries = 2000
+
+	// checkpointAnchorSize is how much of the log before the checkpoint
+	// offset is hashed to detect a rewritten or replaced log file
+	checkpointAnchorSize = 4096
+)
+
+// domainCounters are the additive totals behind DomainStats
+type domainCounters struct {
+	Requests          int   `json:"requests"`
+	Completed         int   `json:"completed"`
+	Errors            int   `json:"errors"`
+	Drained           int   `json:"drained"`
+	SlowClients       int   `json:"slow_clients"`
+	ContentMismatches int   `json:"content_mismatches"`
+	OriginTotalMs     int64 `json:"origin_total_ms"`
+	DrainTotalMs      int64 `json:"drain_total_ms"`
+	MaxClientDrainMs  int64 `json:"max_client_drain_ms"`
+	Bytes             int64 `json:"bytes"`
+
+	Identities map[string]int `json:"identities,omitempty"` // by identityKey
+}
+
+// contribution is what one entry adds to its domain's counters
+func contribution(e *RequestLog) domainCounters {
+	c := domainCounters{Requests: 1}
+	if e.Error != "" {
+		c.Errors = 1
+	}
+	if e.ResponseStatus != 0 {
+		c.Completed = 1
+		c.OriginTotalMs = e.OriginMs
+	}
+	if e.ClientDoneAt != nil && e.DeliveredBytes > 0 {
+		c.Drained = 1
+		c.DrainTotalMs = e.ClientDrainMs
+		c.MaxClientDrainMs = e.ClientDrainMs
+	}
+	if e.SlowClient {
+		c.SlowClients = 1
+	}
+	if e.Content != nil && e.Content.Result == "mismatch" {
+		c.ContentMismatches = 1
+	}
+	c.Bytes = e.DeliveredBytes
+	if e.Server != nil {
+		c.Identities = map[string]int{identityKey(e.Server): 1}
+	}
+	return c
+}
+
+// add adds (sign 1) or removes (sign -1) d. The max only ever grows, since
+// an entry's drain time is recorded at most once.
+func (c *domainCounters) add(d domainCounters, sign int) {
+	c.Requests += sign * d.Requests
+	c.Completed += sign * d.Completed
+	c.Errors += sign * d.Errors
+	c.Drained += sign * d.Drained
+	c.SlowClients += sign * d.SlowClients
+	c.ContentMismatches += sign * d.ContentMismatches
+	c.OriginTotalMs += int64(sign) * d.OriginTotalMs
+	c.DrainTotalMs += int64(sign) * d.DrainTotalMs
+	c.Bytes += int64(sign) * d.Bytes
+	c.MaxClientDrainMs = max(c.MaxClientDrainMs, d.MaxClientDrainMs)
+	for key, n := range d.Identities {
+		if c.Identities == nil {
+			c.Identities = make(map[string]int)
+		}
+		c.Identities[key] += sign * n
+		if c.Identities[key] == 0 {
+			delete(c.Identities, key)
+		}
+	}
+}
+
+// StatsCounters accumulate per-domain stats across the whole log, not just
+// the entries in memory, and are checkpointed so they survive restarts
+type StatsCounters struct {
+	domains map[string]*domainCounters
+	since   time.Time // earliest entry counted
+
+	// Recent entries, stripped to what contribution needs, so updates
+	// logged after them can replace their contribution
+	open      map[string]*RequestLog
+	openOrder []string
+}
+
+func newStatsCounters() *StatsCounters {
+	return &StatsCounters{
+		domains: make(map[string]*domainCounters),
+		open:    make(map[string]*RequestLog),
+	}
+}
+
+// countersState is the checkpoint file. Offset is the position in
+// requests.jsonl the counters cover up to; Anchor hashes the bytes just
+// before it so a rewritten log isn't mistaken for the same one.
+type countersState struct {
+	Version int                        `json:"version"`
+	SavedAt time.Time                  `json:"saved_at"`
+	Offset  int64                      `json:"offset"`
+	Anchor  string                     `json:"anchor"`
+	Since   time.Time                  `json:"since"`
+	Domains map[string]*domainCounters `json:"domains"`
+	Open    []*RequestLog              `json:"open"`
+}
+
+// stripForCounters keeps only the fields contribution and applyTo touch
+func stripForCounters(e RequestLog) *RequestLog {
+	return &RequestLog{
+		ID:             e.ID,
+		Timestamp:      e.Timestamp,
+		Domain:         e.Domain,
+		ResponseStatus: e.ResponseStatus,
+		Error:          e.Error,
+		UpstreamDoneAt: e.UpstreamDoneAt,
+		ClientDoneAt:   e.ClientDoneAt,
+		OriginMs:       e.OriginMs,
+		ClientDrainMs:  e.ClientDrainMs,
+		DeliveredBytes: e.DeliveredBytes,
+		SlowClient:     e.SlowClient,
+		Content:        e.Content,
+		Server:         e.Server,
+		Epoch:          e.Epoch,
+	}
+}
+
+func (s *StatsCounters) domain(name string) *domainCounters {
+	c, ok := s.domains[name]
+	if !ok {
+		c = &domainCounters{}
+		s.domains[name] = c
+	}
+	return c
+}
+
+// observeEntry counts a full entry record, replacing the contribution of
+// an earlier record with the same ID
+func (s *StatsCounters) observeEntry(e RequestLog) {
+	if prev, ok := s.open[e.ID]; ok {
+		s.domain(prev.Domain).add(contribution(prev), -1)
+		stripped := stripForCounters(e)
+		s.open[e.ID] = stripped
+		s.domain(e.Domain).add(contribution(stripped), 1)
+		return
+	}
+
+	stripped := stripForCounters(e)
+	s.domain(e.Domain).add(contribution(stripped), 1)
+	if s.since.IsZero() || e.Timestamp.Before(s.since) {
+		s.since = e.Timestamp
+	}
+
+	s.open[e.ID] = stripped
+	s.openOrder = append(s.openOrder, e.ID)
+	if len(s.openOrder) > maxOpenEntries {
+		delete(s.open, s.openOrder[0])
+		s.openOrder = s.openOrder[1:]
+	}
+}
+
+// observeUpdate folds an update record into the entry it belongs to.
+// Updates for entries no longer open are dropped.
+func (s *StatsCounters) observeUpdate(u entryUpdate) {
+	e, ok := s.open[u.ID]
+	if !ok {
+		return
+	}
+	c := s.domain(e.Domain)
+	c.add(contribution(e), -1)
+	u.applyTo(e)
+	c.add(contribution(e), 1)
+}
+
+// observeLog counts every record in jsonl data, in order
+func (s *StatsCounters) observeLog(data []byte) {
+	for _, line := range splitLines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || bytes.HasPrefix(line, []byte(`{"type":"run_start"`)) {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(`{"type":`)) {
+			var u entryUpdate
+			if json.Unmarshal(line, &u) == nil {
+				s.observeUpdate(u)
+			}
+			continue
+		}
+		var e RequestLog
+		if json.Unmarshal(line, &e) == nil && e.ID != "" {
+			s.observeEntry(e)
+		}
+	}
+}
+
+// Stats returns per-domain stats, busiest first
+func (s *StatsCounters) Stats() []DomainStats {
+	stats := make([]DomainStats, 0, len(s.domains))
+	for domain, c := range s.domains {
+		d := DomainStats{
+			Domain:            domain,
+			Requests:          c.Requests,
+			Completed:         c.Completed,
+			Errors:            c.Errors,
+			MaxClientDrainMs:  c.MaxClientDrainMs,
+			SlowClients:       c.SlowClients,
+			ContentMismatches: c.ContentMismatches,
+			Bytes:             c.Bytes,
+			ServedBy:          servedBy(c.Identities),
+		}
+		if c.Completed > 0 {
+			d.AvgOriginMs = float64(c.OriginTotalMs) / float64(c.Completed)
+		}
+		if c.Drained > 0 {
+			d.AvgClientDrainMs = float64(c.DrainTotalMs) / float64(c.Drained)
+		}
+		stats = append(stats, d)
+	}
+	sortDomainStats(stats)
+	return stats
+}
+
+func countersStatePath(logsDir string) string {
+	return filepath.Join(logsDir, "stats_state.json")
+}
+
+// logAnchor hashes the last checkpointAnchorSize bytes of prefix
+func logAnchor(prefix []byte) string {
+	sum := sha256.Sum256(prefix[max(len(prefix)-checkpointAnchorSize, 0):])
+	return hex.EncodeToString(sum[:])
+}
+
+// loadCounters restores the counters from the checkpoint and counts the
+// records logged after it. If the checkpoint is missing, unreadable or
+// doesn't match the log, the counters are rebuilt from the whole log.
+func loadCounters(logsDir string, data []byte) *StatsCounters {
+	path := countersStatePath(logsDir)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to read %s, rebuilding stats from the log: %v\n", path, err)
+		}
+		return rebuildCounters(data)
+	}
+
+	var state countersState
+	switch {
+	case json.Unmarshal(raw, &state) != nil:
+		fmt.Printf("Warning: %s is corrupt, rebuilding stats from the log\n", path)
+		return rebuildCounters(data)
+	case state.Version != countersStateVersion:
+		fmt.Printf("Warning: %s has unsupported version %d, rebuilding stats from the log\n", path, state.Version)
+		return rebuildCounters(data)
+	case state.Offset < 0 || state.Offset > int64(len(data)) || logAnchor(data[:state.Offset]) != state.Anchor:
+		fmt.Printf("Warning: %s doesn't match requests.jsonl (rewritten or replaced?), rebuilding stats from the log\n", path)
+		return rebuildCounters(data)
+	}
+
+	s := newStatsCounters()
+	s.since = state.Since
+	for name, c := range state.Domains {
+		if c != nil {
+			s.domains[name] = c
+		}
+	}
+	for _, e := range state.Open {
+		if e != nil && e.ID != "" {
+			s.open[e.ID] = e
+			s.openOrder = append(s.openOrder, e.ID)
+		}
+	}
+	s.observeLog(data[state.Offset:])
+	return s
+}
+
+func rebuildCounters(data []byte) *StatsCounters {
+	s := newStatsCounters()
+	s.observeLog(data)
+	return s
+}
+
+// checkpoint snapshots the counters as of offset in the log
+func (s *StatsCounters) checkpoint(offset int64, anchor string) countersState {
+	state := countersState{
+		Version: countersStateVersion,
+		SavedAt: time.Now().UTC(),
+		Offset:  offset,
+		Anchor:  anchor,
+		Since:   s.since,
+		Domains: make(map[string]*domainCounters, len(s.domains)),
+		Open:    make([]*RequestLog, 0, len(s.openOrder)),
+	}
+	for name, c := range s.domains {
+		copied := *c
+		// The snapshot is marshaled after the logger's lock is released,
+		// while the live counters keep updating their own map
+		copied.Identities = maps.Clone(c.Identities)
+		state.Domains[name] = &copied
+	}
+	for _, id := range s.openOrder {
+		copied := *s.open[id]
+		state.Open = append(state.Open, &copied)
+	}
+	return state
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkpointedDomain is planted in a checkpoint to tell whether a restart
+// loaded it or rebuilt the counters from the log
+const checkpointedDomain = "from-checkpoint.example"
+
+// domainRequests returns the request count per domain from /api/stats
+func domainRequests(t *testing.T, s *Server) map[string]int {
+	t.Helper()
+	var stats struct {
+		Domains []DomainStats `json:"domains"`
+	}
+	getJSON(t, s, "/api/stats", &stats)
+	counts := make(map[string]int)
+	for _, d := range stats.Domains {
+		counts[d.Domain] = d.Requests
+	}
+	return counts
+}
+
+// runRequests starts a server on logsDir, sends n requests through it and
+// shuts it down, which checkpoints the counters; it returns the stats the
+// server reported just before
+func runRequests(t *testing.T, logsDir string, n int) map[string]int {
+	t.Helper()
+	origin := newOrigin(t, false)
+	s := newServer(t, logsDir)
+	client := proxiedClient(t, s)
+	for i := 0; i < n; i++ {
+		fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/echo", ""))
+	}
+	waitFor(t, "every request to complete", func() bool {
+		done := 0
+		for _, e := range s.Logger().GetRequests() {
+			if e.ClientDoneAt != nil {
+				done++
+			}
+		}
+		return done == len(s.Logger().GetRequests())
+	})
+	counts := domainRequests(t, s)
+	s.Shutdown(time.Second)
+	return counts
+}
+
+// readCheckpoint loads stats_state.json
+func readCheckpoint(t *testing.T, logsDir string) countersState {
+	t.Helper()
+	raw, err := os.ReadFile(countersStatePath(logsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state countersState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// plantDomain adds checkpointedDomain to the checkpoint, keeping it valid
+func plantDomain(t *testing.T, logsDir string) {
+	t.Helper()
+	state := readCheckpoint(t, logsDir)
+	state.Domains[checkpointedDomain] = &domainCounters{Requests: 7}
+	if err := os.WriteFile(countersStatePath(logsDir), []byte(mustJSON(t, state)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsCheckpointRoundTrip(t *testing.T) {
+	logsDir := t.TempDir()
+	before := runRequests(t, logsDir, 3)
+
+	// The checkpoint covers the whole log as of shutdown
+	state := readCheckpoint(t, logsDir)
+	data, err := os.ReadFile(filepath.Join(logsDir, "requests.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Offset != int64(len(data)) || state.Anchor != logAnchor(data) {
+		t.Errorf("checkpoint at offset %d with anchor %s, log is %d bytes", state.Offset, state.Anchor, len(data))
+	}
+
+	plantDomain(t, logsDir)
+	s := newServer(t, logsDir)
+	defer s.Shutdown(time.Second)
+	after := domainRequests(t, s)
+	if after[checkpointedDomain] != 7 {
+		t.Fatalf("restart didn't load the checkpoint: %v", after)
+	}
+	delete(after, checkpointedDomain)
+	if mustJSON(t, after) != mustJSON(t, before) {
+		t.Errorf("stats after restart %v, before %v", after, before)
+	}
+}
+
+func TestStatsReplayTailAfterCheckpoint(t *testing.T) {
+	logsDir := t.TempDir()
+	runRequests(t, logsDir, 2)
+	plantDomain(t, logsDir)
+	stale, err := os.ReadFile(countersStatePath(logsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run logs more, then its checkpoint is lost, e.g. in a crash
+	want := runRequests(t, logsDir, 3)
+	if err := os.WriteFile(countersStatePath(logsDir), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old checkpoint is loaded and everything logged after it counted
+	s := newServer(t, logsDir)
+	defer s.Shutdown(time.Second)
+	got := domainRequests(t, s)
+	if mustJSON(t, got) != mustJSON(t, want) {
+		t.Errorf("stats %v, want %v", got, want)
+	}
+}
+
+func TestStatsRebuiltFromUnusableCheckpoint(t *testing.T) {
+	for name, spoil := range map[string]func(t *testing.T, logsDir string){
+		"anchor mismatch": func(t *testing.T, logsDir string) {
+			state := readCheckpoint(t, logsDir)
+			state.Domains[checkpointedDomain] = &domainCounters{Requests: 7}
+			state.Anchor = logAnchor([]byte("some other log"))
+			if err := os.WriteFile(countersStatePath(logsDir), []byte(mustJSON(t, state)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"offset past the end": func(t *testing.T, logsDir string) {
+			state := readCheckpoint(t, logsDir)
+			state.Domains[checkpointedDomain] = &domainCounters{Requests: 7}
+			state.Offset += 1 << 20
+			if err := os.WriteFile(countersStatePath(logsDir), []byte(mustJSON(t, state)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"corrupt": func(t *testing.T, logsDir string) {
+			if err := os.WriteFile(countersStatePath(logsDir), []byte(`{"version": 2, "domains": {`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logsDir := t.TempDir()
+			want := runRequests(t, logsDir, 2)
+			spoil(t, logsDir)
+
+			s := newServer(t, logsDir)
+			defer s.Shutdown(time.Second)
+			if got := domainRequests(t, s); mustJSON(t, got) != mustJSON(t, want) {
+				t.Errorf("stats %v, want %v rebuilt from the log", got, want)
+			}
+		})
+	}
+}
+
+// TestStatsCheckpointDuringTraffic saves checkpoints while TLS responses,
+// which count certificate identities, are being logged; run with -race
+func TestStatsCheckpointDuringTraffic(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, false)
+	client := proxiedClient(t, s)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if err := s.Logger().SaveCounters(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/echo", ""))
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// minSlowClientDrain keeps tiny drain times on fast origins from being flagged
+const minSlowClientDrain = 100 * time.Millisecond
+
+// deliveryBody replays a buffered response body to the client and reports
+// once it has been fully consumed or closed. The proxy's relay only reads
+// the next chunk after writing the previous one, so EOF marks the last
+// byte having been written to the client.
+type deliveryBody struct {
+	r         *bytes.Reader
+	size      int64
+	delivered int64
+	once      sync.Once
+	onDone    func(delivered int64, complete bool)
+}
+
+func newDeliveryBody(body []byte, onDone func(delivered int64, complete bool)) *deliveryBody {
+	return &deliveryBody{
+		r:      bytes.NewReader(body),
+		size:   int64(len(body)),
+		onDone: onDone,
+	}
+}
+
+func (b *deliveryBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.delivered += int64(n)
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+// Close reports a partial delivery if the relay gave up before EOF
+func (b *deliveryBody) Close() error {
+	b.finish()
+	return nil
+}
+
+func (b *deliveryBody) finish() {
+	b.once.Do(func() {
+		b.onDone(b.delivered, b.delivered == b.size)
+	})
+}
+
+// logDelivery records when the response finished reaching the client.
+// started is the zero time if the entry was no longer in memory when the
+// response arrived.
+func (l *Logger) logDelivery(requestID string, started, upstreamDone time.Time, delivered int64, complete bool) {
+	clientDone := time.Now().UTC()
+	update := entryUpdate{
+		Type:           "delivery",
+		ID:             requestID,
+		ClientDoneAt:   &clientDone,
+		DeliveredBytes: delivered,
+	}
+
+	// Drain time is only meaningful if the client took the whole body
+	if complete {
+		drain := clientDone.Sub(upstreamDone)
+		update.ClientDrainMs = drain.Milliseconds()
+		if l.slowClientFactor > 0 && !started.IsZero() && drain >= minSlowClientDrain {
+			origin := upstreamDone.Sub(started)
+			update.SlowClient = float64(drain) > l.slowClientFactor*float64(origin)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writeUpdate(update)
+}
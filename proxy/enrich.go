@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many entries a /api/stream subscriber can fall
+// behind before entries are skipped for it
+const subscriberBuffer = 64
+
+// Completion is what's known about a finished request beyond its entry:
+// the full response headers (the entry keeps one value per header) and the
+// upstream TLS state. Both are nil for requests that failed without a
+// response.
+type Completion struct {
+	Header http.Header
+	TLS    *tls.ConnectionState
+}
+
+// Enricher derives something from a completed entry. Enrich returns true
+// if it changed the entry, which is then persisted; only the fields an
+// "enrich" update carries (see LogEnrichment) are kept.
+type Enricher struct {
+	Name     string
+	Priority int // lower runs first
+	Enrich   func(entry *RequestLog, done Completion) bool
+}
+
+// EnricherStats is how an enricher has performed so far
+type EnricherStats struct {
+	Name     string  `json:"name"`
+	Priority int     `json:"priority"`
+	Runs     int64   `json:"runs"`
+	Changed  int64   `json:"changed"` // runs that changed the entry
+	Panics   int64   `json:"panics"`
+	TotalMs  float64 `json:"total_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+}
+
+// EnrichStatus is the state of the pipeline, served by /api/enrichment
+type EnrichStatus struct {
+	Workers     int             `json:"workers"`
+	Queued      int             `json:"queued"`
+	Capacity    int             `json:"capacity"`
+	Processed   int64           `json:"processed"`
+	Dropped     int64           `json:"dropped"` // entries published without enrichment because the queue was full
+	Subscribers int             `json:"subscribers"`
+	Skipped     int64           `json:"skipped"` // entries not sent to subscribers that had fallen behind
+	Enrichers   []EnricherStats `json:"enrichers"`
+}
+
+type enrichJob struct {
+	id   string
+	done Completion
+}
+
+// EnrichPipeline runs the registered enrichers on completed entries in a
+// bounded pool of workers, off the proxy's request path, and publishes the
+// results to /api/stream subscribers. The base entry is already logged
+// when it's submitted; a full queue only costs its enrichment.
+type EnrichPipeline struct {
+	logger  *Logger
+	workers int
+	queue   chan enrichJob
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	closed      bool
+	enrichers   []*Enricher // sorted by priority
+	stats       map[*Enricher]*EnricherStats
+	subscribers map[chan RequestLog]struct{}
+	processed   int64
+	dropped     int64
+	skipped     int64
+}
+
+// NewEnrichPipeline creates a pipeline with the given number of workers and
+// room for queueSize entries waiting for one
+func NewEnrichPipeline(logger *Logger, workers, queueSize int) *EnrichPipeline {
+	return &EnrichPipeline{
+		logger:      logger,
+		workers:     workers,
+		queue:       make(chan enrichJob, queueSize),
+		stats:       make(map[*Enricher]*EnricherStats),
+		subscribers: make(map[chan RequestLog]struct{}),
+	}
+}
+
+// Register adds an enricher. Enrichers with the same priority run in the
+// order they were registered.
+func (p *EnrichPipeline) Register(e Enricher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Workers iterate over their own copy of the slice, so build a new one
+	enricher := &e
+	enrichers := append(append([]*Enricher(nil), p.enrichers...), enricher)
+	sort.SliceStable(enrichers, func(i, j int) bool { return enrichers[i].Priority < enrichers[j].Priority })
+	p.enrichers = enrichers
+	p.stats[enricher] = &EnricherStats{Name: e.Name, Priority: e.Priority}
+}
+
+// Start starts the workers
+func (p *EnrichPipeline) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.queue {
+				p.process(job)
+			}
+		}()
+	}
+}
+
+// Submit queues a completed entry for enrichment, with the response it got
+// (nil if it failed without one). It never blocks: when the queue is full,
+// or the pipeline has been closed, the entry is published as it is.
+func (p *EnrichPipeline) Submit(requestID string, resp *http.Response) {
+	job := enrichJob{id: requestID}
+	if resp != nil {
+		job.done = Completion{Header: resp.Header.Clone(), TLS: resp.TLS}
+	}
+
+	p.mu.Lock()
+	queued := false
+	if !p.closed {
+		select {
+		case p.queue <- job:
+			queued = true
+		default:
+			p.dropped++
+		}
+	}
+	p.mu.Unlock()
+
+	if !queued {
+		if entry, ok := p.logger.GetRequest(requestID); ok {
+			p.publish(entry)
+		}
+	}
+}
+
+// process runs the enrichers on one entry, persists it if any of them
+// changed it, and publishes it
+func (p *EnrichPipeline) process(job enrichJob) {
+	entry, ok := p.logger.GetRequest(job.id)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	enrichers := p.enrichers
+	p.mu.Unlock()
+
+	changed := false
+	for _, e := range enrichers {
+		if p.run(e, &entry, job.done) {
+			changed = true
+		}
+	}
+	if changed {
+		p.logger.LogEnrichment(entry)
+	}
+
+	p.mu.Lock()
+	p.processed++
+	p.mu.Unlock()
+	p.publish(entry)
+}
+
+// run calls one enricher, timing it. A panicking enricher is counted and
+// skipped rather than taking the worker down.
+func (p *EnrichPipeline) run(e *Enricher, entry *RequestLog, done Completion) (changed bool) {
+	start := time.Now()
+	panicked := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+				fmt.Printf("Warning: enricher %s failed on %s: %v\n", e.Name, entry.ID, r)
+			}
+		}()
+		changed = e.Enrich(entry, done)
+	}()
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats[e]
+	s.Runs++
+	s.TotalMs += elapsed
+	if elapsed > s.MaxMs {
+		s.MaxMs = elapsed
+	}
+	if panicked {
+		s.Panics++
+		return false
+	}
+	if changed {
+		s.Changed++
+	}
+	return changed
+}
+
+// Subscribe returns a channel receiving each entry once it's enriched (or
+// dropped from the queue), and a function to stop the subscription
+func (p *EnrichPipeline) Subscribe() (<-chan RequestLog, func()) {
+	ch := make(chan RequestLog, subscriberBuffer)
+	p.mu.Lock()
+	p.subscribers[ch] = struct{}{}
+	p.mu.Unlock()
+
+	return ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[ch]; ok {
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an entry to every subscriber with room for it; decision
+// traces stay with the detail endpoint
+func (p *EnrichPipeline) publish(entry RequestLog) {
+	entry.Debug = nil
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ch := range p.subscribers {
+		select {
+		case ch <- entry:
+		default:
+			p.skipped++
+		}
+	}
+}
+
+// Status reports queue depth, counters and per-enricher timing
+func (p *EnrichPipeline) Status() EnrichStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := EnrichStatus{
+		Workers:     p.workers,
+		Queued:      len(p.queue),
+		Capacity:    cap(p.queue),
+		Processed:   p.processed,
+		Dropped:     p.dropped,
+		Subscribers: len(p.subscribers),
+		Skipped:     p.skipped,
+		Enrichers:   make([]EnricherStats, 0, len(p.enrichers)),
+	}
+	for _, e := range p.enrichers {
+		s := *p.stats[e]
+		if s.Runs > 0 {
+			s.AvgMs = roundMs(s.TotalMs / float64(s.Runs))
+		}
+		s.TotalMs, s.MaxMs = roundMs(s.TotalMs), roundMs(s.MaxMs)
+		status.Enrichers = append(status.Enrichers, s)
+	}
+	return status
+}
+
+// roundMs rounds milliseconds to the microsecond they're measured in
+func roundMs(ms float64) float64 {
+	return math.Round(ms*1000) / 1000
+}
+
+// Close stops accepting entries and waits, until ctx is done, for the
+// queued ones to be enriched. It returns how many weren't.
+func (p *EnrichPipeline) Close(ctx context.Context) int {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return 0
+	case <-ctx.Done():
+		return len(p.queue)
+	}
+}
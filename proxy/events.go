@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents is how many events are kept in memory for the API
+const maxRecentEvents = 200
+
+// Event is a notable proxy occurrence that isn't tied to a single request
+type Event struct {
+	Time time.Time   `json:"time"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+
+	Instance string `json:"instance,omitempty"` // set by the aggregator
+}
+
+// EventLog appends events to events.jsonl and keeps the most recent in memory
+type EventLog struct {
+	file        appendFile
+	mu          sync.Mutex
+	recent      []Event
+	subscribers []func(Event)
+}
+
+// NewEventLog opens (or creates) the event log in the logs directory
+func NewEventLog(logsDir string, readOnly bool) (*EventLog, error) {
+	path := filepath.Join(logsDir, "events.jsonl")
+	file, err := openAppend(path, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	return &EventLog{file: file}, nil
+}
+
+// Emit records an event
+func (e *EventLog) Emit(eventType string, data interface{}) {
+	event := Event{
+		Time: time.Now().UTC(),
+		Type: eventType,
+		Data: data,
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, fn := range e.subscribers {
+		fn(event)
+	}
+
+	e.recent = append(e.recent, event)
+	if len(e.recent) > maxRecentEvents {
+		e.recent = e.recent[len(e.recent)-maxRecentEvents:]
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Failed to marshal %s event: %v\n", eventType, err)
+		return
+	}
+	if _, err := e.file.Write(append(line, '\n')); err != nil {
+		fmt.Printf("Failed to write %s event: %v\n", eventType, err)
+	}
+	e.file.Sync()
+}
+
+// Subscribe calls fn for every event emitted from now on. fn runs with the
+// event log locked, so it must not block or emit events itself.
+func (e *EventLog) Subscribe(fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscribers = append(e.subscribers, fn)
+}
+
+// Recent returns the most recent events, oldest first
+func (e *EventLog) Recent() []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]Event, len(e.recent))
+	copy(result, e.recent)
+	return result
+}
+
+// Close closes the event log
+func (e *EventLog) Close() error {
+	return e.file.Close()
+}
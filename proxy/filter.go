@@ -0,0 +1,601 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A filter expression selects log entries, e.g.
+//
+//	domain =~ "*.openai.com" and (status >= 500 or duration > 2s)
+//
+// Comparisons of a field with a value are combined with "and", "or" and
+// "not" (in decreasing order of precedence: not, and, or) and parentheses.
+// Values are bare words or double-quoted strings.
+
+// FilterError is a filter expression problem at a 1-based column
+type FilterError struct {
+	Column int
+	Msg    string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+type filterTokenKind int
+
+const (
+	tokenWord filterTokenKind = iota
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenEnd
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int // 0-based byte offset
+}
+
+// filterOps are the comparison operators, longest first so "<=" isn't lexed as "<"
+var filterOps = []string{"!=", "<=", ">=", "=~", "!~", "=", "<", ">"}
+
+// isFilterOpChar reports whether c can start an operator, which also ends a bare word
+func isFilterOpChar(c byte) bool {
+	return strings.IndexByte("=!<>~", c) >= 0
+}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			kind := tokenLParen
+			if c == ')' {
+				kind = tokenRParen
+			}
+			tokens = append(tokens, filterToken{kind: kind, text: string(c), pos: i})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				sb.WriteByte(expr[j])
+			}
+			if j >= len(expr) {
+				return nil, &FilterError{Column: i + 1, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: sb.String(), pos: i})
+			i = j + 1
+		case isFilterOpChar(c):
+			op := ""
+			for _, candidate := range filterOps {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &FilterError{Column: i + 1, Msg: fmt.Sprintf("unexpected %q", c)}
+			}
+			tokens = append(tokens, filterToken{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		default:
+			j := i
+			for j < len(expr) && !unicode.IsSpace(rune(expr[j])) && strings.IndexByte(`"()`, expr[j]) < 0 && !isFilterOpChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: expr[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(tokens, filterToken{kind: tokenEnd, pos: len(expr)}), nil
+}
+
+type filterFieldKind int
+
+const (
+	fieldString filterFieldKind = iota
+	fieldNumber
+	fieldDuration
+	fieldTime
+)
+
+// filterField is an entry field that expressions can compare against
+type filterField struct {
+	kind filterFieldKind
+	str  func(*RequestLog) string
+	num  func(*RequestLog) float64
+	time func(*RequestLog) time.Time
+	glob func(pattern, value string) bool // for =~ on strings; path.Match if nil
+}
+
+var filterFields = map[string]filterField{
+	"id":     {kind: fieldString, str: func(e *RequestLog) string { return e.ID }},
+	"domain": {kind: fieldString, str: func(e *RequestLog) string { return e.Domain }},
+	"method": {kind: fieldString, str: func(e *RequestLog) string { return e.Method }},
+	"scheme": {kind: fieldString, str: func(e *RequestLog) string { return e.Scheme }},
+	"path":   {kind: fieldString, str: func(e *RequestLog) string { return e.Path }, glob: matchPath},
+	"error":  {kind: fieldString, str: func(e *RequestLog) string { return e.Error }},
+	"status": {kind: fieldNumber, num: func(e *RequestLog) float64 { return float64(e.ResponseStatus) }},
+	"bytes":  {kind: fieldNumber, num: func(e *RequestLog) float64 { return float64(e.DeliveredBytes) }},
+	"cost":   {kind: fieldNumber, num: func(e *RequestLog) float64 { return llmCost(e) }},
+	// Time from the request to the last byte from the origin
+	"duration": {kind: fieldDuration, num: func(e *RequestLog) float64 { return float64(e.OriginMs) }},
+	"time":     {kind: fieldTime, time: func(e *RequestLog) time.Time { return e.Timestamp }},
+	"trace_id": {kind: fieldString, str: func(e *RequestLog) string { return e.TraceID }},
+	"provider": {kind: fieldString, str: serverProvider},
+	"secret":   {kind: fieldString, str: func(e *RequestLog) string { return e.Secret }},
+}
+
+// llmCost is the estimated cost of an entry's LLM call, 0 for other requests
+func llmCost(e *RequestLog) float64 {
+	if e.LLM == nil {
+		return 0
+	}
+	return e.LLM.CostUSD
+}
+
+// filterFieldNames lists the fields for error messages
+func filterFieldNames() string {
+	names := make([]string, 0, len(filterFields))
+	for name := range filterFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// filterNode is a parsed expression that can be evaluated against an entry
+type filterNode interface {
+	match(e *RequestLog, now time.Time) bool
+	// describe returns the node as JSON-friendly data for /api/filter/validate
+	describe() interface{}
+}
+
+type andNode []filterNode
+
+func (n andNode) match(e *RequestLog, now time.Time) bool {
+	for _, child := range n {
+		if !child.match(e, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n andNode) describe() interface{} {
+	return map[string]interface{}{"and": describeAll(n)}
+}
+
+type orNode []filterNode
+
+func (n orNode) match(e *RequestLog, now time.Time) bool {
+	for _, child := range n {
+		if child.match(e, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n orNode) describe() interface{} {
+	return map[string]interface{}{"or": describeAll(n)}
+}
+
+type notNode struct{ child filterNode }
+
+func (n notNode) match(e *RequestLog, now time.Time) bool {
+	return !n.child.match(e, now)
+}
+
+func (n notNode) describe() interface{} {
+	return map[string]interface{}{"not": n.child.describe()}
+}
+
+func describeAll(nodes []filterNode) []interface{} {
+	result := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		result[i] = n.describe()
+	}
+	return result
+}
+
+// compareNode compares one field with a value
+type compareNode struct {
+	name  string
+	field filterField
+	op    string
+	value string // as written
+	str   string
+	num   float64
+	at    time.Time     // absolute time, or
+	ago   time.Duration // time relative to evaluation, when at is zero
+}
+
+func (n *compareNode) match(e *RequestLog, now time.Time) bool {
+	switch n.field.kind {
+	case fieldString:
+		value := n.field.str(e)
+		switch n.op {
+		case "=":
+			return strings.EqualFold(value, n.str)
+		case "!=":
+			return !strings.EqualFold(value, n.str)
+		case "=~", "!~":
+			glob := n.field.glob
+			if glob == nil {
+				glob = func(pattern, value string) bool {
+					ok, _ := path.Match(pattern, value)
+					return ok
+				}
+			}
+			return glob(n.str, value) == (n.op == "=~")
+		}
+	case fieldNumber, fieldDuration:
+		return compareOrdered(n.field.num(e), n.num, n.op)
+	case fieldTime:
+		at := n.at
+		if at.IsZero() {
+			at = now.Add(-n.ago)
+		}
+		value := n.field.time(e)
+		switch {
+		case value.Before(at):
+			return compareOrdered(-1, 0, n.op)
+		case value.After(at):
+			return compareOrdered(1, 0, n.op)
+		default:
+			return compareOrdered(0, 0, n.op)
+		}
+	}
+	return false
+}
+
+func (n *compareNode) describe() interface{} {
+	return map[string]interface{}{"field": n.name, "op": n.op, "value": n.value}
+}
+
+func compareOrdered(a, b float64, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// Filter is a parsed filter expression
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// ParseFilter parses a filter expression. Errors are *FilterError.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	if p.peek().kind == tokenEnd {
+		return nil, &FilterError{Column: 1, Msg: "empty expression"}
+	}
+
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEnd {
+		msg := fmt.Sprintf("expected \"and\", \"or\" or end of expression, got %q", tok.text)
+		if tok.kind == tokenRParen {
+			msg = "unmatched )"
+		}
+		return nil, &FilterError{Column: tok.pos + 1, Msg: msg}
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// combineFilters returns a filter matching entries that match all of
+// filters; nil filters are skipped, and nil is returned if none remain
+func combineFilters(filters ...*Filter) *Filter {
+	var parts []string
+	var nodes andNode
+	for _, f := range filters {
+		if f != nil {
+			parts = append(parts, "("+f.expr+")")
+			nodes = append(nodes, f.root)
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		for _, f := range filters {
+			if f != nil {
+				return f
+			}
+		}
+	}
+	return &Filter{expr: strings.Join(parts, " and "), root: nodes}
+}
+
+// filterSugar compiles the simple query parameters (?domain=, ?status=,
+// ?since=, ...) into a filter. String fields match as globs, so a plain
+// value still matches exactly.
+func filterSugar(params map[string][]string) (*Filter, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var filters []*Filter
+	for _, name := range names {
+		field, op := name, "="
+		switch name {
+		case "since":
+			field, op = "time", ">="
+		case "until":
+			field, op = "time", "<"
+		default:
+			f, ok := filterFields[name]
+			if !ok {
+				continue
+			}
+			if f.kind == fieldString {
+				op = "=~"
+			}
+		}
+		for _, value := range params[name] {
+			f, err := ParseFilter(field + " " + op + " " + quoteFilterValue(value))
+			if err != nil {
+				var ferr *FilterError
+				if errors.As(err, &ferr) {
+					err = errors.New(ferr.Msg)
+				}
+				return nil, fmt.Errorf("invalid %s parameter: %v", name, err)
+			}
+			filters = append(filters, f)
+		}
+	}
+	return combineFilters(filters...), nil
+}
+
+// quoteFilterValue quotes a value for use in an expression
+func quoteFilterValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Describe returns the parsed expression tree as JSON-friendly data
+func (f *Filter) Describe() interface{} {
+	return f.root.describe()
+}
+
+// Match reports whether the entry matches the filter
+func (f *Filter) Match(e *RequestLog) bool {
+	return f.root.match(e, time.Now())
+}
+
+// maxFilterDepth bounds how deeply "not" and parentheses can nest, so a
+// hostile expression can't exhaust the stack of the parser or of Match
+const maxFilterDepth = 64
+
+type filterParser struct {
+	tokens []filterToken
+	i      int
+	depth  int // "not"s and parentheses enclosing the current token
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.i]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.i]
+	if tok.kind != tokenEnd {
+		p.i++
+	}
+	return tok
+}
+
+// keyword reports whether the next token is the given keyword
+func (p *filterParser) keyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokenWord && strings.EqualFold(tok.text, word)
+}
+
+// or parses and-expressions joined by "or"
+func (p *filterParser) or() (filterNode, error) {
+	var terms orNode
+	for {
+		term, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !p.keyword("or") {
+			break
+		}
+		p.next()
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+// and parses unary expressions joined by "and"
+func (p *filterParser) and() (filterNode, error) {
+	var terms andNode
+	for {
+		term, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !p.keyword("and") {
+			break
+		}
+		p.next()
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+// nest enters a "not" or parenthesis at tok, failing past maxFilterDepth;
+// the caller leaves it with p.depth--
+func (p *filterParser) nest(tok filterToken) error {
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return &FilterError{Column: tok.pos + 1, Msg: fmt.Sprintf("expression nested more than %d levels deep", maxFilterDepth)}
+	}
+	return nil
+}
+
+// unary parses "not x", "(expr)" or a comparison
+func (p *filterParser) unary() (filterNode, error) {
+	if p.keyword("not") {
+		if err := p.nest(p.next()); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		child, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	if open := p.peek(); open.kind == tokenLParen {
+		if err := p.nest(p.next()); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokenRParen {
+			return nil, &FilterError{Column: open.pos + 1, Msg: "unclosed ("}
+		}
+		return inner, nil
+	}
+	return p.comparison()
+}
+
+// comparison parses "field op value"
+func (p *filterParser) comparison() (filterNode, error) {
+	name := p.next()
+	if name.kind != tokenWord || p.isKeyword(name) {
+		got := name.text
+		if name.kind == tokenEnd {
+			got = "end of expression"
+		}
+		return nil, &FilterError{Column: name.pos + 1, Msg: fmt.Sprintf("expected a field name, got %s", got)}
+	}
+	field, ok := filterFields[strings.ToLower(name.text)]
+	if !ok {
+		return nil, &FilterError{Column: name.pos + 1, Msg: fmt.Sprintf("unknown field %q (fields: %s)", name.text, filterFieldNames())}
+	}
+
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, &FilterError{Column: op.pos + 1, Msg: fmt.Sprintf("expected an operator after %s", name.text)}
+	}
+	if !fieldAllowsOp(field.kind, op.text) {
+		return nil, &FilterError{Column: op.pos + 1, Msg: fmt.Sprintf("operator %s can't be used with %s", op.text, name.text)}
+	}
+
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, &FilterError{Column: value.pos + 1, Msg: fmt.Sprintf("expected a value after %s %s", name.text, op.text)}
+	}
+	return parseFilterValue(strings.ToLower(name.text), field, op.text, value)
+}
+
+func (p *filterParser) isKeyword(tok filterToken) bool {
+	switch strings.ToLower(tok.text) {
+	case "and", "or", "not":
+		return true
+	}
+	return false
+}
+
+func fieldAllowsOp(kind filterFieldKind, op string) bool {
+	switch kind {
+	case fieldString:
+		return op == "=" || op == "!=" || op == "=~" || op == "!~"
+	default:
+		return op != "=~" && op != "!~"
+	}
+}
+
+// parseFilterValue checks value against the field's type
+func parseFilterValue(name string, field filterField, op string, value filterToken) (filterNode, error) {
+	n := &compareNode{name: name, field: field, op: op, value: value.text}
+	bad := func(format string, args ...interface{}) error {
+		return &FilterError{Column: value.pos + 1, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	switch field.kind {
+	case fieldString:
+		n.str = value.text
+		if op == "=~" || op == "!~" {
+			if _, err := path.Match(value.text, ""); err != nil {
+				return nil, bad("invalid pattern %q", value.text)
+			}
+		}
+	case fieldNumber:
+		num, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, bad("%q is not a number", value.text)
+		}
+		n.num = num
+	case fieldDuration:
+		d, err := time.ParseDuration(value.text)
+		if err != nil {
+			return nil, bad("%q is not a duration like 500ms or 2s", value.text)
+		}
+		n.num = float64(d.Milliseconds())
+	case fieldTime:
+		if at, err := time.Parse(time.RFC3339, value.text); err == nil {
+			n.at = at
+		} else if d, err := time.ParseDuration(value.text); err == nil && d < 0 {
+			n.ago = -d
+		} else {
+			return nil, bad("%q is not an RFC 3339 time or a negative duration like -1h", value.text)
+		}
+	}
+	return n, nil
+}
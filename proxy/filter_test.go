@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// filterTree renders a parsed expression compactly, e.g.
+// (or (and status >= "500" …) …)
+func filterTree(n filterNode) string {
+	children := func(op string, nodes []filterNode) string {
+		parts := []string{op}
+		for _, child := range nodes {
+			parts = append(parts, filterTree(child))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	switch n := n.(type) {
+	case andNode:
+		return children("and", n)
+	case orNode:
+		return children("or", n)
+	case notNode:
+		return "(not " + filterTree(n.child) + ")"
+	case *compareNode:
+		return n.name + " " + n.op + " " + strconv.Quote(n.value)
+	}
+	return "?"
+}
+
+func TestFilterGrammar(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want string
+	}{
+		{`status >= 500`, `status >= "500"`},
+		{`status>=500`, `status >= "500"`},
+		{`Domain =~ "*.openai.com"`, `domain =~ "*.openai.com"`},
+		{`path = "a \"quoted\" \\ path"`, `path = "a \"quoted\" \\ path"`},
+		{`method = GET and status = 200 and error = ""`, `(and method = "GET" status = "200" error = "")`},
+		{`method = GET or method = PUT or method = POST`, `(or method = "GET" method = "PUT" method = "POST")`},
+		// not binds tighter than and, and tighter than or
+		{`status = 1 or status = 2 and status = 3`, `(or status = "1" (and status = "2" status = "3"))`},
+		{`not status = 1 and status = 2`, `(and (not status = "1") status = "2")`},
+		{`not not status = 1`, `(not (not status = "1"))`},
+		{`NOT status = 1 AND status = 2 OR status = 3`, `(or (and (not status = "1") status = "2") status = "3")`},
+		{`(status = 1 or status = 2) and status = 3`, `(and (or status = "1" status = "2") status = "3")`},
+		{`not (status = 1 or status = 2)`, `(not (or status = "1" status = "2"))`},
+		{`((status = 1))`, `status = "1"`},
+		{`duration > 2s and time >= -1h`, `(and duration > "2s" time >= "-1h")`},
+		{`time < 2026-01-02T03:04:05Z`, `time < "2026-01-02T03:04:05Z"`},
+		{`cost > 0.5`, `cost > "0.5"`},
+		// The deepest nesting allowed
+		{strings.Repeat("(", maxFilterDepth) + "status = 1" + strings.Repeat(")", maxFilterDepth), `status = "1"`},
+		{strings.Repeat("not ", maxFilterDepth) + "status = 1", strings.Repeat("(not ", maxFilterDepth) + `status = "1"` + strings.Repeat(")", maxFilterDepth)},
+	} {
+		f, err := ParseFilter(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := filterTree(f.root); got != tc.want {
+			t.Errorf("%s parsed as\n\t%s\nwant\n\t%s", tc.expr, got, tc.want)
+		}
+		if f.String() != tc.expr {
+			t.Errorf("%s: String() is %q", tc.expr, f.String())
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	deepParens := strings.Repeat("(", maxFilterDepth+1) + "status = 1" + strings.Repeat(")", maxFilterDepth+1)
+	deepNots := strings.Repeat("not ", maxFilterDepth+1) + "status = 1"
+	for _, tc := range []struct {
+		expr   string
+		column int
+		msg    string
+	}{
+		{``, 1, "empty expression"},
+		{`   `, 1, "empty expression"},
+		{`status`, 7, "expected an operator after status"},
+		{`status >=`, 10, "expected a value after status >="},
+		{`status = (`, 10, "expected a value after status ="},
+		{`bogus = 1`, 1, `unknown field "bogus"`},
+		{`and status = 1`, 1, "expected a field name, got and"},
+		{`status = 1 and`, 15, "expected a field name, got end of expression"},
+		{`status = 1 or not`, 18, "expected a field name, got end of expression"},
+		{`domain > x`, 8, "operator > can't be used with domain"},
+		{`status =~ 5*`, 8, "operator =~ can't be used with status"},
+		{`status = abc`, 10, `"abc" is not a number`},
+		{`duration > 5`, 12, `"5" is not a duration`},
+		{`time >= 1h`, 9, `"1h" is not an RFC 3339 time or a negative duration`},
+		{`path =~ "[a"`, 9, `invalid pattern "[a"`},
+		{`path = "abc`, 8, "unterminated string"},
+		{`status ! 1`, 8, `unexpected '!'`},
+		{`(status = 1`, 1, "unclosed ("},
+		{`status = 1 and (status = 2 or (status = 3)`, 16, "unclosed ("},
+		{`status = 1)`, 11, "unmatched )"},
+		{`status = 1 status = 2`, 12, `expected "and", "or" or end of expression, got "status"`},
+		{deepParens, maxFilterDepth + 1, "nested more than 64 levels deep"},
+		{deepNots, 4*maxFilterDepth + 1, "nested more than 64 levels deep"},
+		{strings.Repeat("not (", 40) + "status = 1" + strings.Repeat(")", 40), 5*32 + 1, "nested more than 64 levels deep"},
+	} {
+		_, err := ParseFilter(tc.expr)
+		var ferr *FilterError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%q: got %v, want a FilterError", tc.expr, err)
+			continue
+		}
+		if ferr.Column != tc.column || !strings.Contains(ferr.Msg, tc.msg) {
+			t.Errorf("%q: column %d %q, want column %d %q", tc.expr, ferr.Column, ferr.Msg, tc.column, tc.msg)
+		}
+	}
+}
+
+func TestFilterSugar(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params map[string][]string
+		tree   string
+		expr   string
+	}{
+		{"none", map[string][]string{}, "", ""},
+		{"only unrelated parameters", map[string][]string{"q": {"status = 1"}, "limit": {"10"}}, "", ""},
+		{"string fields match as globs", map[string][]string{"domain": {"*.openai.com"}}, `domain =~ "*.openai.com"`, `domain =~ "*.openai.com"`},
+		{"a plain value still matches exactly", map[string][]string{"method": {"POST"}}, `method =~ "POST"`, `method =~ "POST"`},
+		{"numbers compare", map[string][]string{"status": {"404"}}, `status = "404"`, `status = "404"`},
+		{"since and until bound the time", map[string][]string{"since": {"-1h"}, "until": {"2026-01-02T00:00:00Z"}},
+			`(and time >= "-1h" time < "2026-01-02T00:00:00Z")`, `(time >= "-1h") and (time < "2026-01-02T00:00:00Z")`},
+		{"values are quoted", map[string][]string{"path": {`/a "b"`}}, `path =~ "/a \"b\""`, `path =~ "/a \"b\""`},
+		{"everything is and-ed, by parameter name", map[string][]string{"status": {"500", "502"}, "domain": {"api.example.com"}},
+			`(and domain =~ "api.example.com" status = "500" status = "502")`,
+			`(domain =~ "api.example.com") and (status = "500") and (status = "502")`},
+	} {
+		f, err := filterSugar(tc.params)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.tree == "" {
+			if f != nil {
+				t.Errorf("%s: got filter %s, want none", tc.name, f)
+			}
+			continue
+		}
+		if f == nil {
+			t.Errorf("%s: got no filter, want %s", tc.name, tc.tree)
+			continue
+		}
+		if got := filterTree(f.root); got != tc.tree || f.String() != tc.expr {
+			t.Errorf("%s: got %s from %q, want %s from %q", tc.name, got, f.String(), tc.tree, tc.expr)
+		}
+	}
+
+	// Errors name the parameter rather than a column of a generated expression
+	for _, tc := range []struct {
+		params map[string][]string
+		want   string
+	}{
+		{map[string][]string{"status": {"abc"}}, `invalid status parameter: "abc" is not a number`},
+		{map[string][]string{"since": {"yesterday"}}, `invalid since parameter: "yesterday" is not an RFC 3339 time`},
+		{map[string][]string{"path": {"[a"}}, `invalid path parameter: invalid pattern "[a"`},
+	} {
+		_, err := filterSugar(tc.params)
+		var ferr *FilterError
+		if err == nil || errors.As(err, &ferr) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got %v, want %q", tc.params, err, tc.want)
+		}
+	}
+}
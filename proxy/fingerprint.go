@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/apart-work-test/proxy/version"
+)
+
+// proxyEnvVars are the environment variables that affect where traffic goes.
+// Only these are fingerprinted, and only as hashes.
+var proxyEnvVars = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY",
+	"http_proxy", "https_proxy", "no_proxy", "all_proxy",
+}
+
+// containerIDPattern matches a docker/containerd container ID in cgroup or mount paths
+var containerIDPattern = regexp.MustCompile(`(?:docker|containers|cri-containerd|libpod)[-/]([0-9a-f]{64})`)
+
+// Fingerprint describes the environment a run was captured in
+type Fingerprint struct {
+	CapturedAt    time.Time         `json:"captured_at"`
+	Build         version.Info      `json:"build"`
+	OS            string            `json:"os"`
+	Arch          string            `json:"arch"`
+	ContainerID   string            `json:"container_id,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+	ConfigHash    string            `json:"config_hash"`
+	CAFingerprint string            `json:"ca_fingerprint"`
+}
+
+// CaptureFingerprint collects the environment fingerprint for this process
+func CaptureFingerprint(cfg *Config, ca *CAConfig) Fingerprint {
+	fp := Fingerprint{
+		CapturedAt:    time.Now().UTC(),
+		Build:         version.Get(),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		ContainerID:   detectContainerID(),
+		Env:           make(map[string]string),
+		ConfigHash:    configHash(cfg),
+		CAFingerprint: fmt.Sprintf("sha256:%x", sha256.Sum256(ca.Cert.Raw)),
+	}
+
+	for _, name := range proxyEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			fp.Env[name] = hashValue(value)
+		}
+	}
+
+	return fp
+}
+
+// SaveFingerprint appends the fingerprint to the environment history in the logs dir
+func SaveFingerprint(logsDir string, readOnly bool, fp Fingerprint) error {
+	data, err := json.Marshal(fp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fingerprint: %w", err)
+	}
+
+	path := filepath.Join(logsDir, "environment.jsonl")
+	file, err := openAppend(path, readOnly)
+	if err != nil {
+		return fmt.Errorf("failed to open environment log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write fingerprint: %w", err)
+	}
+	return file.Sync()
+}
+
+// configHash hashes the effective configuration so runs with identical
+// configuration can be matched up. API tokens are left out (see Config).
+func configHash(cfg *Config) string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	return hashValue(string(data))
+}
+
+// detectContainerID returns the container ID if running under docker/containerd
+func detectContainerID() string {
+	for _, path := range []string{"/proc/self/cgroup", "/proc/self/mountinfo"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if m := containerIDPattern.FindSubmatch(data); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// hashValue returns a short, stable hash that identifies a value without revealing it
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkLogsDir creates the logs directory if needed and makes sure files
+// can be created in it. The error names the path and what's missing.
+func checkLogsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create logs directory %s: %w%s", dir, pathCause(err), writeHint(err, "its parent"))
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("logs directory %s is not writable: %w%s", dir, pathCause(err), writeHint(err, "it"))
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// pathCause drops the path from a filesystem error, for messages that
+// already name it
+func pathCause(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// writeHint explains what a failed write to a directory needs
+func writeHint(err error, what string) string {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return " (the filesystem is mounted read-only; mount a writable volume there)"
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Sprintf(" (uid %d needs write and execute permission on %s)", os.Getuid(), what)
+	}
+	return ""
+}
+
+// appendFile is an append-only log file, such as requests.jsonl
+type appendFile interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// discardFile stands in for an append-only log while nothing is persisted
+type discardFile struct{}
+
+func (discardFile) Write(p []byte) (int, error) { return len(p), nil }
+func (discardFile) Sync() error                 { return nil }
+func (discardFile) Close() error                { return nil }
+
+// openAppend opens path for appending, creating it if needed. When the
+// logs directory is read-only (-allow-readonly-logs), writes are discarded.
+func openAppend(path string, readOnly bool) (appendFile, error) {
+	if readOnly {
+		return discardFile{}, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and
+// renames it into place so readers never see a partially written file.
+// Stores whose logs directory is read-only don't call it: they keep their
+// state in memory and only read what's already on disk.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to chmod temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	// Sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
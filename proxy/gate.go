@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	errPolicyDenied      = errors.New("not allowed by the proxy policy")
+	errLLMBudgetExceeded = errors.New("LLM budget exceeded")
+)
+
+// Gate makes the decisions every request leaving the proxy is subject to,
+// whether it's proxied, replayed or composed: the policy allowlist and the
+// LLM budget
+type Gate struct {
+	rules *RuleStore
+	llm   *LLMBudget
+}
+
+// GateDecision is what the gate decided about one request
+type GateDecision struct {
+	Policy     string // "" if allowed, otherwise "flagged" or "blocked"
+	OverBudget string // why an LLM call is refused, if it is
+}
+
+// NewGate creates a gate checking requests against the current rules
+func NewGate(rules *RuleStore, llm *LLMBudget) *Gate {
+	return &Gate{rules: rules, llm: llm}
+}
+
+// Check decides about req, recording each decision on trace
+func (g *Gate) Check(req *http.Request, trace *DecisionTrace) GateDecision {
+	var d GateDecision
+	rules := g.rules.Get()
+
+	// Once a budget is spent, LLM calls are refused rather than forwarded
+	if rules.LLM.recognizes(req.Method, req.URL.Hostname()) {
+		d.OverBudget = g.llm.Refusal()
+		trace.Add("llm_budget", req.URL.Hostname(), d.OverBudget != "", d.OverBudget)
+	}
+
+	// Requests outside the policy allowlist are flagged, or refused once it's enforced
+	if active := rules.Policy; active != nil {
+		d.Policy = active.decide(req.Method, req.URL.Hostname(), req.URL.Path)
+		action := d.Policy
+		if action == "" {
+			action = "allowed"
+		}
+		trace.Add("policy", active.Mode, d.Policy == "", action)
+	}
+	return d
+}
+
+// Refuse logs why the entry for req is refused, if it is, and returns the
+// response to answer it with; nil means it may go upstream
+func (d GateDecision) Refuse(logger *Logger, requestID string, req *http.Request) *http.Response {
+	switch {
+	case d.Policy == "blocked":
+		logger.LogError(requestID, "policy_denied")
+		fmt.Printf("[%s] Refused: not allowed by the policy\n", requestID)
+		return policyResponse(req)
+	case d.OverBudget != "":
+		logger.LogError(requestID, "llm_budget_exceeded")
+		fmt.Printf("[%s] Refused: %s\n", requestID, d.OverBudget)
+		return llmBudgetResponse(req, d.OverBudget)
+	}
+	return nil
+}
+
+// Err is the error a replayed or composed request refused by d fails with
+func (d GateDecision) Err() error {
+	switch {
+	case d.Policy == "blocked":
+		return errPolicyDenied
+	case d.OverBudget != "":
+		return fmt.Errorf("%w: %s", errLLMBudgetExceeded, d.OverBudget)
+	}
+	return nil
+}
@@ -5,4 +5,5 @@ go 1.22
 require (
 	github.com/elazarl/goproxy v0.0.0-20231117061959-7cc037d33fb5
 	github.com/google/uuid v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// handshakeWindow is how far back failed client handshakes count toward
+// the /api/health hint
+const handshakeWindow = 10 * time.Minute
+
+// pendingHandshakeTimeout is how long a MITM'd connection is matched to
+// goproxy's report of its handshake failing; handshakes finish long before
+const pendingHandshakeTimeout = time.Minute
+
+// maxRecentHandshakeFailures bounds the failures counted toward the hint
+const maxRecentHandshakeFailures = 1000
+
+// goproxy's report of a failed client handshake, after the session prefix
+const handshakeFailedReport = "] WARN: Cannot handshake client "
+
+// untrustedCAAlerts are how handshakes fail when the client rejects the
+// certificate the proxy presented, almost always because it doesn't have
+// the proxy CA installed. OpenSSL-based clients (curl, Python) rejecting it
+// over TLS 1.3 send an alert Go's server reads as a bad record MAC.
+var untrustedCAAlerts = []string{"unknown certificate authority", "certificate unknown", "bad certificate", "bad record MAC"}
+
+// HandshakeFailure is a MITM'd connection whose client handshake failed
+type HandshakeFailure struct {
+	SNI       string `json:"sni,omitempty"`
+	Client    string `json:"client,omitempty"` // client address
+	Error     string `json:"error"`
+	MissingCA bool   `json:"missing_ca,omitempty"` // the failure looks like the client rejecting the proxy's certificate
+}
+
+// missingCA reports whether a handshake error means the client doesn't
+// trust the proxy CA
+func missingCA(reason string) bool {
+	for _, alert := range untrustedCAAlerts {
+		if strings.Contains(reason, alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingHandshake is a CONNECT whose client handshake hasn't finished
+type pendingHandshake struct {
+	req     *http.Request
+	sni     string
+	started time.Time
+}
+
+// handshakeFailedAt is a failure counted toward the health hint
+type handshakeFailedAt struct {
+	at      time.Time
+	domain  string
+	failure HandshakeFailure
+}
+
+// HandshakeMonitor turns failed client handshakes on MITM'd connections
+// into entries. goproxy only reports them through its logger, so the
+// monitor stands in as that logger and matches each report, by session and
+// host, to the CONNECT the TLS config was built for.
+type HandshakeMonitor struct {
+	mu        sync.Mutex
+	next      goproxy.Logger // where goproxy's other messages still go
+	logger    *Logger
+	pipeline  *EnrichPipeline
+	events    *EventLog
+	threshold int // failures within handshakeWindow that raise the hint; 0 disables
+	pending   map[string]*pendingHandshake
+	recent    []handshakeFailedAt // within handshakeWindow, oldest first
+	alerted   bool                // the tls_handshake_failures event fired and hasn't re-armed
+}
+
+// NewHandshakeMonitor creates a monitor that passes the messages it doesn't
+// handle on to next
+func NewHandshakeMonitor(next goproxy.Logger, logger *Logger, pipeline *EnrichPipeline, events *EventLog, threshold int) *HandshakeMonitor {
+	return &HandshakeMonitor{
+		next:      next,
+		logger:    logger,
+		pipeline:  pipeline,
+		events:    events,
+		threshold: threshold,
+		pending:   make(map[string]*pendingHandshake),
+	}
+}
+
+// handshakeKey identifies a connection the way goproxy's log messages do
+func handshakeKey(session, host string) string {
+	return session + " " + host
+}
+
+// TLSConfig wraps a goproxy TLS config func so the handshakes on the
+// connections it configures are tracked
+func (m *HandshakeMonitor) TLSConfig(inner func(string, *goproxy.ProxyCtx) (*tls.Config, error)) func(string, *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := inner(host, ctx)
+		if err != nil || ctx.Req == nil {
+			return config, err
+		}
+		key := handshakeKey(fmt.Sprintf("%03d", ctx.Session&0xFF), ctx.Req.Host)
+		pending := &pendingHandshake{req: ctx.Req, started: time.Now()}
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			m.mu.Lock()
+			pending.sni = hello.ServerName
+			m.mu.Unlock()
+			return nil, nil
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for k, p := range m.pending {
+			if time.Since(p.started) > pendingHandshakeTimeout {
+				delete(m.pending, k)
+			}
+		}
+		m.pending[key] = pending
+		return config, nil
+	}
+}
+
+// Printf implements goproxy.Logger
+func (m *HandshakeMonitor) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	session, rest, ok := strings.Cut(strings.TrimPrefix(msg, "["), handshakeFailedReport)
+	if !ok {
+		m.next.Printf(format, v...)
+		return
+	}
+	host, reason, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	m.failed(handshakeKey(session, host), host, reason)
+}
+
+// failed records the failed handshake of the connection key
+func (m *HandshakeMonitor) failed(key, host, reason string) {
+	failure := HandshakeFailure{Error: reason, MissingCA: missingCA(reason)}
+
+	m.mu.Lock()
+	req := &http.Request{Method: http.MethodConnect, Host: host, URL: &url.URL{Host: host}, Header: make(http.Header)}
+	if p, ok := m.pending[key]; ok {
+		delete(m.pending, key)
+		req, failure.SNI = p.req, p.sni
+		failure.Client = req.RemoteAddr
+	}
+	m.mu.Unlock()
+
+	// Group the entry with the MITM'd requests to the same host, which
+	// carry the client's Host header rather than the CONNECT's port
+	logged := *req
+	logged.Host = strings.TrimSuffix(req.Host, ":443")
+	entry := m.logger.LogRequest(&logged, LogOptions{Redact: []string{"Proxy-Authorization"}, Handshake: &failure})
+	m.logger.LogError(entry.ID, "tls_handshake_failed: "+reason)
+	m.pipeline.Submit(entry.ID, nil)
+	if failure.MissingCA {
+		fmt.Printf("[%s] CONNECT %s: client handshake failed: %s (the client likely doesn't trust the proxy CA)\n", entry.ID, req.Host, reason)
+	} else {
+		fmt.Printf("[%s] CONNECT %s: client handshake failed: %s\n", entry.ID, req.Host, reason)
+	}
+
+	m.mu.Lock()
+	m.recent = append(m.recent, handshakeFailedAt{at: time.Now(), domain: logged.Host, failure: failure})
+	if len(m.recent) > maxRecentHandshakeFailures {
+		m.recent = m.recent[len(m.recent)-maxRecentHandshakeFailures:]
+	}
+	hint, fire := m.hintLocked()
+	count := len(m.recent)
+	if fire {
+		m.alerted = true
+	}
+	m.mu.Unlock()
+	if fire && m.events != nil {
+		m.events.Emit("tls_handshake_failures", map[string]interface{}{
+			"failures": count,
+			"window":   handshakeWindow.String(),
+			"hint":     hint,
+		})
+	}
+}
+
+// Hint explains the client handshakes failing recently, or returns "" if
+// fewer than the threshold have
+func (m *HandshakeMonitor) Hint() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hint, _ := m.hintLocked()
+	return hint
+}
+
+// hintLocked drops failures that have left the window and builds the hint.
+// fire reports whether the hint just turned on. Callers must hold m.mu.
+func (m *HandshakeMonitor) hintLocked() (hint string, fire bool) {
+	cutoff := time.Now().Add(-handshakeWindow)
+	i := 0
+	for i < len(m.recent) && m.recent[i].at.Before(cutoff) {
+		i++
+	}
+	m.recent = m.recent[i:]
+	if m.threshold <= 0 || len(m.recent) < m.threshold {
+		m.alerted = false // re-arms once failures drop below the threshold
+		return "", false
+	}
+
+	untrusted := 0
+	for _, f := range m.recent {
+		if f.failure.MissingCA {
+			untrusted++
+		}
+	}
+	last := m.recent[len(m.recent)-1]
+	hint = fmt.Sprintf("%d client TLS handshakes failed in the last %s (last: %s: %s)",
+		len(m.recent), handshakeWindow, last.domain, last.failure.Error)
+	if untrusted > 0 {
+		hint += fmt.Sprintf("; %d look like clients rejecting the proxy's certificate; they most likely don't have the proxy CA (ca.crt in the logs directory) installed", untrusted)
+	}
+	return hint, !m.alerted
+}
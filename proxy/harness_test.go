@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a proxy on ephemeral ports with a fresh logs directory.
+// args are extra command-line flags. The server is shut down when the test
+// ends.
+func startServer(t *testing.T, args ...string) *Server {
+	t.Helper()
+	s := newServer(t, t.TempDir(), args...)
+	t.Cleanup(func() { s.Shutdown(time.Second) })
+	return s
+}
+
+// startServerWithTokens is startServer with API tokens, which main reads
+// from the environment rather than flags
+func startServerWithTokens(t *testing.T, token, adminToken string, args ...string) *Server {
+	t.Helper()
+	s := buildServer(t, t.TempDir(), func(cfg *Config) { cfg.WebToken, cfg.WebAdminToken = token, adminToken }, args...)
+	t.Cleanup(func() { s.Shutdown(time.Second) })
+	return s
+}
+
+// newServer builds and starts a server on logsDir without registering a
+// cleanup, for tests that restart or shut down servers themselves
+func newServer(t *testing.T, logsDir string, args ...string) *Server {
+	t.Helper()
+	return buildServer(t, logsDir, nil, args...)
+}
+
+// buildServer parses args like main does, lets configure adjust the
+// result, then builds and starts the server
+func buildServer(t *testing.T, logsDir string, configure func(*Config), args ...string) *Server {
+	t.Helper()
+	var cfg Config
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	defaults := []string{"-proxy=127.0.0.1:0", "-web=127.0.0.1:0", "-logs=" + logsDir}
+	if err := fs.Parse(append(defaults, args...)); err != nil {
+		t.Fatal(err)
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Fatalf("invalid config: %v", errs)
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := NewServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s
+}
+
+// writeRules writes a rules file for -rules and returns its path
+func writeRules(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// proxiedClient is an HTTP client that goes through s and trusts its CA
+func proxiedClient(t *testing.T, s *Server) *http.Client {
+	t.Helper()
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(s.CACert()) {
+		t.Fatal("server CA certificate doesn't parse")
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: s.ProxyAddr()}
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+		// Tests look at each hop's entry themselves
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// fetch sends a request through the client and returns the response body
+func fetch(t *testing.T, client *http.Client, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", req.URL, err)
+	}
+	return resp, string(body)
+}
+
+// newRequest builds a request, failing the test on a malformed URL
+func newRequest(t *testing.T, method, rawURL, body string) *http.Request {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// waitForEntry polls the server's log until an entry satisfies match, so
+// tests don't race the updates written after a response is relayed
+func waitForEntry(t *testing.T, s *Server, match func(RequestLog) bool) RequestLog {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, e := range s.Logger().GetRequests() {
+			if match(e) {
+				return e
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no matching entry among %d logged", len(s.Logger().GetRequests()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFor polls until cond holds, failing the test after 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// apiRequest calls the server's API and returns the status and body
+func apiRequest(t *testing.T, s *Server, method, path, body string, header http.Header) (int, string) {
+	t.Helper()
+	req := newRequest(t, method, "http://"+s.WebAddr()+path, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// compose POSTs a request template to /api/compose
+func compose(t *testing.T, s *Server, template string) (int, string) {
+	t.Helper()
+	return apiRequest(t, s, http.MethodPost, "/api/compose", template, http.Header{"Content-Type": {"application/json"}})
+}
+
+// getJSON decodes a successful API GET into v
+func getJSON(t *testing.T, s *Server, path string, v interface{}) {
+	t.Helper()
+	status, body := apiRequest(t, s, http.MethodGet, path, "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", path, status, body)
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("GET %s: %v in %s", path, err, body)
+	}
+}
+
+// mustJSON marshals v for inspection
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// originRequest is what the origin's /echo endpoint saw
+type originRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// newOrigin starts an origin server, over TLS unless plain is set. It
+// serves:
+//
+//	/echo            the request as an originRequest
+//	/delay?ms=N      "ok" after N milliseconds
+//	/chunked?n=N     N chunks of "chunk i\n", flushed one by one
+//	/large?kb=N&ms=M N KB of a repeating pattern, pausing M milliseconds halfway
+//	/gzip            a gzip-encoded body
+//	/redirect?to=U   a 302 to U
+//	/ws              a WebSocket handshake, then echoes raw bytes back
+func newOrigin(t *testing.T, plain bool) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(originRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header, Body: string(body)})
+	})
+	mux.HandleFunc("/delay", func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		kb, _ := strconv.Atoi(r.URL.Query().Get("kb"))
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		body := largeBody(kb)
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		w.Write(body[len(body)/2:])
+	})
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, "compressed body")
+		gz.Close()
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			base64.StdEncoding.EncodeToString(sum[:]))
+		rw.Flush()
+		io.Copy(conn, rw.Reader)
+	})
+
+	var origin *httptest.Server
+	if plain {
+		origin = httptest.NewServer(mux)
+	} else {
+		origin = httptest.NewTLSServer(mux)
+	}
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// largeBody is what the origin's /large endpoint serves
+func largeBody(kb int) []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), kb*64)
+}
+
+// dialUpgrade sends a WebSocket upgrade for target through the proxy as an
+// absolute-form request and returns the connection once it's switched
+func dialUpgrade(t *testing.T, s *Server, target string) (*bufio.ReadWriter, func()) {
+	t.Helper()
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).Dial("tcp", s.ProxyAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	fmt.Fprintf(rw, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", target, u.Host)
+	rw.Flush()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(rw.Reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("upgrade answered %d", resp.StatusCode)
+	}
+	return rw, func() { conn.Close() }
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflightEntry is a request that has been logged but not yet fully
+// relayed back to the client
+type inflightEntry struct {
+	ID      string    `json:"id"`
+	Domain  string    `json:"domain"`
+	Started time.Time `json:"started"`
+}
+
+// InFlight tracks requests from LogRequest until their response body has
+// been relayed or the client has gone away, so shutdown and /api/inflight
+// have one place to look
+type InFlight struct {
+	mu       sync.Mutex
+	entries  map[string]inflightEntry
+	draining bool
+	drained  int // requests completed since draining started
+	changed  chan struct{}
+}
+
+// NewInFlight creates an empty registry
+func NewInFlight() *InFlight {
+	return &InFlight{
+		entries: make(map[string]inflightEntry),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Add registers a request as in flight
+func (f *InFlight) Add(id, domain string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[id] = inflightEntry{ID: id, Domain: domain, Started: time.Now()}
+}
+
+// Done marks a request as finished. Unknown IDs are ignored.
+func (f *InFlight) Done(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.entries[id]; !ok {
+		return
+	}
+	delete(f.entries, id)
+	if f.draining {
+		f.drained++
+	}
+
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+// DoneOnClose wraps a response body so the request is marked finished once
+// the relay reads it to the end, fails reading it or closes it, e.g.
+// because the client went away. finished, if set, runs just before.
+func (f *InFlight) DoneOnClose(id string, body io.ReadCloser, finished func()) io.ReadCloser {
+	return &inflightBody{ReadCloser: body, done: func() {
+		if finished != nil {
+			finished()
+		}
+		f.Done(id)
+	}}
+}
+
+// inflightBody calls done once its body is exhausted or closed
+type inflightBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *inflightBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *inflightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// Len returns the number of requests in flight
+func (f *InFlight) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.entries)
+}
+
+// Snapshot returns the requests in flight, oldest first
+func (f *InFlight) Snapshot() []inflightEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := make([]inflightEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Started.Before(entries[j].Started)
+	})
+	return entries
+}
+
+// StartDraining begins counting completions and returns how many requests
+// are in flight at that moment
+func (f *InFlight) StartDraining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.draining = true
+	f.drained = 0
+	return len(f.entries)
+}
+
+// Wait blocks until nothing is in flight or ctx is done. It returns how
+// many requests completed since StartDraining and those still outstanding.
+func (f *InFlight) Wait(ctx context.Context) (int, []inflightEntry) {
+	for f.Len() > 0 {
+		select {
+		case <-f.changed:
+		case <-ctx.Done():
+			f.mu.Lock()
+			drained := f.drained
+			f.mu.Unlock()
+			return drained, f.Snapshot()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.drained, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInFlightUntilBodyRelayed checks that a request stays in flight after
+// its response headers arrive, until the body is relayed or the client
+// hangs up
+func TestInFlightUntilBodyRelayed(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(largeBody(64))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			io.WriteString(w, "second half")
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+
+	// Verified bodies stream to the client instead of being buffered, and
+	// the first half overflows the relay's write buffer, so the headers
+	// arrive while the origin is still sending
+	s := startServer(t, "-rules="+verifyRules(t, ""))
+	client := proxiedClient(t, s)
+	inFlight := func() int {
+		var health struct {
+			InFlight int `json:"in_flight"`
+		}
+		getJSON(t, s, "/api/health", &health)
+		return health.InFlight
+	}
+
+	for _, finish := range []string{"relayed", "client closed"} {
+		t.Run(finish, func(t *testing.T) {
+			resp, err := client.Get(origin.URL + "/" + finish)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/"+finish && e.ResponseStatus != 0 })
+
+			// Headers are in, the body isn't
+			if n := inFlight(); n != 1 {
+				t.Errorf("%d in flight once headers arrived, want 1", n)
+			}
+			var listed []inflightEntry
+			getJSON(t, s, "/api/inflight", &listed)
+			if len(listed) != 1 || listed[0].ID != entry.ID {
+				t.Errorf("/api/inflight lists %+v, want %s", listed, entry.ID)
+			}
+
+			if finish == "relayed" {
+				release <- struct{}{}
+				if body, err := io.ReadAll(resp.Body); err != nil || string(body) != string(largeBody(64))+"second half" {
+					t.Fatalf("client read %d bytes, %v", len(body), err)
+				}
+			} else {
+				resp.Body.Close()
+				client.Transport.(*http.Transport).CloseIdleConnections()
+			}
+			waitFor(t, "the request to leave the in-flight registry", func() bool { return inFlight() == 0 })
+		})
+	}
+}
+
+// TestEnrichedOnceBodyRelayed checks that entries reach the enrichers and
+// /api/stream with what's only known once the body has been relayed
+func TestEnrichedOnceBodyRelayed(t *testing.T) {
+	s := startServer(t, "-rules="+verifyRules(t, ""))
+	origin := newOrigin(t, true)
+
+	resp, err := http.Get("http://" + s.WebAddr() + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	streamed := make(chan RequestLog)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var entry RequestLog
+				if json.Unmarshal([]byte(data), &entry) == nil {
+					streamed <- entry
+				}
+			}
+		}
+		close(streamed)
+	}()
+	next := func() RequestLog {
+		t.Helper()
+		select {
+		case entry, ok := <-streamed:
+			if !ok {
+				t.Fatal("stream ended early")
+			}
+			return entry
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing streamed")
+		}
+		return RequestLog{}
+	}
+
+	// A verified body streams through, its second half well after the
+	// headers; a 404 is buffered and replayed
+	client := proxiedClient(t, s)
+	fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/large?kb=64&ms=300", ""))
+	entry := next()
+	if entry.Content == nil || entry.Content.SHA256 == "" || entry.Content.Partial {
+		t.Errorf("verified entry streamed with content %+v, want its hash", entry.Content)
+	}
+	if entry.ClientDoneAt == nil || entry.DeliveredBytes != 64<<10 {
+		t.Errorf("verified entry streamed with delivery %v, %d bytes", entry.ClientDoneAt, entry.DeliveredBytes)
+	}
+
+	fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/missing", ""))
+	entry = next()
+	if entry.ResponseStatus != http.StatusNotFound || entry.ClientDoneAt == nil || entry.DeliveredBytes == 0 {
+		t.Errorf("buffered entry streamed with status %d, delivery %v, %d bytes", entry.ResponseStatus, entry.ClientDoneAt, entry.DeliveredBytes)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apart-work-test/proxy/version"
+)
+
+// orphanedError marks entries whose proxy exited before they got a response
+const orphanedError = "orphaned_by_restart"
+
+// runStart is the marker each run appends to requests.jsonl before logging
+// anything. Entries carry the epoch of the run that logged them, so after a
+// crash any prior-epoch entry without a response can't still be in flight.
+// The build and config hash say which proxy, configured how, logged them.
+type runStart struct {
+	Type       string       `json:"type"` // always "run_start"
+	Epoch      int          `json:"epoch"`
+	StartedAt  time.Time    `json:"started_at"`
+	PID        int          `json:"pid"`
+	Build      version.Info `json:"build"`
+	ConfigHash string       `json:"config_hash,omitempty"`
+}
+
+// pending reports whether an entry is still waiting for a response
+func (r *RequestLog) pending() bool {
+	return r.ResponseStatus == 0 && r.Error == ""
+}
+
+// startEpoch writes the run-start marker for the next epoch after the last
+// one in the log, then finalizes entries earlier runs left pending. entries
+// is the whole parsed log, not just the in-memory window. Callers must hold
+// l.mu.
+func (l *Logger) startEpoch(entries []RequestLog, runs []runStart) error {
+	last := 0
+	for _, run := range runs {
+		last = max(last, run.Epoch)
+	}
+	// Entries can outlive their marker (e.g. a hand-edited log); never reuse an epoch
+	for _, entry := range entries {
+		last = max(last, entry.Epoch)
+	}
+
+	marker := runStart{
+		Type:       "run_start",
+		Epoch:      last + 1,
+		StartedAt:  time.Now().UTC(),
+		PID:        os.Getpid(),
+		Build:      l.fingerprint.Build,
+		ConfigHash: l.fingerprint.ConfigHash,
+	}
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run start: %w", err)
+	}
+	if err := l.appendRecord(data); err != nil {
+		return fmt.Errorf("failed to write run start: %w", err)
+	}
+	l.epoch = marker.Epoch
+
+	orphaned := 0
+	for _, entry := range entries {
+		if entry.Epoch < l.epoch && entry.pending() {
+			l.writeUpdate(entryUpdate{Type: "error", ID: entry.ID, Error: orphanedError})
+			orphaned++
+		}
+	}
+	if orphaned > 0 {
+		fmt.Printf("Marked %d requests from earlier runs as %s\n", orphaned, orphanedError)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apart-work-test/proxy/version"
+)
+
+// crashedLog is a requests.jsonl as a proxy that crashed mid-write leaves
+// it: a response-less entry from each run, a record glued onto the partial
+// write before it, and a last line cut off mid-record
+const crashedLog = `{"type":"run_start","epoch":1,"started_at":"2026-01-01T00:00:00Z","pid":100}
+{"id":"answered","timestamp":"2026-01-01T00:00:01Z","method":"GET","path":"/answered","headers":{},"pcap_file":"","epoch":1}
+{"type":"response","id":"answered","response_status":200}
+{"id":"pending-run1","timestamp":"2026-01-01T00:00:02Z","method":"GET","path":"/pending","headers":{},"pcap_file":"","epoch":1}
+{"type":"run_start","epoch":2,"started_at":"2026-01-02T00:00:00Z","pid":200}
+{"id":"glued","timestamp":"2026-01-02T00:00:01Z","method":"GET","pa{"id":"pending-run2","timestamp":"2026-01-02T00:00:02Z","method":"GET","path":"/salvaged","headers":{},"pcap_file":"","epoch":2}
+{"id":"cut","timestamp":"2026-01-02T00:00:03Z","method":"GET","path":"/cu`
+
+func TestReopenAfterCrash(t *testing.T) {
+	logsDir := t.TempDir()
+	logPath := filepath.Join(logsDir, "requests.jsonl")
+	if err := os.WriteFile(logPath, []byte(crashedLog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(t, logsDir)
+	byID := make(map[string]RequestLog)
+	for _, e := range s.Logger().GetRequests() {
+		byID[e.ID] = e
+	}
+
+	// The damaged records are dropped, the record glued after one is kept
+	for _, id := range []string{"glued", "cut"} {
+		if _, ok := byID[id]; ok {
+			t.Errorf("loaded the truncated record %q", id)
+		}
+	}
+	if len(byID) != 3 {
+		t.Fatalf("loaded %d entries, want answered, pending-run1 and pending-run2", len(byID))
+	}
+
+	// Entries from both earlier runs that never got a response are orphaned;
+	// the answered one is left alone
+	for _, id := range []string{"pending-run1", "pending-run2"} {
+		if e := byID[id]; e.Error != orphanedError {
+			t.Errorf("%s has error %q, want %s", id, e.Error, orphanedError)
+		}
+	}
+	if e := byID["answered"]; e.ResponseStatus != http.StatusOK || e.Error != "" {
+		t.Errorf("answered entry has status %d, error %q", e.ResponseStatus, e.Error)
+	}
+
+	// What this run logs gets the next epoch, in a record of its own rather
+	// than glued onto the cut-off line
+	origin := newOrigin(t, true)
+	fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo?after=crash", ""))
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" && e.ResponseStatus != 0 })
+	if entry.Epoch != 3 {
+		t.Errorf("new entry logged in epoch %d, want 3", entry.Epoch)
+	}
+	s.Shutdown(time.Second)
+
+	// Reopening once more finds the new entry and marks nothing again
+	s = newServer(t, logsDir)
+	defer s.Shutdown(time.Second)
+	detail, ok := s.Logger().GetRequest(entry.ID)
+	if !ok || detail.ResponseStatus != http.StatusOK || detail.Error != "" {
+		t.Errorf("after a second restart %s shows %+v", entry.ID, detail)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, runs, _ := parseLogLines(data)
+	if len(runs) != 4 || runs[2].Epoch != 3 || runs[3].Epoch != 4 {
+		t.Errorf("log has run markers %+v, want epochs 1 to 4", runs)
+	}
+	if run := runs[len(runs)-1]; run.Build != version.Get() || run.ConfigHash != configHash(s.cfg) {
+		t.Errorf("run marker records build %+v, config hash %q", run.Build, run.ConfigHash)
+	}
+	for _, e := range entries {
+		if e.ID == "pending-run1" && e.Error != orphanedError {
+			t.Errorf("orphaning of %s didn't reach the log: %q", e.ID, e.Error)
+		}
+	}
+	if n := bytes.Count(data, []byte(`"error":"`+orphanedError+`"`)); n != 2 {
+		t.Errorf("log has %d orphan updates, want one per pending entry", n)
+	}
+	if !strings.Contains(string(data), "/cu\n") {
+		t.Error("the cut-off last line wasn't terminated before the next append")
+	}
+}
+
+// TestCrashWithRequestInFlight snapshots the log of a running proxy while
+// a request is waiting on its origin, as a crash would leave it, and
+// reopens the snapshot
+func TestCrashWithRequestInFlight(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	s := startServer(t)
+	go proxiedClient(t, s).Get(origin.URL + "/slow")
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/slow" })
+	if !entry.pending() || entry.Epoch != 1 {
+		t.Fatalf("in-flight entry is %+v, want pending in epoch 1", entry)
+	}
+	data, err := os.ReadFile(filepath.Join(s.Logger().logsDir, "requests.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The running proxy still owns the entry; only the reopened copy gives up on it
+	crashed := t.TempDir()
+	if err := os.WriteFile(filepath.Join(crashed, "requests.jsonl"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reopened := startServer(t, "-logs="+crashed)
+	if e, _ := reopened.Logger().GetRequest(entry.ID); e.Error != orphanedError {
+		t.Errorf("reopened log shows %s with error %q, want %s", entry.ID, e.Error, orphanedError)
+	}
+	if e, _ := s.Logger().GetRequest(entry.ID); !e.pending() {
+		t.Errorf("the running proxy's entry changed: %+v", e)
+	}
+}
+
+func TestEpochNeverReused(t *testing.T) {
+	// An entry can outlive its run's marker, e.g. in a hand-edited log
+	logsDir := t.TempDir()
+	log := `{"type":"run_start","epoch":1,"started_at":"2026-01-01T00:00:00Z","pid":100}
+{"id":"later","timestamp":"2026-01-03T00:00:00Z","method":"GET","path":"/later","headers":{},"pcap_file":"","epoch":5}
+`
+	if err := os.WriteFile(filepath.Join(logsDir, "requests.jsonl"), []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(t, logsDir)
+	defer s.Shutdown(time.Second)
+	if epoch := s.Logger().epoch; epoch != 6 {
+		t.Errorf("started epoch %d, want 6", epoch)
+	}
+	if e, _ := s.Logger().GetRequest("later"); e.Error != orphanedError {
+		t.Errorf("entry from epoch 5 has error %q, want %s", e.Error, orphanedError)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// llmScopes are the budgets -llm-budget can set: spend since the proxy
+// started (or was reset), and spend across runs
+var llmScopes = []string{"run", "total"}
+
+// Reasons an LLM call was charged the -llm-unknown-cost default
+const (
+	estimatedNoUsage      = "no_usage"      // the response had no usage block, e.g. a stream without one
+	estimatedUnknownModel = "unknown_model" // no price for the model
+	estimatedNotCaptured  = "not_captured"  // the response body wasn't buffered
+)
+
+// defaultLLMHosts are recognized as LLM APIs unless the rules file lists its own
+var defaultLLMHosts = []string{"api.openai.com", "api.anthropic.com"}
+
+// defaultLLMPrices are list prices in dollars per million tokens, by model
+// glob. The rules file's llm.prices take precedence.
+var defaultLLMPrices = map[string]LLMPrice{
+	"gpt-4o*":            {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini*":       {Input: 0.15, Output: 0.60},
+	"gpt-4.1*":           {Input: 2.00, Output: 8.00},
+	"gpt-4.1-mini*":      {Input: 0.40, Output: 1.60},
+	"o3-mini*":           {Input: 1.10, Output: 4.40},
+	"o4-mini*":           {Input: 1.10, Output: 4.40},
+	"claude-3-5-haiku*":  {Input: 0.80, Output: 4.00},
+	"claude-3-5-sonnet*": {Input: 3.00, Output: 15.00},
+	"claude-3-7-sonnet*": {Input: 3.00, Output: 15.00},
+	"claude-sonnet-4*":   {Input: 3.00, Output: 15.00},
+	"claude-3-opus*":     {Input: 15.00, Output: 75.00},
+	"claude-opus-4*":     {Input: 15.00, Output: 75.00},
+}
+
+// LLMPrice is the cost of a model in dollars per million tokens
+type LLMPrice struct {
+	Input  float64 `yaml:"input" json:"input"`
+	Output float64 `yaml:"output" json:"output"`
+}
+
+// LLMRules configures which hosts are LLM APIs and how their calls are priced
+type LLMRules struct {
+	Hosts  []string            `yaml:"hosts"`  // hostname globs; replaces the defaults
+	Prices map[string]LLMPrice `yaml:"prices"` // by model glob, checked before the defaults
+}
+
+// recognizes reports whether a request is a call to an LLM API
+func (r LLMRules) recognizes(method, host string) bool {
+	if method != "POST" {
+		return false
+	}
+	hosts := r.Hosts
+	if hosts == nil {
+		hosts = defaultLLMHosts
+	}
+	for _, pattern := range hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// price returns the price of model: the longest matching glob in the rules
+// file, else the longest matching default
+func (r LLMRules) price(model string) (LLMPrice, bool) {
+	for _, table := range []map[string]LLMPrice{r.Prices, defaultLLMPrices} {
+		best, found := "", false
+		for pattern := range table {
+			if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(best) {
+				best, found = pattern, true
+			}
+		}
+		if found {
+			return table[best], true
+		}
+	}
+	return LLMPrice{}, false
+}
+
+// LLMUsage is the token usage and estimated cost of one LLM API call
+type LLMUsage struct {
+	Model         string   `json:"model,omitempty"`
+	InputTokens   int64    `json:"input_tokens,omitempty"`
+	OutputTokens  int64    `json:"output_tokens,omitempty"`
+	CostUSD       float64  `json:"cost_usd"`
+	Estimated     string   `json:"estimated,omitempty"`      // why the cost is the -llm-unknown-cost default
+	BudgetWarning []string `json:"budget_warning,omitempty"` // budgets past the warning level after this call, e.g. "run 82%"
+}
+
+// usageBlock covers OpenAI (prompt/completion) and Anthropic (input/output,
+// cache reads and writes) usage fields
+type usageBlock struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	InputTokens         int64 `json:"input_tokens"`
+	OutputTokens        int64 `json:"output_tokens"`
+	CacheCreationTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// llmReply is the part of a response, or of one streamed event, that
+// carries the model and usage. Anthropic's message_start nests them.
+type llmReply struct {
+	Model   string      `json:"model"`
+	Usage   *usageBlock `json:"usage"`
+	Message *struct {
+		Model string      `json:"model"`
+		Usage *usageBlock `json:"usage"`
+	} `json:"message"`
+	Response *struct { // OpenAI Responses API stream events
+		Model string      `json:"model"`
+		Usage *usageBlock `json:"usage"`
+	} `json:"response"`
+}
+
+// parseLLMUsage reads the model and token counts from a JSON response or a
+// server-sent event stream. Streams report usage across several events, so
+// the largest count of each kind wins.
+func parseLLMUsage(body []byte) (model string, input, output int64, ok bool) {
+	observe := func(data []byte) {
+		var reply llmReply
+		if json.Unmarshal(data, &reply) != nil {
+			return
+		}
+		models := []string{reply.Model}
+		usages := []*usageBlock{reply.Usage}
+		if reply.Message != nil {
+			models = append(models, reply.Message.Model)
+			usages = append(usages, reply.Message.Usage)
+		}
+		if reply.Response != nil {
+			models = append(models, reply.Response.Model)
+			usages = append(usages, reply.Response.Usage)
+		}
+		for _, m := range models {
+			if model == "" {
+				model = m
+			}
+		}
+		for _, u := range usages {
+			if u == nil {
+				continue
+			}
+			ok = true
+			input = max(input, u.PromptTokens+u.InputTokens+u.CacheCreationTokens+u.CacheReadTokens)
+			output = max(output, u.CompletionTokens+u.OutputTokens)
+		}
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		observe(trimmed)
+		return
+	}
+	for _, line := range splitLines(body) {
+		if data, found := bytes.CutPrefix(line, []byte("data:")); found {
+			observe(bytes.TrimSpace(data))
+		}
+	}
+	return
+}
+
+// requestModel matches the model field of a (possibly truncated) request body
+var requestModel = regexp.MustCompile(`"model"\s*:\s*"([^"]+)"`)
+
+// estimateLLMUsage prices a successful LLM call. body is nil when the
+// response wasn't buffered; requestBody is the captured request body.
+func estimateLLMUsage(rules LLMRules, requestBody string, body []byte, unknownCost float64) *LLMUsage {
+	usage := &LLMUsage{}
+	if m := requestModel.FindStringSubmatch(requestBody); m != nil {
+		usage.Model = m[1]
+	}
+	if body == nil {
+		usage.CostUSD, usage.Estimated = unknownCost, estimatedNotCaptured
+		return usage
+	}
+
+	model, input, output, ok := parseLLMUsage(body)
+	if model != "" {
+		usage.Model = model
+	}
+	usage.InputTokens, usage.OutputTokens = input, output
+	price, priced := rules.price(usage.Model)
+	switch {
+	case !ok:
+		usage.CostUSD, usage.Estimated = unknownCost, estimatedNoUsage
+	case !priced:
+		usage.CostUSD, usage.Estimated = unknownCost, estimatedUnknownModel
+	default:
+		usage.CostUSD = (float64(input)*price.Input + float64(output)*price.Output) / 1e6
+	}
+	return usage
+}
+
+// llmBudgetResponse answers an LLM call refused by the budget, in a shape
+// both OpenAI and Anthropic clients surface as an error message
+func llmBudgetResponse(req *http.Request, reason string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": "llm_budget_exceeded", "message": reason},
+	})
+	return goproxy.NewResponse(req, "application/json", http.StatusPaymentRequired, string(body))
+}
+
+// parseLLMLimits parses -llm-budget, e.g. "run=5.00,total=50.00"
+func parseLLMLimits(s string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+	for _, item := range splitList(s) {
+		scope, value, ok := strings.Cut(item, "=")
+		scope = strings.TrimSpace(scope)
+		if !ok || (scope != "run" && scope != "total") {
+			return nil, fmt.Errorf("%q must be run=<dollars> or total=<dollars>", item)
+		}
+		if _, dup := limits[scope]; dup {
+			return nil, fmt.Errorf("%s is set twice", scope)
+		}
+		dollars, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(value), "$"), 64)
+		if err != nil || dollars <= 0 || math.IsInf(dollars, 0) {
+			return nil, fmt.Errorf("%s budget %q must be a positive number of dollars", scope, value)
+		}
+		limits[scope] = dollars
+	}
+	return limits, nil
+}
+
+// modelSpend is what one model has cost within a scope
+type modelSpend struct {
+	Requests     int     `json:"requests"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+}
+
+// llmSpend is the spend within one scope
+type llmSpend struct {
+	Since     time.Time              `json:"since"`
+	SpentUSD  float64                `json:"spent_usd"`
+	Requests  int                    `json:"requests"`
+	Estimated int                    `json:"estimated"` // calls charged the -llm-unknown-cost default
+	Models    map[string]*modelSpend `json:"models"`
+}
+
+func newLLMSpend() *llmSpend {
+	return &llmSpend{Since: time.Now().UTC(), Models: make(map[string]*modelSpend)}
+}
+
+func (s *llmSpend) add(u *LLMUsage) {
+	s.SpentUSD += u.CostUSD
+	s.Requests++
+	if u.Estimated != "" {
+		s.Estimated++
+	}
+	model := u.Model
+	if model == "" {
+		model = "unknown"
+	}
+	m, ok := s.Models[model]
+	if !ok {
+		m = &modelSpend{}
+		s.Models[model] = m
+	}
+	m.Requests++
+	m.InputTokens += u.InputTokens
+	m.OutputTokens += u.OutputTokens
+	m.CostUSD += u.CostUSD
+}
+
+// LLMBudget tracks estimated LLM spend against the -llm-budget limits,
+// warning once a budget passes the warning level and, when enforcing,
+// refusing further LLM calls once one is spent
+type LLMBudget struct {
+	limits      map[string]float64 // by scope; a missing scope is unlimited
+	warnAt      float64            // fraction of a limit
+	enforce     bool
+	unknownCost float64
+	path        string // persisted total spend
+	readOnly    bool   // the logs directory can't be written; keep the spend in memory
+	events      *EventLog
+
+	mu      sync.Mutex
+	spend   map[string]*llmSpend
+	alerted map[string]string // last level emitted per scope, "warning" or "exceeded"
+}
+
+// LLMBudgetStatus is the response of /api/budget
+type LLMBudgetStatus struct {
+	Limits         map[string]float64  `json:"limits"`
+	WarnAt         float64             `json:"warn_at"`
+	Enforce        bool                `json:"enforce"`
+	UnknownCostUSD float64             `json:"unknown_cost_usd"`
+	Scopes         map[string]llmScope `json:"scopes"`
+	Exceeded       []string            `json:"exceeded"`
+}
+
+type llmScope struct {
+	*llmSpend
+	RemainingUSD *float64 `json:"remaining_usd,omitempty"` // unset without a limit
+}
+
+// NewLLMBudget restores the total spend from the logs directory. The run
+// budget starts empty.
+func NewLLMBudget(logsDir string, readOnly bool, limits map[string]float64, warnAt float64, enforce bool, unknownCost float64, events *EventLog) (*LLMBudget, error) {
+	b := &LLMBudget{
+		limits:      limits,
+		warnAt:      warnAt,
+		enforce:     enforce,
+		unknownCost: unknownCost,
+		path:        filepath.Join(logsDir, "llm_spend.json"),
+		readOnly:    readOnly,
+		events:      events,
+		spend:       map[string]*llmSpend{"run": newLLMSpend(), "total": newLLMSpend()},
+		alerted:     make(map[string]string),
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, fmt.Errorf("failed to read LLM spend: %w", err)
+	}
+	total := newLLMSpend()
+	if err := json.Unmarshal(data, total); err != nil {
+		return nil, fmt.Errorf("failed to parse LLM spend %s: %w", b.path, err)
+	}
+	if total.Models == nil {
+		total.Models = make(map[string]*modelSpend)
+	}
+	b.spend["total"] = total
+	return b, nil
+}
+
+// budgetEvent is the data of llm_budget_warning and llm_budget_exceeded events
+type budgetEvent struct {
+	Scope    string  `json:"scope"`
+	LimitUSD float64 `json:"limit_usd"`
+	SpentUSD float64 `json:"spent_usd"`
+}
+
+// Charge adds a call's cost to every scope, marking it with the budgets past
+// the warning level and emitting an event each time a budget crosses a level
+func (b *LLMBudget) Charge(usage *LLMUsage) {
+	type pending struct {
+		level string
+		event budgetEvent
+	}
+	var emit []pending
+
+	b.mu.Lock()
+	for _, scope := range llmScopes {
+		spend := b.spend[scope]
+		spend.add(usage)
+		limit, ok := b.limits[scope]
+		if !ok {
+			continue
+		}
+		level := ""
+		switch {
+		case spend.SpentUSD >= limit:
+			level = "exceeded"
+		case spend.SpentUSD >= limit*b.warnAt:
+			level = "warning"
+		}
+		if level == "" {
+			continue
+		}
+		usage.BudgetWarning = append(usage.BudgetWarning, fmt.Sprintf("%s %.0f%%", scope, 100*spend.SpentUSD/limit))
+		if b.alerted[scope] != level {
+			b.alerted[scope] = level
+			emit = append(emit, pending{level, budgetEvent{Scope: scope, LimitUSD: limit, SpentUSD: spend.SpentUSD}})
+		}
+	}
+	err := b.save()
+	b.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	for _, p := range emit {
+		fmt.Printf("LLM %s budget %s: $%.2f of $%.2f spent\n", p.event.Scope, p.level, p.event.SpentUSD, p.event.LimitUSD)
+		b.events.Emit("llm_budget_"+p.level, p.event)
+	}
+}
+
+// Refusal returns why LLM calls are being refused, or "" if they aren't
+func (b *LLMBudget) Refusal() string {
+	if !b.enforce {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, scope := range llmScopes {
+		if limit, ok := b.limits[scope]; ok && b.spend[scope].SpentUSD >= limit {
+			return fmt.Sprintf("the %s LLM budget of $%.2f is spent ($%.2f estimated); the proxy is refusing LLM API calls until it is reset with POST /api/budget/reset?scope=%s",
+				scope, limit, b.spend[scope].SpentUSD, scope)
+		}
+	}
+	return ""
+}
+
+// Status reports spend, remaining budget and spend per model in each scope
+func (b *LLMBudget) Status() LLMBudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := LLMBudgetStatus{
+		Limits:         b.limits,
+		WarnAt:         b.warnAt,
+		Enforce:        b.enforce,
+		UnknownCostUSD: b.unknownCost,
+		Scopes:         make(map[string]llmScope, len(llmScopes)),
+		Exceeded:       []string{},
+	}
+	for _, scope := range llmScopes {
+		// Copy so the caller can encode it without holding the lock
+		spend := *b.spend[scope]
+		spend.Models = make(map[string]*modelSpend, len(b.spend[scope].Models))
+		for model, m := range b.spend[scope].Models {
+			copied := *m
+			spend.Models[model] = &copied
+		}
+		s := llmScope{llmSpend: &spend}
+		if limit, ok := b.limits[scope]; ok {
+			remaining := max(limit-spend.SpentUSD, 0)
+			s.RemainingUSD = &remaining
+			if spend.SpentUSD >= limit {
+				status.Exceeded = append(status.Exceeded, scope)
+			}
+		}
+		status.Scopes[scope] = s
+	}
+	return status
+}
+
+var errUnknownScope = errors.New(`scope must be "run" or "total"`)
+
+// Reset clears the spend in scope, re-arming its warnings
+func (b *LLMBudget) Reset(scope string) error {
+	if scope != "run" && scope != "total" {
+		return errUnknownScope
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.spend[scope] = newLLMSpend()
+	delete(b.alerted, scope)
+	return b.save()
+}
+
+// save persists the total spend. Callers must hold b.mu.
+func (b *LLMBudget) save() error {
+	if b.readOnly {
+		return nil
+	}
+	data, err := json.Marshal(b.spend["total"])
+	if err == nil {
+		err = writeFileAtomic(b.path, data, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save LLM spend: %w", err)
+	}
+	return nil
+}
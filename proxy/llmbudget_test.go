@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// startOverBudget starts a server, with the given API tokens if any, that
+// treats the local origin as an LLM API and has already spent its run
+// budget on one call through the proxy, which it returns
+func startOverBudget(t *testing.T, tokens ...string) (*Server, string, RequestLog) {
+	t.Helper()
+	rules := writeRules(t, "version: 1\nllm:\n  hosts: [127.0.0.1]\n")
+	args := []string{"-rules=" + rules, "-llm-budget=run=0.10", "-llm-budget-enforce", "-llm-unknown-cost=1"}
+	var s *Server
+	if len(tokens) == 2 {
+		s = startServerWithTokens(t, tokens[0], tokens[1], args...)
+	} else {
+		s = startServer(t, args...)
+	}
+	origin := newOrigin(t, true)
+
+	fetch(t, proxiedClient(t, s), newRequest(t, http.MethodPost, origin.URL+"/echo", `{"model": "unknown"}`))
+	spent := waitForEntry(t, s, func(e RequestLog) bool { return e.LLM != nil })
+	waitFor(t, "the run budget to be spent", func() bool { return len(s.logger.llm.Status().Exceeded) > 0 })
+	return s, origin.URL, spent
+}
+
+func TestLLMBudgetRefusesReplayAndCompose(t *testing.T) {
+	s, originURL, spent := startOverBudget(t)
+
+	status, body := apiRequest(t, s, http.MethodPost, "/api/requests/"+spent.ID+"/replay", "", nil)
+	if status != http.StatusPaymentRequired || !strings.Contains(body, "LLM budget") {
+		t.Errorf("replay over budget: %d %s", status, body)
+	}
+	template := `{"method": "POST", "url": "` + originURL + `/echo", "body": "{}"}`
+	status, body = compose(t, s, template)
+	if status != http.StatusPaymentRequired {
+		t.Errorf("compose over budget: %d %s", status, body)
+	}
+
+	// Both are logged as refused, and neither reached the origin
+	for _, e := range s.Logger().GetRequests() {
+		if e.ID == spent.ID {
+			continue
+		}
+		if e.Error != "llm_budget_exceeded" || e.ResponseStatus != http.StatusPaymentRequired {
+			t.Errorf("%s logged error %q, status %d", e.ID, e.Error, e.ResponseStatus)
+		}
+	}
+}
+
+func TestLLMBudgetResetNeedsPrivilege(t *testing.T) {
+	t.Run("without tokens", func(t *testing.T) {
+		s, _, _ := startOverBudget(t)
+
+		// A page in the operator's browser can POST here, but it says where it's from
+		crossSite := http.Header{"Origin": {"http://agent.example"}}
+		if status, body := apiRequest(t, s, http.MethodPost, "/api/budget/reset", "", crossSite); status != http.StatusForbidden {
+			t.Errorf("cross-origin reset: %d %s", status, body)
+		}
+		if len(s.logger.llm.Status().Exceeded) == 0 {
+			t.Fatal("a refused reset lifted the stop")
+		}
+
+		sameSite := http.Header{"Origin": {"http://" + s.WebAddr()}}
+		if status, body := apiRequest(t, s, http.MethodPost, "/api/budget/reset", "", sameSite); status != http.StatusOK {
+			t.Fatalf("same-origin loopback reset: %d %s", status, body)
+		}
+		if exceeded := s.logger.llm.Status().Exceeded; len(exceeded) != 0 {
+			t.Errorf("still exceeded after reset: %v", exceeded)
+		}
+	})
+
+	t.Run("with tokens", func(t *testing.T) {
+		s, _, _ := startOverBudget(t, "agent-token", "admin-token")
+
+		// Loopback doesn't matter once there are tokens: the agent's isn't enough
+		agent := http.Header{"Authorization": {"Bearer agent-token"}}
+		if status, body := apiRequest(t, s, http.MethodPost, "/api/budget/reset", "", agent); status != http.StatusForbidden {
+			t.Errorf("reset with the agent token: %d %s", status, body)
+		}
+		admin := http.Header{"Authorization": {"Bearer admin-token"}}
+		if status, body := apiRequest(t, s, http.MethodPost, "/api/budget/reset", "", admin); status != http.StatusOK {
+			t.Errorf("reset with the admin token: %d %s", status, body)
+		}
+	})
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,46 +22,134 @@ type RequestLog struct {
 	ID              string            `json:"id"`
 	Timestamp       time.Time         `json:"timestamp"`
 	Method          string            `json:"method"`
+	Scheme          string            `json:"scheme,omitempty"`
 	Domain          string            `json:"domain"`
 	Path            string            `json:"path"`
+	Query           string            `json:"query,omitempty"`
+	QueryTruncated  bool              `json:"query_truncated,omitempty"`
+	QueryLength     int               `json:"query_length,omitempty"` // full length, set when truncated
 	Headers         map[string]string `json:"headers"`
 	Body            string            `json:"body,omitempty"`
 	ResponseStatus  int               `json:"response_status,omitempty"`
 	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
 	ResponseBody    string            `json:"response_body,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	UpstreamDoneAt  *time.Time        `json:"upstream_done_at,omitempty"` // last byte read from origin
+	ClientDoneAt    *time.Time        `json:"client_done_at,omitempty"`   // last byte written to client
+	OriginMs        int64             `json:"origin_ms,omitempty"`
+	ClientDrainMs   int64             `json:"client_drain_ms,omitempty"`
+	DeliveredBytes  int64             `json:"delivered_bytes,omitempty"`
+	SlowClient      bool              `json:"slow_client,omitempty"`
 	PcapFile        string            `json:"pcap_file"`
+	Debug           *DecisionTrace    `json:"debug,omitempty"`
+	ReplayOf        string            `json:"replay_of,omitempty"`
+	ReplayApplied   []string          `json:"replay_transforms,omitempty"`
+	Composed        bool              `json:"composed,omitempty"`        // built from a template via /api/compose
+	Content         *ContentCheck     `json:"content,omitempty"`         // set for bodies matched by verify rules
+	CaptureSkipped  string            `json:"capture_skipped,omitempty"` // why bodies weren't captured, e.g. memory_pressure
+	Upgraded        bool              `json:"upgraded,omitempty"`        // the origin switched protocols (101)
+	Upgrade         *UpgradeInfo      `json:"upgrade,omitempty"`         // set for requests with an Upgrade header
+	TraceID         string            `json:"trace_id,omitempty"`        // from a valid traceparent header
+	SpanID          string            `json:"span_id,omitempty"`         // the traceparent's parent span
+	TraceSampled    bool              `json:"trace_sampled,omitempty"`   // the traceparent's sampled flag
+	TraceGenerated  bool              `json:"trace_generated,omitempty"` // traceparent injected by -generate-traceparent
+	LLM             *LLMUsage         `json:"llm,omitempty"`             // usage and estimated cost of LLM API calls
+	Range           *RangeInfo        `json:"range,omitempty"`           // set for byte-range requests and responses
+	Server          *ServerIdentity   `json:"server,omitempty"`          // upstream certificate identity, for TLS origins
+	Handshake       *HandshakeFailure `json:"handshake,omitempty"`       // set for CONNECTs whose client TLS handshake failed
+	Policy          string            `json:"policy,omitempty"`          // "flagged" or "blocked" when outside the policy allowlist
+	Secret          string            `json:"secret,omitempty"`          // credential the request seems to carry, found by enrichment
+	Epoch           int               `json:"epoch,omitempty"`           // run that logged the request
+	Instance        string            `json:"instance,omitempty"`        // set by the aggregator
 }
 
+// LogOptions carries per-request logging metadata
+type LogOptions struct {
+	Trace         *DecisionTrace    // nil unless tracing is enabled
+	Redact        []string          // extra headers to redact, beyond redactedHeaders
+	ReplayOf      string            // ID of the entry this request replays
+	ReplayApplied []string          // replay transforms applied to the request
+	Composed      bool              // request was built by /api/compose
+	RefuseUpgrade string            // why the request's upgrade won't be relayed
+	TraceInjected bool              // the proxy added the request's traceparent
+	Handshake     *HandshakeFailure // the CONNECT's client handshake failed
+	Policy        string            // what the policy did with the request, if it isn't allowed
+}
+
+// redactedHeaders are replaced with [REDACTED] before logging
+var redactedHeaders = []string{"Authorization", "X-Api-Key", "Api-Key"}
+
 // Logger handles request logging
 type Logger struct {
-	logsDir    string
-	logFile    *os.File
-	mu         sync.Mutex
-	requests   []RequestLog
-	requestIdx map[string]int // maps request ID to index in requests slice
+	logsDir          string
+	readOnly         bool // the logs directory can't be written; keep entries in memory
+	logFile          appendFile
+	mu               sync.Mutex
+	requests         []RequestLog
+	requestIdx       map[string]int // maps request ID to index in requests slice
+	slowClientFactor float64        // flag entries whose drain exceeds this multiple of origin time; 0 disables
+	rules            *RuleStore
+	budget           *CaptureBudget // memory for buffered bodies across in-flight requests
+	llm              *LLMBudget     // charged for successful LLM API calls
+	ranges           *rangeTracker  // verified downloads waiting for their next range
+	epoch            int            // this run's epoch, from its run_start marker
+	fingerprint      Fingerprint    // recorded in this run's run_start marker
+
+	// Stats over the whole log, checkpointed against the log position
+	counters *StatsCounters
+	offset   int64  // bytes written to requests.jsonl so far
+	tail     []byte // the last bytes written, for the checkpoint anchor
 }
 
 // NewLogger creates a new logger
-func NewLogger(logsDir string) (*Logger, error) {
+func NewLogger(logsDir string, readOnly bool, slowClientFactor float64, rules *RuleStore, budget *CaptureBudget, llm *LLMBudget, fingerprint Fingerprint) (*Logger, error) {
 	logPath := filepath.Join(logsDir, "requests.jsonl")
 
 	// Open or create log file
-	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	file, err := openAppend(logPath, readOnly)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
 
 	logger := &Logger{
-		logsDir:    logsDir,
-		logFile:    file,
-		requests:   make([]RequestLog, 0),
-		requestIdx: make(map[string]int),
+		logsDir:          logsDir,
+		readOnly:         readOnly,
+		logFile:          file,
+		requests:         make([]RequestLog, 0),
+		requestIdx:       make(map[string]int),
+		slowClientFactor: slowClientFactor,
+		rules:            rules,
+		budget:           budget,
+		llm:              llm,
+		ranges:           newRangeTracker(),
+		fingerprint:      fingerprint,
 	}
 
-	// Load existing logs
+	// Load existing logs, then start this run's epoch. Starting without
+	// them would restart epochs at 1 and reuse ones already in the log, so
+	// a log that can't be read stops startup unless nothing is persisted.
 	if err := logger.loadExistingLogs(); err != nil {
+		if !readOnly {
+			file.Close()
+			return nil, fmt.Errorf("failed to load existing logs: %w", err)
+		}
 		fmt.Printf("Warning: failed to load existing logs: %v\n", err)
 	}
+	if logger.counters == nil {
+		logger.counters = loadCounters(logsDir, nil)
+		if info, err := os.Stat(logPath); err == nil {
+			logger.offset = info.Size()
+		}
+	}
+	if logger.epoch == 0 {
+		logger.mu.Lock()
+		err := logger.startEpoch(logger.requests, nil)
+		logger.mu.Unlock()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 
 	return logger, nil
 }
@@ -73,83 +164,257 @@ func (l *Logger) loadExistingLogs() error {
 		return err
 	}
 
-	// Parse each line
-	lines := splitLines(data)
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
+	l.counters = loadCounters(l.logsDir, data)
+	l.offset = int64(len(data))
+	l.tail = append(l.tail, data[max(len(data)-checkpointAnchorSize, 0):]...)
+
+	entries, runs, skipped := parseLogLines(data)
+	if len(skipped) > 0 {
+		fmt.Printf("Warning: %s: loaded %d entries, skipped %d lines (%s); run 'proxy repair' to clean up\n",
+			logPath, len(entries), len(skipped), summarizeSkipped(skipped))
+	}
+
+	// Keep only the most recent entries in memory
+	all := entries
+	if len(entries) > 1000 {
+		entries = entries[len(entries)-1000:]
+	}
+	l.requests = entries
+	for i, r := range l.requests {
+		l.requestIdx[r.ID] = i
+	}
+
+	// A crash can leave a partial last line; terminate it so the next
+	// append doesn't get glued onto it and lost as well
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		if err := l.appendRecord(nil); err != nil {
+			return fmt.Errorf("failed to terminate partial last line: %w", err)
 		}
+	}
+	return l.startEpoch(all, runs)
+}
+
+// skippedLine is a line from requests.jsonl that couldn't be loaded
+type skippedLine struct {
+	Line   int
+	Reason string
+	Raw    []byte
+}
+
+// parseLogLines parses jsonl log data into entries. Records sharing an ID
+// (a request and its later response update) are merged so the latest record
+// wins while entries keep the order they were first seen in. Run start
+// markers are returned separately.
+func parseLogLines(data []byte) ([]RequestLog, []runStart, []skippedLine) {
+	var entries []RequestLog
+	var runs []runStart
+	var skipped []skippedLine
+	index := make(map[string]int)
+
+	// parse applies one record, returning a skip reason if it isn't usable
+	parse := func(line []byte) string {
+		if bytes.HasPrefix(line, []byte(`{"type":"run_start"`)) {
+			var run runStart
+			if err := json.Unmarshal(line, &run); err != nil {
+				return "invalid JSON"
+			}
+			runs = append(runs, run)
+			return ""
+		}
+		if bytes.HasPrefix(line, []byte(`{"type":`)) {
+			var update entryUpdate
+			if err := json.Unmarshal(line, &update); err != nil {
+				return "invalid JSON"
+			}
+			i, ok := index[update.ID]
+			if !ok {
+				return "update for unknown id"
+			}
+			update.applyTo(&entries[i])
+			return ""
+		}
+
 		var req RequestLog
 		if err := json.Unmarshal(line, &req); err != nil {
+			return "invalid JSON"
+		}
+		if req.ID == "" {
+			return "missing id"
+		}
+		if i, ok := index[req.ID]; ok {
+			entries[i] = req
+			return ""
+		}
+		index[req.ID] = len(entries)
+		entries = append(entries, req)
+		return ""
+	}
+
+	for n, line := range splitLines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
 			continue
 		}
-		l.requests = append(l.requests, req)
+
+		reason := parse(line)
+		if reason == "invalid JSON" {
+			// A partial write followed by a full record on the same line:
+			// salvage the record that starts after the damage
+			i := max(bytes.LastIndex(line, []byte(`{"id":`)), bytes.LastIndex(line, []byte(`{"type":`)))
+			if i > 0 && parse(line[i:]) == "" {
+				skipped = append(skipped, skippedLine{Line: n + 1, Reason: "truncated record", Raw: line[:i]})
+				continue
+			}
+		}
+		if reason != "" {
+			skipped = append(skipped, skippedLine{Line: n + 1, Reason: reason, Raw: line})
+		}
 	}
 
-	return nil
+	return entries, runs, skipped
 }
 
+// summarizeSkipped returns a count of skipped lines per reason, e.g. "2 invalid JSON, 1 missing id"
+func summarizeSkipped(skipped []skippedLine) string {
+	counts := make(map[string]int)
+	var reasons []string
+	for _, s := range skipped {
+		if counts[s.Reason] == 0 {
+			reasons = append(reasons, s.Reason)
+		}
+		counts[s.Reason]++
+	}
+
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", counts[reason], reason)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitLines splits on \n, tolerating \r\n endings and a missing trailing newline
 func splitLines(data []byte) [][]byte {
 	var lines [][]byte
 	start := 0
 	for i, b := range data {
 		if b == '\n' {
-			lines = append(lines, data[start:i])
+			lines = append(lines, bytes.TrimSuffix(data[start:i], []byte{'\r'}))
 			start = i + 1
 		}
 	}
 	if start < len(data) {
-		lines = append(lines, data[start:])
+		lines = append(lines, bytes.TrimSuffix(data[start:], []byte{'\r'}))
 	}
 	return lines
 }
 
 // LogRequest logs an HTTP request
-func (l *Logger) LogRequest(req *http.Request) *RequestLog {
+func (l *Logger) LogRequest(req *http.Request, opts LogOptions) *RequestLog {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	trace := opts.Trace
+	rules := l.rules.Get()
+
+	if req.URL.Scheme == "https" {
+		trace.Add("mitm", "always", true, "decrypted")
+	}
+
 	// Create log entry
 	headers := make(map[string]string)
 	for key, values := range req.Header {
 		if len(values) > 0 {
-			// Redact sensitive headers
-			if key == "Authorization" || key == "X-Api-Key" || key == "Api-Key" {
-				headers[key] = "[REDACTED]"
-			} else {
-				headers[key] = values[0]
-			}
+			headers[key] = values[0]
 		}
 	}
 
-	// Read request body for POST/PUT/PATCH requests
-	var body string
-	if req.Body != nil && (req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH") {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err == nil {
+	// Redact sensitive headers
+	for _, name := range redactedHeaders {
+		_, ok := headers[name]
+		if ok {
+			headers[name] = "[REDACTED]"
+			trace.Add("redact", "header:"+name, true, "redacted")
+		} else {
+			trace.Add("redact", "header:"+name, false, "")
+		}
+	}
+	for _, name := range append(rules.redactHeaders(), opts.Redact...) {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := headers[name]; ok {
+			headers[name] = "[REDACTED]"
+			trace.Add("redact", "header:"+name, true, "redacted")
+		}
+	}
+
+	// Read request body for the methods the capture rules select
+	var body, captureSkipped string
+	if req.Body != nil && req.Body != http.NoBody && rules.Capture.capturesBody(req.Method) {
+		// The lock is dropped while the body arrives so a slow client
+		// doesn't hold up every other request
+		l.mu.Unlock()
+		bodyBytes, reserved, err := l.budget.readAll(req.Body, req.ContentLength)
+		l.mu.Lock()
+		switch {
+		case err == nil:
 			// Restore the body so it can be forwarded
-			req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			// Limit body size to 10KB for logging
-			if len(bodyBytes) > 10*1024 {
-				body = string(bodyBytes[:10*1024]) + "... [truncated]"
-			} else {
-				body = string(bodyBytes)
-			}
+			req.Body = &bufferedRequestBody{Reader: bytes.NewReader(bodyBytes), budget: l.budget, reserved: reserved}
+			body = captureBody(bodyBytes, rules.Capture.MaxBodyBytes, "request-body", trace)
+		case errors.Is(err, errBudgetExhausted):
+			req.Body = newPassthroughBody(bodyBytes, req.Body, l.budget, reserved)
+			captureSkipped = captureSkippedMemory
+			l.budget.skippedRequests.Add(1)
+			trace.Add("capture", "request-body", false, "skipped: capture budget exhausted")
+		default:
+			l.budget.release(reserved)
+			trace.Add("capture", "request-body", true, "read failed: "+err.Error())
 		}
+	} else {
+		trace.Add("capture", "request-body", false, "skipped for "+req.Method)
 	}
 
+	query, queryTruncated := captureQuery(req.URL.RawQuery, rules.Capture.MaxQueryBytes, trace)
+
 	// Get current PCAP file name
 	pcapFile := fmt.Sprintf("capture_%s.pcap", time.Now().Format("20060102_150405"))
 
 	entry := RequestLog{
-		ID:        uuid.New().String()[:8],
-		Timestamp: time.Now().UTC(),
-		Method:    req.Method,
-		Domain:    req.Host,
-		Path:      req.URL.Path,
-		Headers:   headers,
-		Body:      body,
-		PcapFile:  pcapFile,
+		ID:             uuid.New().String()[:8],
+		Epoch:          l.epoch,
+		Timestamp:      time.Now().UTC(),
+		Method:         req.Method,
+		Scheme:         req.URL.Scheme,
+		Domain:         req.Host,
+		Path:           req.URL.Path,
+		Query:          query,
+		Headers:        headers,
+		Body:           body,
+		PcapFile:       pcapFile,
+		Debug:          trace,
+		ReplayOf:       opts.ReplayOf,
+		ReplayApplied:  opts.ReplayApplied,
+		Composed:       opts.Composed,
+		CaptureSkipped: captureSkipped,
+		Range:          requestRange(req),
+		Handshake:      opts.Handshake,
+		Policy:         opts.Policy,
+	}
+	if queryTruncated {
+		entry.QueryTruncated = true
+		entry.QueryLength = len(req.URL.RawQuery)
+	}
+	if value := req.Header.Get("Traceparent"); value != "" {
+		if tc, ok := parseTraceparent(value); ok {
+			entry.TraceID, entry.SpanID, entry.TraceSampled = tc.TraceID, tc.SpanID, tc.Sampled
+			entry.TraceGenerated = opts.TraceInjected
+			trace.Add("traceparent", tc.TraceID, true, "recorded")
+		} else {
+			trace.Add("traceparent", value, false, "invalid, passed through")
+		}
+	}
+	if protocol := upgradeProtocol(req.Header); protocol != "" {
+		entry.Upgrade = &UpgradeInfo{Protocol: protocol, Refused: opts.RefuseUpgrade}
 	}
 
 	// Write to file
@@ -159,10 +424,11 @@ func (l *Logger) LogRequest(req *http.Request) *RequestLog {
 		return &entry
 	}
 
-	if _, err := l.logFile.Write(append(data, '\n')); err != nil {
+	if err := l.appendRecord(data); err != nil {
 		fmt.Printf("Failed to write log entry: %v\n", err)
+	} else {
+		l.counters.observeEntry(entry)
 	}
-	l.logFile.Sync()
 
 	// Add to in-memory list
 	l.requests = append(l.requests, entry)
@@ -181,6 +447,141 @@ func (l *Logger) LogRequest(req *http.Request) *RequestLog {
 	return &entry
 }
 
+// entryUpdate is appended in place of a full entry when an entry that is
+// no longer held in memory gets a response, finishes delivery or is marked failed
+type entryUpdate struct {
+	Type            string            `json:"type"` // "response", "content", "delivery", "upgrade", "enrich" or "error"
+	ID              string            `json:"id"`
+	ResponseStatus  int               `json:"response_status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	ResponseBody    string            `json:"response_body,omitempty"`
+	UpstreamDoneAt  *time.Time        `json:"upstream_done_at,omitempty"`
+	ClientDoneAt    *time.Time        `json:"client_done_at,omitempty"`
+	ClientDrainMs   int64             `json:"client_drain_ms,omitempty"`
+	DeliveredBytes  int64             `json:"delivered_bytes,omitempty"`
+	SlowClient      bool              `json:"slow_client,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Content         *ContentCheck     `json:"content,omitempty"`
+	CaptureSkipped  string            `json:"capture_skipped,omitempty"`
+	Upgraded        bool              `json:"upgraded,omitempty"`
+	Upgrade         *UpgradeInfo      `json:"upgrade,omitempty"`
+	LLM             *LLMUsage         `json:"llm,omitempty"`
+	Range           *RangeInfo        `json:"range,omitempty"`
+	Server          *ServerIdentity   `json:"server,omitempty"`
+	Secret          string            `json:"secret,omitempty"`
+}
+
+func (u entryUpdate) applyTo(entry *RequestLog) {
+	if u.CaptureSkipped != "" {
+		entry.CaptureSkipped = u.CaptureSkipped
+	}
+	switch u.Type {
+	case "response":
+		entry.ResponseStatus = u.ResponseStatus
+		entry.ResponseHeaders = u.ResponseHeaders
+		entry.ResponseBody = u.ResponseBody
+		entry.UpstreamDoneAt = u.UpstreamDoneAt
+		if u.UpstreamDoneAt != nil {
+			entry.OriginMs = u.UpstreamDoneAt.Sub(entry.Timestamp).Milliseconds()
+		}
+		entry.Upgraded = u.Upgraded
+		entry.LLM = u.LLM
+		if u.Range != nil {
+			entry.Range = u.Range
+		}
+		entry.Server = u.Server
+	case "content":
+		entry.ResponseBody = u.ResponseBody
+		entry.Content = u.Content
+		entry.UpstreamDoneAt = u.UpstreamDoneAt
+		if u.UpstreamDoneAt != nil {
+			entry.OriginMs = u.UpstreamDoneAt.Sub(entry.Timestamp).Milliseconds()
+		}
+	case "delivery":
+		entry.ClientDoneAt = u.ClientDoneAt
+		entry.ClientDrainMs = u.ClientDrainMs
+		entry.DeliveredBytes = u.DeliveredBytes
+		entry.SlowClient = u.SlowClient
+	case "upgrade":
+		entry.Upgrade = u.Upgrade
+	case "enrich":
+		entry.Secret = u.Secret
+	case "error":
+		entry.Error = u.Error
+	}
+}
+
+// writeUpdate applies update to the entry and persists it: as the full
+// entry when it's in memory, otherwise as a standalone update record that's
+// merged back in by ID when the log is read. Callers must hold l.mu.
+func (l *Logger) writeUpdate(update entryUpdate) {
+	var data []byte
+	var err error
+	idx, inMemory := l.requestIdx[update.ID]
+	if inMemory {
+		update.applyTo(&l.requests[idx])
+		// Write updated entry to file (append as new line - we'll have duplicates but that's ok)
+		data, err = json.Marshal(l.requests[idx])
+	} else {
+		data, err = json.Marshal(update)
+	}
+	if err != nil {
+		fmt.Printf("Failed to marshal %s log entry: %v\n", update.Type, err)
+		return
+	}
+
+	if err := l.appendRecord(data); err != nil {
+		fmt.Printf("Failed to write %s log entry: %v\n", update.Type, err)
+		return
+	}
+	// Count the record the same way it's counted when replayed from disk
+	if inMemory {
+		l.counters.observeEntry(l.requests[idx])
+	} else {
+		l.counters.observeUpdate(update)
+	}
+}
+
+// appendRecord appends a line to requests.jsonl and syncs it, keeping
+// track of the file position for stats checkpoints. Callers must hold l.mu.
+func (l *Logger) appendRecord(data []byte) error {
+	line := append(data, '\n')
+	n, err := l.logFile.Write(line)
+	l.offset += int64(n)
+	l.tail = append(l.tail, line[:n]...)
+	if len(l.tail) > 2*checkpointAnchorSize {
+		l.tail = append(l.tail[:0], l.tail[len(l.tail)-checkpointAnchorSize:]...)
+	}
+	if err != nil {
+		return err
+	}
+	return l.logFile.Sync()
+}
+
+// captureBody returns the loggable form of a body, truncated to max bytes
+func captureBody(data []byte, max int, rule string, trace *DecisionTrace) string {
+	if len(data) > max {
+		trace.Add("capture", rule, true, fmt.Sprintf("truncated %d bytes to %d", len(data), max))
+		return string(data[:max]) + "... [truncated]"
+	}
+	trace.Add("capture", rule, true, fmt.Sprintf("captured %d bytes", len(data)))
+	return string(data)
+}
+
+// captureQuery returns the loggable form of a raw query string, truncated
+// to limit bytes without splitting a percent escape
+func captureQuery(raw string, limit int, trace *DecisionTrace) (string, bool) {
+	if len(raw) <= limit {
+		return raw, false
+	}
+	cut := limit
+	if i := strings.LastIndexByte(raw[max(cut-2, 0):cut], '%'); i >= 0 {
+		cut = max(cut-2, 0) + i
+	}
+	trace.Add("capture", "query", true, fmt.Sprintf("truncated %d bytes to %d", len(raw), cut))
+	return raw[:cut], true
+}
+
 // LogResponse updates a request log with response data
 func (l *Logger) LogResponse(requestID string, resp *http.Response) {
 	if resp == nil {
@@ -190,9 +591,11 @@ func (l *Logger) LogResponse(requestID string, resp *http.Response) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	idx, ok := l.requestIdx[requestID]
-	if !ok {
-		return
+	var trace *DecisionTrace
+	var started time.Time
+	if idx, ok := l.requestIdx[requestID]; ok {
+		trace = l.requests[idx].Debug
+		started = l.requests[idx].Timestamp
 	}
 
 	// Extract response headers
@@ -203,38 +606,163 @@ func (l *Logger) LogResponse(requestID string, resp *http.Response) {
 		}
 	}
 
+	// After a protocol switch the body is the connection itself, relayed
+	// until either side closes; LogUpgrade records how that went
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		trace.Add("capture", "response-body", false, "skipped: switching protocols")
+		upstreamDone := time.Now().UTC()
+		l.writeUpdate(entryUpdate{
+			Type:            "response",
+			ID:              requestID,
+			ResponseStatus:  resp.StatusCode,
+			ResponseHeaders: headers,
+			UpstreamDoneAt:  &upstreamDone,
+			Upgraded:        true,
+			Server:          serverIdentity(resp),
+		})
+		return
+	}
+
+	// Bodies matched by verify rules can be arbitrarily large, so they're
+	// hashed as they stream to the client instead of being buffered. Only a
+	// 200 or 206 carries the resource; error pages, redirects and 416s are
+	// logged as usual
+	rules := l.rules.Get()
+	carriesResource := resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent
+	if resp.Body != nil && resp.Request != nil && carriesResource && rules.Verify.matches(resp.Request.URL.Hostname(), resp.Request.URL.Path) {
+		trace.Add("verify", resp.Request.URL.Hostname()+resp.Request.URL.Path, true, "streaming sha256")
+
+		// The hash is always computed; only the kept prefix needs budget
+		keep, skipped := int64(rules.Capture.MaxBodyBytes), ""
+		if !l.budget.acquire(keep) {
+			keep, skipped = 0, captureSkippedMemory
+			l.budget.skippedResponses.Add(1)
+			trace.Add("capture", "response-body", false, "skipped: capture budget exhausted")
+		}
+		// Ranges of one resource share a hash, picked up where the client
+		// got to, so the whole resource is judged rather than each part
+		key := resp.Request.URL.String()
+		assembly, placeErr := l.ranges.locate(key, resp)
+		resp.Body = newVerifyBody(resp.Body, &rules.Verify, assembly, placeErr, int(keep), func(body *verifyBody, complete bool) {
+			l.budget.release(keep)
+			if a := body.resumable(); a != nil {
+				l.ranges.put(key, a)
+			}
+			l.logContent(requestID, started, body, complete)
+		})
+		l.writeUpdate(entryUpdate{
+			Type:            "response",
+			ID:              requestID,
+			ResponseStatus:  resp.StatusCode,
+			ResponseHeaders: headers,
+			CaptureSkipped:  skipped,
+			LLM:             l.chargeLLM(requestID, resp, rules, nil),
+			Range:           responseRange(resp),
+			Server:          serverIdentity(resp),
+		})
+		return
+	}
+
 	// Read response body
-	var body string
+	var body, captureSkipped string
+	var captured []byte // the whole body, when it was buffered
+	upstreamDone := time.Now().UTC()
 	if resp.Body != nil {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err == nil {
-			// Restore the body so it can be forwarded
-			resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			// Limit body size to 10KB for logging
-			if len(bodyBytes) > 10*1024 {
-				body = string(bodyBytes[:10*1024]) + "... [truncated]"
+		// As for requests, a slow origin mustn't hold the lock
+		l.mu.Unlock()
+		bodyBytes, reserved, err := l.budget.readAll(resp.Body, resp.ContentLength)
+		l.mu.Lock()
+		upstreamDone = time.Now().UTC()
+		switch {
+		case err == nil:
+			// Restore the body so it can be forwarded, timing its delivery to the client
+			if len(bodyBytes) > 0 {
+				resp.Body = newDeliveryBody(bodyBytes, func(delivered int64, complete bool) {
+					l.budget.release(reserved)
+					l.logDelivery(requestID, started, upstreamDone, delivered, complete)
+				})
 			} else {
-				body = string(bodyBytes)
+				l.budget.release(reserved)
+				resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 			}
+			body = captureBody(bodyBytes, rules.Capture.MaxBodyBytes, "response-body", trace)
+			captured = bodyBytes
+		case errors.Is(err, errBudgetExhausted):
+			// Stream the rest through uncaptured; delivery isn't timed
+			resp.Body = newPassthroughBody(bodyBytes, resp.Body, l.budget, reserved)
+			captureSkipped = captureSkippedMemory
+			l.budget.skippedResponses.Add(1)
+			trace.Add("capture", "response-body", false, "skipped: capture budget exhausted")
+		default:
+			l.budget.release(reserved)
+			trace.Add("capture", "response-body", true, "read failed: "+err.Error())
 		}
 	}
 
-	// Update the request entry
-	l.requests[idx].ResponseStatus = resp.StatusCode
-	l.requests[idx].ResponseHeaders = headers
-	l.requests[idx].ResponseBody = body
+	l.writeUpdate(entryUpdate{
+		Type:            "response",
+		ID:              requestID,
+		ResponseStatus:  resp.StatusCode,
+		ResponseHeaders: headers,
+		ResponseBody:    body,
+		UpstreamDoneAt:  &upstreamDone,
+		CaptureSkipped:  captureSkipped,
+		LLM:             l.chargeLLM(requestID, resp, rules, captured),
+		Range:           responseRange(resp),
+		Server:          serverIdentity(resp),
+	})
+}
 
-	// Write updated entry to file (append as new line - we'll have duplicates but that's ok)
-	data, err := json.Marshal(l.requests[idx])
-	if err != nil {
-		fmt.Printf("Failed to marshal response log entry: %v\n", err)
-		return
+// chargeLLM estimates the cost of a successful LLM API call and charges it
+// to the budget. body is nil when the response wasn't buffered. Callers
+// must hold l.mu.
+func (l *Logger) chargeLLM(requestID string, resp *http.Response, rules *Rules, body []byte) *LLMUsage {
+	if resp.Request == nil || resp.StatusCode/100 != 2 || !rules.LLM.recognizes(resp.Request.Method, resp.Request.URL.Hostname()) {
+		return nil
 	}
-
-	if _, err := l.logFile.Write(append(data, '\n')); err != nil {
-		fmt.Printf("Failed to write response log entry: %v\n", err)
+	var requestBody string
+	if idx, ok := l.requestIdx[requestID]; ok {
+		requestBody = l.requests[idx].Body
 	}
-	l.logFile.Sync()
+	usage := estimateLLMUsage(rules.LLM, requestBody, body, l.llm.unknownCost)
+	l.llm.Charge(usage)
+	return usage
+}
+
+// LogUpgrade records the end of an upgraded connection's relay
+func (l *Logger) LogUpgrade(requestID string, info UpgradeInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writeUpdate(entryUpdate{
+		Type:    "upgrade",
+		ID:      requestID,
+		Upgrade: &info,
+	})
+}
+
+// LogEnrichment persists the fields enrichers derive from an entry
+func (l *Logger) LogEnrichment(entry RequestLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writeUpdate(entryUpdate{
+		Type:   "enrich",
+		ID:     entry.ID,
+		Secret: entry.Secret,
+	})
+}
+
+// LogError marks a request as failed without a response
+func (l *Logger) LogError(requestID, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writeUpdate(entryUpdate{
+		Type:  "error",
+		ID:    requestID,
+		Error: reason,
+	})
 }
 
 // GetRequests returns all logged requests
@@ -248,7 +776,127 @@ func (l *Logger) GetRequests() []RequestLog {
 	return result
 }
 
-// Close closes the logger
+// History returns every entry in the log, merged as on startup, with the
+// entries in memory taking precedence; those are all there is when the log
+// can't be read
+func (l *Logger) History() []RequestLog {
+	var entries []RequestLog
+	if data, err := os.ReadFile(filepath.Join(l.logsDir, "requests.jsonl")); err == nil {
+		entries, _, _ = parseLogLines(data)
+	}
+	index := make(map[string]int, len(entries))
+	for i, e := range entries {
+		index[e.ID] = i
+	}
+	for _, e := range l.GetRequests() {
+		if i, ok := index[e.ID]; ok {
+			entries[i] = e
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// GetRequest returns the logged request with the given ID, reading it
+// from disk if it's no longer held in memory
+func (l *Logger) GetRequest(id string) (RequestLog, bool) {
+	l.mu.Lock()
+	idx, ok := l.requestIdx[id]
+	if ok {
+		entry := l.requests[idx]
+		entry.Debug = entry.Debug.Clone()
+		l.mu.Unlock()
+		return entry, true
+	}
+	l.mu.Unlock()
+
+	return l.findOnDisk(id)
+}
+
+// findOnDisk scans the log file for records with the given ID and merges them
+func (l *Logger) findOnDisk(id string) (RequestLog, bool) {
+	file, err := os.Open(filepath.Join(l.logsDir, "requests.jsonl"))
+	if err != nil {
+		return RequestLog{}, false
+	}
+	defer file.Close()
+
+	// Only lines mentioning the ID are worth parsing
+	needle := []byte(`"id":"` + id + `"`)
+	var matched []byte
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if bytes.Contains(line, needle) {
+			matched = append(matched, line...)
+			if line[len(line)-1] != '\n' {
+				matched = append(matched, '\n')
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	entries, _, _ := parseLogLines(matched)
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return RequestLog{}, false
+}
+
+// Stats returns per-domain stats over the whole log and the time of the
+// earliest entry they cover
+func (l *Logger) Stats() ([]DomainStats, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counters.Stats(), l.counters.since
+}
+
+// SaveCounters checkpoints the stats counters so the next run only has to
+// replay what's logged after this point
+func (l *Logger) SaveCounters() error {
+	if l.readOnly {
+		return nil
+	}
+	l.mu.Lock()
+	state := l.counters.checkpoint(l.offset, logAnchor(l.tail))
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stats checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(countersStatePath(l.logsDir), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write stats checkpoint: %w", err)
+	}
+	return nil
+}
+
+// CheckpointCounters saves the stats counters every interval until stop
+// is closed
+func (l *Logger) CheckpointCounters(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := l.SaveCounters(); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+	}
+}
+
+// Close checkpoints the stats counters and closes the logger
 func (l *Logger) Close() error {
+	if err := l.SaveCounters(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 	return l.logFile.Close()
 }
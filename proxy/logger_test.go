@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResponseForEvictedEntrySurvivesRestart answers a request only after
+// enough others that its entry has left the in-memory window, then checks
+// that the response is read back from disk after a restart
+func TestResponseForEvictedEntrySurvivesRestart(t *testing.T) {
+	release := make(chan struct{})
+	var released sync.Once
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/first" {
+			<-release
+		}
+		io.WriteString(w, "answer to "+r.URL.Path)
+	}))
+	defer origin.Close()
+	defer released.Do(func() { close(release) })
+
+	logsDir := t.TempDir()
+	s := newServer(t, logsDir)
+	client := proxiedClient(t, s)
+
+	first := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(origin.URL + "/first")
+		if err != nil {
+			first <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		first <- string(body)
+	}()
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/first" })
+
+	const total = 1500
+	for i := 1; i < total; i++ {
+		fetch(t, client, newRequest(t, http.MethodGet, fmt.Sprintf("%s/r%d", origin.URL, i), ""))
+	}
+	for _, e := range s.Logger().GetRequests() {
+		if e.ID == entry.ID {
+			t.Fatalf("entry %s still in memory after %d more requests", entry.ID, total-1)
+		}
+	}
+
+	released.Do(func() { close(release) })
+	if body := <-first; body != "answer to /first" {
+		t.Fatalf("first request got %q", body)
+	}
+	waitFor(t, "the late response to be logged", func() bool {
+		_, body := apiRequest(t, s, http.MethodGet, "/api/requests/"+entry.ID, "", nil)
+		return strings.Contains(body, `"response_status":200`)
+	})
+	s.Shutdown(time.Second)
+
+	// After a restart the entry is only on disk; its response must be too
+	s = newServer(t, logsDir)
+	defer s.Shutdown(time.Second)
+	var detail RequestLog
+	getJSON(t, s, "/api/requests/"+entry.ID, &detail)
+	if detail.ResponseStatus != http.StatusOK || detail.ResponseBody != "answer to /first" || detail.Error != "" {
+		t.Errorf("after restart %s shows status %d, body %q, error %q", entry.ID, detail.ResponseStatus, detail.ResponseBody, detail.Error)
+	}
+}
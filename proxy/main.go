@@ -1,85 +1,72 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-
-	"github.com/elazarl/goproxy"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	proxyAddr := flag.String("proxy", ":8080", "Proxy listen address")
-	webAddr := flag.String("web", ":8888", "Web UI listen address")
-	logsDir := flag.String("logs", "/logs", "Directory for logs and PCAP files")
-	flag.Parse()
-
-	// Ensure logs directory exists
-	if err := os.MkdirAll(*logsDir, 0o755); err != nil {
-		log.Fatalf("Failed to create logs directory: %v", err)
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repair":
+			os.Exit(runRepair(os.Args[2:]))
+		case "aggregate":
+			os.Exit(runAggregate(os.Args[2:]))
+		case "validate-config":
+			os.Exit(runValidateConfig(os.Args[2:]))
+		}
 	}
 
-	// Load or create CA
-	ca, err := LoadOrCreateCA(*logsDir)
-	if err != nil {
-		log.Fatalf("Failed to load/create CA: %v", err)
-	}
-	fmt.Println("CA certificate ready")
+	var cfg Config
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
 
-	// Create logger
-	logger, err := NewLogger(*logsDir)
-	if err != nil {
-		log.Fatalf("Failed to create logger: %v", err)
+	if errs := cfg.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		log.Fatalf("Invalid configuration (%d errors)", len(errs))
 	}
-	defer logger.Close()
+	cfg.WebToken = os.Getenv("PROXY_WEB_TOKEN")
+	cfg.WebAdminToken = os.Getenv("PROXY_WEB_ADMIN_TOKEN")
 
-	// Create proxy
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = false
-
-	// Set up MITM for HTTPS
-	tlsCert, err := tls.X509KeyPair(ca.CertPEM, ca.KeyPEM)
+	server, err := NewServer(&cfg)
 	if err != nil {
-		log.Fatalf("Failed to create TLS cert: %v", err)
+		log.Fatalf("%v", err)
 	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve()
+	}()
 
-	goproxy.GoproxyCa = tlsCert
-	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&tlsCert)}
-	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&tlsCert)}
-	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&tlsCert)}
-	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&tlsCert)}
-
-	// Handle CONNECT requests (HTTPS)
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-
-	// Log all requests
-	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		entry := logger.LogRequest(req)
-		ctx.UserData = entry.ID // Store request ID for response handler
-		fmt.Printf("[%s] %s %s%s\n", entry.ID, req.Method, req.Host, req.URL.Path)
-		return req, nil
-	})
-
-	// Log all responses
-	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		if requestID, ok := ctx.UserData.(string); ok {
-			logger.LogResponse(requestID, resp)
-		}
-		return resp
-	})
+	// Wait for a shutdown signal, then drain in-flight requests
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Start web server in goroutine
-	webServer := NewWebServer(logger, *logsDir)
+	// Reload the rules file on SIGHUP, keeping the current rules if it's invalid
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := webServer.Start(*webAddr); err != nil {
-			log.Fatalf("Web server failed: %v", err)
+		for range hup {
+			server.ReloadRules()
 		}
 	}()
 
-	// Start proxy
-	fmt.Printf("Proxy listening on %s\n", *proxyAddr)
-	log.Fatal(http.ListenAndServe(*proxyAddr, proxy))
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Proxy server failed: %v", err)
+		}
+	case <-ctx.Done():
+		summary := server.Shutdown(cfg.ShutdownGrace)
+		fmt.Printf("Proxy stopped: %s\n", summary)
+	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyRules is the allowlist of hosts, methods and paths requests may go
+// to. Without a policy section every request is allowed.
+type PolicyRules struct {
+	Mode  string       `yaml:"mode"` // "monitor" (default) flags requests outside the allowlist, "enforce" refuses them
+	Allow []PolicyRule `yaml:"allow"`
+}
+
+// PolicyRule allows requests to the hosts matching Host. Patterns use
+// path.Match syntax, as verify targets do; empty Methods or Paths allow any.
+type PolicyRule struct {
+	Host    string   `yaml:"host" json:"host"`
+	Methods []string `yaml:"methods,omitempty" json:"methods,omitempty"`
+	Paths   []string `yaml:"paths,omitempty" json:"paths,omitempty"`
+}
+
+// allows reports whether the rule covers a request
+func (r PolicyRule) allows(method, host, urlPath string) bool {
+	if ok, _ := path.Match(r.Host, host); !ok {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, method) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	for _, p := range r.Paths {
+		if matchPath(p, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns what the policy does with a request: "" if it's allowed,
+// otherwise "flagged" or, when the policy is enforced, "blocked". A nil
+// policy allows everything.
+func (p *PolicyRules) decide(method, host, urlPath string) string {
+	if p == nil {
+		return ""
+	}
+	for _, r := range p.Allow {
+		if r.allows(method, host, urlPath) {
+			return ""
+		}
+	}
+	if p.Mode == "enforce" {
+		return "blocked"
+	}
+	return "flagged"
+}
+
+// policyResponse refuses a request the enforced policy doesn't allow
+func policyResponse(req *http.Request) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden,
+		fmt.Sprintf("%s %s%s is not allowed by the proxy policy\n", req.Method, req.URL.Hostname(), req.URL.Path))
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *rulesParser) parsePolicy(node *yaml.Node, policy *PolicyRules) {
+	keys := p.mapping(node, "policy key", "mode", "allow")
+
+	policy.Mode = "monitor"
+	if n, ok := keys["mode"]; ok {
+		p.decode(n, &policy.Mode)
+		if policy.Mode != "monitor" && policy.Mode != "enforce" {
+			p.errorf(n, "mode must be monitor or enforce, not %q", policy.Mode)
+		}
+	}
+
+	n, ok := keys["allow"]
+	if !ok {
+		return
+	}
+	if n.Kind != yaml.SequenceNode {
+		p.errorf(n, "allow must be a list")
+		return
+	}
+	for _, item := range n.Content {
+		fields := p.mapping(item, "allow key", "host", "methods", "paths")
+		var r PolicyRule
+		if h, ok := fields["host"]; ok {
+			p.decode(h, &r.Host)
+			if _, err := path.Match(r.Host, ""); err != nil || r.Host == "" {
+				p.errorf(h, "invalid host pattern %q", r.Host)
+			}
+		} else if fields != nil {
+			p.errorf(item, "allow rule is missing host")
+		}
+		if mn, ok := fields["methods"]; ok {
+			p.decode(mn, &r.Methods)
+			for i, m := range r.Methods {
+				if m == "" || strings.ToUpper(m) != m {
+					p.errorf(itemNode(mn, i), "method %q must be an upper-case HTTP method", m)
+				}
+			}
+		}
+		if pn, ok := fields["paths"]; ok {
+			p.decode(pn, &r.Paths)
+			for i, pattern := range r.Paths {
+				if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil || !strings.HasPrefix(pattern, "/") {
+					p.errorf(itemNode(pn, i), "invalid path pattern %q (must start with /)", pattern)
+				}
+			}
+		}
+		policy.Allow = append(policy.Allow, r)
+	}
+}
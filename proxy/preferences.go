@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxPreferencesSize caps a single stored preferences blob
+const maxPreferencesSize = 64 * 1024
+
+// globalPreferencesKey is shared by all clients when no API tokens are
+// configured; otherwise each token's blob is keyed by its fingerprint
+const globalPreferencesKey = "global"
+
+// errInvalidPreferences is returned by Put for blobs rejected before saving
+var errInvalidPreferences = errors.New("invalid preferences")
+
+// PreferencesStore persists opaque UI/CLI preference blobs in the logs dir
+type PreferencesStore struct {
+	path     string
+	readOnly bool // the logs directory can't be written; keep preferences in memory
+	mu       sync.Mutex
+	blobs    map[string]json.RawMessage
+}
+
+// NewPreferencesStore loads preferences from the logs directory
+func NewPreferencesStore(logsDir string, readOnly bool) (*PreferencesStore, error) {
+	s := &PreferencesStore{
+		path:     filepath.Join(logsDir, "preferences.json"),
+		readOnly: readOnly,
+		blobs:    make(map[string]json.RawMessage),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read preferences: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.blobs); err != nil {
+		return nil, fmt.Errorf("failed to parse preferences: %w", err)
+	}
+	return s, nil
+}
+
+// Get returns the stored blob for key, or nil if none is stored
+func (s *PreferencesStore) Get(key string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[key]
+}
+
+// Put validates and stores the blob for key
+func (s *PreferencesStore) Put(key string, blob []byte) error {
+	if len(blob) > maxPreferencesSize {
+		return fmt.Errorf("%w: exceeds %d bytes", errInvalidPreferences, maxPreferencesSize)
+	}
+	if !json.Valid(blob) {
+		return fmt.Errorf("%w: must be valid JSON", errInvalidPreferences)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, hadPrev := s.blobs[key]
+	s.blobs[key] = json.RawMessage(blob)
+	data, err := json.MarshalIndent(s.blobs, "", "  ")
+	if err == nil && !s.readOnly {
+		err = writeFileAtomic(s.path, data, 0o644)
+	}
+	if err != nil {
+		// Keep memory consistent with what's on disk
+		if hadPrev {
+			s.blobs[key] = prev
+		} else {
+			delete(s.blobs, key)
+		}
+		return fmt.Errorf("failed to save preferences: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPreferencesPerToken(t *testing.T) {
+	s := startServerWithTokens(t, "user-token", "admin-token")
+	auth := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	for token, blob := range map[string]string{"user-token": `{"auto_refresh":false}`, "admin-token": `{"auto_refresh":true}`} {
+		if status, body := apiRequest(t, s, http.MethodPut, "/api/preferences", blob, auth(token)); status != http.StatusOK {
+			t.Fatalf("PUT as %s: %d %s", token, status, body)
+		}
+	}
+
+	// Each token reads back its own blob, not the last one written
+	for token, want := range map[string]string{"user-token": `{"auto_refresh":false}`, "admin-token": `{"auto_refresh":true}`} {
+		if _, body := apiRequest(t, s, http.MethodGet, "/api/preferences", "", auth(token)); body != want {
+			t.Errorf("GET as %s: %s, want %s", token, body, want)
+		}
+	}
+	stored, err := NewPreferencesStore(s.cfg.LogsDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.Get(globalPreferencesKey); got != nil {
+		t.Errorf("token holders wrote the global blob: %s", got)
+	}
+	if got := compactJSON(stored.Get(tokenFingerprint("user-token"))); got != `{"auto_refresh":false}` {
+		t.Errorf("blob stored under the user token's fingerprint is %q", got)
+	}
+}
+
+func TestPreferencesSharedWithoutTokens(t *testing.T) {
+	s := startServer(t)
+	if status, body := apiRequest(t, s, http.MethodPut, "/api/preferences", `{"auto_refresh":false}`, nil); status != http.StatusOK {
+		t.Fatalf("PUT: %d %s", status, body)
+	}
+	stored, err := NewPreferencesStore(s.cfg.LogsDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := compactJSON(stored.Get(globalPreferencesKey)); got != `{"auto_refresh":false}` {
+		t.Errorf("global blob is %q", got)
+	}
+}
+
+// compactJSON undoes the indentation preferences.json is saved with
+func compactJSON(blob json.RawMessage) string {
+	var buf bytes.Buffer
+	json.Compact(&buf, blob)
+	return buf.String()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogsRequestAndResponse(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, true)
+	client := proxiedClient(t, s)
+
+	req := newRequest(t, http.MethodPost, origin.URL+"/echo?page=2", `{"hello":"world"}`)
+	req.Header.Set("Content-Type", "application/json")
+	resp, body := fetch(t, client, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var seen originRequest
+	if err := json.Unmarshal([]byte(body), &seen); err != nil || seen.Body != `{"hello":"world"}` {
+		t.Fatalf("origin saw %+v (%v)", seen, err)
+	}
+
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" && e.ClientDoneAt != nil })
+	u, _ := url.Parse(origin.URL)
+	switch {
+	case entry.Method != http.MethodPost || entry.Scheme != "http" || entry.Domain != u.Host:
+		t.Errorf("logged %s %s://%s", entry.Method, entry.Scheme, entry.Domain)
+	case entry.Query != "page=2":
+		t.Errorf("logged query %q", entry.Query)
+	case entry.Body != `{"hello":"world"}`:
+		t.Errorf("logged request body %q", entry.Body)
+	case entry.ResponseStatus != http.StatusOK:
+		t.Errorf("logged status %d", entry.ResponseStatus)
+	case !strings.Contains(entry.ResponseBody, `"method":"POST"`):
+		t.Errorf("logged response body %q", entry.ResponseBody)
+	case entry.Error != "":
+		t.Errorf("logged error %q", entry.Error)
+	}
+
+	// The API serves the same entry
+	var listed []RequestLog
+	getJSON(t, s, "/api/requests", &listed)
+	if len(listed) != 1 || listed[0].ID != entry.ID {
+		t.Fatalf("/api/requests listed %d entries", len(listed))
+	}
+	var detail RequestLog
+	getJSON(t, s, "/api/requests/"+entry.ID, &detail)
+	if detail.ResponseStatus != http.StatusOK || detail.Body != entry.Body {
+		t.Errorf("/api/requests/%s = %+v", entry.ID, detail)
+	}
+}
+
+func TestMITMsHTTPS(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, false)
+	client := proxiedClient(t, s)
+
+	resp, body := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/echo", ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		t.Fatal("response wasn't over TLS")
+	}
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != "Agent Network Logger CA" {
+		t.Errorf("client saw a certificate issued by %q, want the proxy CA", issuer)
+	}
+
+	// The decrypted request and response are logged, with the origin's identity
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" })
+	if entry.Scheme != "https" || entry.ResponseBody == "" || !strings.Contains(body, `"path":"/echo"`) {
+		t.Errorf("logged %s with response body %q", entry.Scheme, entry.ResponseBody)
+	}
+	if entry.Server == nil || entry.Server.CertSHA256 == "" {
+		t.Errorf("upstream certificate not recorded: %+v", entry.Server)
+	}
+}
+
+func TestLogsClientRejectingTheCA(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, false)
+
+	// A client without the proxy CA fails the handshake and never sends a request
+	proxyURL := &url.URL{Scheme: "http", Host: s.ProxyAddr()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{}}, Timeout: 5 * time.Second}
+	if _, err := client.Get(origin.URL + "/echo"); err == nil {
+		t.Fatal("client without the proxy CA got a response")
+	}
+
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Method == http.MethodConnect })
+	if !strings.HasPrefix(entry.Error, "tls_handshake_failed: ") || entry.Handshake == nil || !entry.Handshake.MissingCA {
+		t.Errorf("logged %q with handshake %+v", entry.Error, entry.Handshake)
+	}
+}
+
+func TestRedactsCredentials(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, true)
+	client := proxiedClient(t, s)
+
+	req := newRequest(t, http.MethodGet, origin.URL+"/echo", "")
+	req.Header.Set("Authorization", "Bearer origin-secret")
+	req.Header.Set("X-Api-Key", "key-secret")
+	req.Header.Set("X-Request-Id", "visible")
+	_, body := fetch(t, client, req)
+
+	// Redaction is for the log only; the origin still gets the credentials
+	var seen originRequest
+	if err := json.Unmarshal([]byte(body), &seen); err != nil {
+		t.Fatal(err)
+	}
+	if seen.Header.Get("Authorization") != "Bearer origin-secret" || seen.Header.Get("X-Api-Key") != "key-secret" {
+		t.Errorf("origin got Authorization %q, X-Api-Key %q", seen.Header.Get("Authorization"), seen.Header.Get("X-Api-Key"))
+	}
+
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" })
+	for _, name := range []string{"Authorization", "X-Api-Key"} {
+		if entry.Headers[name] != "[REDACTED]" {
+			t.Errorf("logged %s: %q", name, entry.Headers[name])
+		}
+	}
+	if entry.Headers["X-Request-Id"] != "visible" {
+		t.Errorf("logged X-Request-Id %q", entry.Headers["X-Request-Id"])
+	}
+
+	// An origin that doesn't echo them back leaves no trace of them in the API
+	req = newRequest(t, http.MethodGet, origin.URL+"/delay", "")
+	req.Header.Set("Authorization", "Bearer origin-secret")
+	fetch(t, client, req)
+	entry = waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/delay" })
+	_, detail := apiRequest(t, s, http.MethodGet, "/api/requests/"+entry.ID, "", nil)
+	if strings.Contains(detail, "origin-secret") {
+		t.Errorf("API leaked a redacted header: %s", detail)
+	}
+}
+
+func TestOriginBehaviors(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, false)
+	client := proxiedClient(t, s)
+
+	t.Run("delay", func(t *testing.T) {
+		fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/delay?ms=100", ""))
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/delay" && e.UpstreamDoneAt != nil })
+		if entry.OriginMs < 100 {
+			t.Errorf("origin time %dms, want at least the 100ms delay", entry.OriginMs)
+		}
+	})
+	t.Run("chunked", func(t *testing.T) {
+		_, body := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/chunked?n=5", ""))
+		if !strings.HasSuffix(body, "chunk 4\n") {
+			t.Fatalf("client got %q", body)
+		}
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/chunked" && e.ClientDoneAt != nil })
+		if entry.DeliveredBytes != int64(len(body)) {
+			t.Errorf("delivered %d bytes, client read %d", entry.DeliveredBytes, len(body))
+		}
+	})
+	t.Run("gzip", func(t *testing.T) {
+		_, body := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/gzip", ""))
+		if body != "compressed body" {
+			t.Fatalf("client got %q", body)
+		}
+		// goproxy lets the upstream transport negotiate compression, so the
+		// body is logged decoded
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/gzip" && e.ClientDoneAt != nil })
+		if entry.ResponseBody != "compressed body" {
+			t.Errorf("logged response body %q", entry.ResponseBody)
+		}
+	})
+	t.Run("redirect", func(t *testing.T) {
+		resp, _ := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/redirect?to=/echo", ""))
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/redirect" })
+		if entry.ResponseStatus != http.StatusFound || entry.ResponseHeaders["Location"] != "/echo" {
+			t.Errorf("logged %d to %q", entry.ResponseStatus, entry.ResponseHeaders["Location"])
+		}
+	})
+}
+
+func TestRelaysWebSocket(t *testing.T) {
+	s := startServer(t)
+	origin := newOrigin(t, true)
+
+	rw, closeConn := dialUpgrade(t, s, origin.URL+"/ws")
+	fmt.Fprint(rw, "ping")
+	rw.Flush()
+	got := make([]byte, 4)
+	if _, err := rw.Read(got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo: %q, %v", got, err)
+	}
+	closeConn()
+
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/ws" && e.Upgrade != nil && e.Upgrade.ClosedAt != nil })
+	if !entry.Upgraded || entry.Upgrade.BytesToUpstream != 4 || entry.Upgrade.BytesToClient != 4 {
+		t.Errorf("logged upgrade %+v", entry.Upgrade)
+	}
+}
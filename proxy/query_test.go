@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// longQuery is a query string of n bytes, e.g. "q=xxxx..."
+func longQuery(n int) string {
+	return "q=" + strings.Repeat("x", n-2)
+}
+
+// TestLongQueryUnderHeaderLimit sends a 64KB query to a proxy whose
+// listener accepts it, once logged in full and once over max_query_bytes
+func TestLongQueryUnderHeaderLimit(t *testing.T) {
+	query := longQuery(64 << 10)
+	origin := newOrigin(t, true)
+
+	t.Run("captured", func(t *testing.T) {
+		rules := writeRules(t, "version: 1\ncapture:\n  max_query_bytes: 131072\n")
+		s := startServer(t, "-max-header-bytes=131072", "-rules="+rules)
+		_, body := fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo?"+query, ""))
+		var seen originRequest
+		if err := json.Unmarshal([]byte(body), &seen); err != nil || seen.Query != query {
+			t.Fatalf("origin saw a %d byte query (%v)", len(seen.Query), err)
+		}
+
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" })
+		if entry.QueryTruncated || entry.Query != query {
+			t.Fatalf("logged a %d byte query, truncated %v", len(entry.Query), entry.QueryTruncated)
+		}
+		status, body := apiRequest(t, s, http.MethodPost, "/api/requests/"+entry.ID+"/replay", "", nil)
+		if status != http.StatusOK {
+			t.Fatalf("replay: %d %s", status, body)
+		}
+		var replayed RequestLog
+		if err := json.Unmarshal([]byte(body), &replayed); err != nil || replayed.Query != query {
+			t.Errorf("replay sent a %d byte query (%v)", len(replayed.Query), err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		s := startServer(t, "-max-header-bytes=131072")
+		_, body := fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo?"+query, ""))
+		var seen originRequest
+		if err := json.Unmarshal([]byte(body), &seen); err != nil || seen.Query != query {
+			t.Fatalf("origin saw a %d byte query (%v); truncation is for the log only", len(seen.Query), err)
+		}
+
+		// The default max_query_bytes keeps 2KB of it and records the full length
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" })
+		if !entry.QueryTruncated || entry.QueryLength != len(query) || len(entry.Query) != 2048 || !strings.HasPrefix(query, entry.Query) {
+			t.Fatalf("logged %d bytes, truncated %v, length %d", len(entry.Query), entry.QueryTruncated, entry.QueryLength)
+		}
+
+		// Replaying would send a different request than the one captured
+		status, body := apiRequest(t, s, http.MethodPost, "/api/requests/"+entry.ID+"/replay", "", nil)
+		if status != http.StatusConflict || !strings.Contains(body, "query string was truncated") {
+			t.Errorf("replay of a truncated query: %d %s", status, body)
+		}
+	})
+}
+
+// TestLongQueryOverHeaderLimit checks that a query past -max-header-bytes
+// is refused by the listener rather than relayed
+func TestLongQueryOverHeaderLimit(t *testing.T) {
+	s := startServer(t, "-max-header-bytes=65536")
+	origin := newOrigin(t, true)
+
+	// net/http allows 4KB of slack over MaxHeaderBytes, so go well past it
+	resp, _ := fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo?"+longQuery(96<<10), ""))
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("status %d, want 431", resp.StatusCode)
+	}
+	if n := len(s.Logger().GetRequests()); n != 0 {
+		t.Errorf("logged %d entries for a request the listener refused", n)
+	}
+
+	// The same limit still lets a request just under it through
+	resp, _ = fetch(t, proxiedClient(t, s), newRequest(t, http.MethodGet, origin.URL+"/echo?"+longQuery(60<<10), ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d for a query just under the limit", resp.StatusCode)
+	}
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" })
+	if !entry.QueryTruncated || entry.QueryLength != 60<<10 {
+		t.Errorf("logged truncated %v, length %d", entry.QueryTruncated, entry.QueryLength)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRangeAssemblies bounds how many verified downloads can be waiting for
+// their next range at once; the least recently updated is dropped first
+const maxRangeAssemblies = 64
+
+// RangeInfo records a byte-range request and how the origin answered it
+type RangeInfo struct {
+	Requested    string `json:"requested,omitempty"`     // the Range header
+	IfRange      string `json:"if_range,omitempty"`      // the If-Range header
+	ContentRange string `json:"content_range,omitempty"` // from a 206 or 416 response
+	Ignored      bool   `json:"ignored,omitempty"`       // the origin sent the full body (200) instead
+}
+
+// requestRange returns the range a request asked for, or nil
+func requestRange(req *http.Request) *RangeInfo {
+	value := req.Header.Get("Range")
+	if value == "" {
+		return nil
+	}
+	return &RangeInfo{Requested: value, IfRange: req.Header.Get("If-Range")}
+}
+
+// responseRange adds how the origin answered to the range resp's request
+// asked for. It returns nil if neither side used ranges.
+func responseRange(resp *http.Response) *RangeInfo {
+	var info *RangeInfo
+	if resp.Request != nil {
+		info = requestRange(resp.Request)
+	}
+	value := resp.Header.Get("Content-Range")
+	if info == nil && value == "" {
+		return nil
+	}
+	if info == nil {
+		info = &RangeInfo{}
+	}
+	info.ContentRange = value
+	info.Ignored = info.Requested != "" && resp.StatusCode == http.StatusOK
+	return info
+}
+
+// contentRange is a parsed single-part "bytes start-end/size" header
+type contentRange struct {
+	start, end int64 // inclusive
+	size       int64 // -1 if the origin sent "*"
+}
+
+func parseContentRange(value string) (contentRange, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return contentRange{}, false
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return contentRange{}, false
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return contentRange{}, false
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return contentRange{}, false
+	}
+	size := int64(-1)
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || n <= end {
+			return contentRange{}, false
+		}
+		size = n
+	}
+	return contentRange{start: start, end: end, size: size}, true
+}
+
+// rangeAssembly is the running hash of the first next bytes of a resource,
+// as relayed to the client so far
+type rangeAssembly struct {
+	hash      hash.Hash
+	next      int64  // offset the next range has to start at
+	size      int64  // full resource size, -1 if not yet known
+	validator string // ETag or Last-Modified the ranges must share
+	segments  int    // responses the hash covers
+	updated   time.Time
+}
+
+// resourceValidator returns what identifies the version of a resource
+func resourceValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// rangeTracker carries the hash of verified downloads across the responses
+// they arrive in, so a download resumed or split into consecutive ranges is
+// judged as the whole resource. Assemblies are keyed by URL.
+type rangeTracker struct {
+	mu         sync.Mutex
+	assemblies map[string]*rangeAssembly
+}
+
+func newRangeTracker() *rangeTracker {
+	return &rangeTracker{assemblies: make(map[string]*rangeAssembly)}
+}
+
+// place returns the assembly a response body continues, or nil if it
+// can't be placed within its resource: a range that neither starts the
+// resource nor continues where an earlier response left off, a multipart
+// or unparseable range, or one of unknown total size. An assembly that's
+// continued is claimed until put back.
+func (t *rangeTracker) place(key string, resp *http.Response) *rangeAssembly {
+	validator := resourceValidator(resp.Header)
+	if resp.StatusCode != http.StatusPartialContent {
+		// Any other status says nothing about a download in progress, so
+		// its body is hashed on its own, with no size to resume from
+		size := int64(-1)
+		if resp.StatusCode == http.StatusOK {
+			// A full body starts over, whatever was assembled before
+			t.mu.Lock()
+			delete(t.assemblies, key)
+			t.mu.Unlock()
+			size = resp.ContentLength
+			if resp.Uncompressed {
+				// Ranges index the encoded body, not what the client got
+				size = -1
+			}
+		}
+		return &rangeAssembly{hash: sha256.New(), size: size, validator: validator}
+	}
+
+	cr, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || cr.size < 0 {
+		return nil
+	}
+	if cr.start == 0 {
+		return &rangeAssembly{hash: sha256.New(), size: cr.size, validator: validator}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.assemblies[key]
+	if !ok || a.next != cr.start || (a.size >= 0 && a.size != cr.size) || a.validator != validator {
+		return nil
+	}
+	delete(t.assemblies, key)
+	a.size = cr.size
+	return a
+}
+
+// locate returns the assembly a response body starts or continues, or
+// why it can't be placed within its resource. The proxy never fetches a
+// part of the resource it didn't relay itself, so a range that doesn't
+// continue a download it saw can't be verified.
+func (t *rangeTracker) locate(key string, resp *http.Response) (*rangeAssembly, error) {
+	if a := t.place(key, resp); a != nil {
+		return a, nil
+	}
+
+	cr, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case !ok && strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges"):
+		return nil, errors.New("multipart ranges can't be placed within the resource")
+	case !ok:
+		return nil, fmt.Errorf("unsupported Content-Range %q", resp.Header.Get("Content-Range"))
+	case cr.size < 0:
+		return nil, errors.New("resource size unknown")
+	}
+	return nil, fmt.Errorf("unverifiable: prefix not seen (range starts at byte %d)", cr.start)
+}
+
+// put stores an assembly whose next range hasn't been seen yet
+func (t *rangeTracker) put(key string, a *rangeAssembly) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a.updated = time.Now()
+	t.assemblies[key] = a
+	if len(t.assemblies) <= maxRangeAssemblies {
+		return
+	}
+	var oldest string
+	for k, other := range t.assemblies {
+		if oldest == "" || other.updated.Before(t.assemblies[oldest].updated) {
+			oldest = k
+		}
+	}
+	delete(t.assemblies, oldest)
+}
+
+// cloneHash copies a sha256 state so it can be finished early
+func cloneHash(h hash.Hash) hash.Hash {
+	clone := sha256.New()
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err == nil {
+		err = clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	}
+	if err != nil {
+		panic("sha256 state can't be copied: " + err.Error())
+	}
+	return clone
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangedOrigin serves a 100KB file at /file.bin with Range support,
+// counting the requests it gets
+func rangedOrigin(t *testing.T) (*httptest.Server, []byte, *atomic.Int64) {
+	t.Helper()
+	content := make([]byte, 100_000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	var hits atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+	return origin, content, &hits
+}
+
+// verifyRules writes a rules file verifying everything on the origin,
+// against an allowlist of allowed hashes if any are given
+func verifyRules(t *testing.T, onMismatch string, allowed ...string) string {
+	t.Helper()
+	rules := "version: 1\nverify:\n  targets:\n    - host: 127.0.0.1\n"
+	if len(allowed) > 0 {
+		list := filepath.Join(t.TempDir(), "known-good.sha256")
+		var lines bytes.Buffer
+		for _, sum := range allowed {
+			fmt.Fprintf(&lines, "%s  file.bin\n", sum)
+		}
+		if err := os.WriteFile(list, lines.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules += "  allowlist: " + list + "\n  on_mismatch: " + onMismatch + "\n"
+	}
+	return writeRules(t, rules)
+}
+
+func getRange(t *testing.T, client *http.Client, url, spec string) (*http.Response, string) {
+	t.Helper()
+	req := newRequest(t, http.MethodGet, url, "")
+	req.Header.Set("Range", spec)
+	return fetch(t, client, req)
+}
+
+func TestRangedDownloadAssembles(t *testing.T) {
+	origin, content, _ := rangedOrigin(t)
+	whole := sha256.Sum256(content)
+	s := startServer(t, "-rules="+verifyRules(t, "block", hex.EncodeToString(whole[:])))
+	client := proxiedClient(t, s)
+	url := origin.URL + "/file.bin"
+
+	first, head := getRange(t, client, url, "bytes=0-49999")
+	second, tail := getRange(t, client, url, "bytes=50000-")
+	if first.StatusCode != http.StatusPartialContent || second.StatusCode != http.StatusPartialContent {
+		t.Fatalf("statuses %d, %d, want 206s", first.StatusCode, second.StatusCode)
+	}
+	if got := head + tail; got != string(content) {
+		t.Fatalf("reassembled %d bytes that differ from the %d-byte resource", len(got), len(content))
+	}
+
+	// The first part is never judged on its own; the second completes the
+	// hash of the whole resource, which the allowlist accepts
+	entries := make([]RequestLog, 2)
+	for i, spec := range []string{"bytes=0-49999", "bytes=50000-"} {
+		entries[i] = waitForEntry(t, s, func(e RequestLog) bool {
+			return e.Range != nil && e.Range.Requested == spec && e.Content != nil
+		})
+	}
+	if e := entries[0]; e.ResponseStatus != http.StatusPartialContent || e.Range.ContentRange != "bytes 0-49999/100000" || e.Content.Result != "range_pending" || e.Content.SHA256 != "" {
+		t.Errorf("first part logged %d %+v %+v", e.ResponseStatus, e.Range, e.Content)
+	}
+	if e := entries[1]; e.ResponseStatus != http.StatusPartialContent || e.Range.ContentRange != "bytes 50000-99999/100000" {
+		t.Errorf("second part logged %d %+v", e.ResponseStatus, e.Range)
+	}
+	check := entries[1].Content
+	if check.SHA256 != hex.EncodeToString(whole[:]) || check.Result != "allowed" || check.Segments != 2 {
+		t.Errorf("second part judged %+v, want the whole resource allowed over 2 segments", check)
+	}
+}
+
+func TestRangeWithoutPrefixIsUnverifiable(t *testing.T) {
+	origin, content, hits := rangedOrigin(t)
+	whole := sha256.Sum256(content)
+	s := startServer(t, "-rules="+verifyRules(t, "flag", hex.EncodeToString(whole[:])))
+	client := proxiedClient(t, s)
+
+	// A download resumed somewhere the proxy never saw it start
+	resp, tail := getRange(t, client, origin.URL+"/file.bin", "bytes=50000-")
+	if resp.StatusCode != http.StatusPartialContent || tail != string(content[50000:]) {
+		t.Fatalf("flagged range: %d with %d bytes", resp.StatusCode, len(tail))
+	}
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Content != nil })
+	if c := entry.Content; c.Result != "range_unverifiable" || c.Action != "flagged" || c.Error != "unverifiable: prefix not seen (range starts at byte 50000)" {
+		t.Errorf("logged %+v", c)
+	}
+
+	// The proxy didn't fetch the missing bytes behind the client's back
+	if n := hits.Load(); n != 1 {
+		t.Errorf("origin got %d requests, want only the client's", n)
+	}
+	if n := len(s.Logger().GetRequests()); n != 1 {
+		t.Errorf("%d entries logged, want 1", n)
+	}
+}
+
+func TestOnlyResourcesAreVerified(t *testing.T) {
+	// Nothing on the origin is allowlisted, so anything verified is blocked
+	s := startServer(t, "-rules="+verifyRules(t, "block", strings.Repeat("0", 64)))
+	origin := newOrigin(t, true)
+	client := proxiedClient(t, s)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/missing", http.StatusNotFound},
+		{"/redirect?to=/echo", http.StatusFound},
+	} {
+		resp, body := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+tc.path, ""))
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d relayed unjudged", tc.path, resp.StatusCode, tc.status)
+		}
+		path, _, _ := strings.Cut(tc.path, "?")
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == path && e.ResponseStatus != 0 })
+		if entry.Content != nil || entry.ResponseBody != body {
+			t.Errorf("%s: logged content %+v and body %q, want the body captured as usual", tc.path, entry.Content, entry.ResponseBody)
+		}
+	}
+
+	// A 200 from the same origin is still judged, and cut off once its
+	// hash isn't on the allowlist
+	if resp, err := client.Get(origin.URL + "/echo"); err == nil {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" && e.Content != nil })
+	if entry.Content.Action != "blocked" {
+		t.Errorf("unlisted 200 judged %+v, want it blocked", entry.Content)
+	}
+}
+
+func TestOnlyFullBodiesRestartAnAssembly(t *testing.T) {
+	const key = "http://example.com/file.bin"
+	for _, tc := range []struct {
+		status int
+		kept   bool
+	}{
+		{http.StatusNotModified, true},
+		{http.StatusNotFound, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusOK, false},
+	} {
+		tracker := newRangeTracker()
+		partial := &rangeAssembly{hash: sha256.New(), size: 100_000, next: 50_000, validator: `"v1"`}
+		tracker.put(key, partial)
+
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{"Etag": {`"v1"`}}, ContentLength: 10}
+		a := tracker.place(key, resp)
+		if a == nil || a == partial {
+			t.Fatalf("%d: placed in %+v, want a fresh assembly", tc.status, a)
+		}
+		if tc.kept && a.size >= 0 {
+			t.Errorf("%d: body can be resumed from, size %d", tc.status, a.size)
+		}
+		if _, ok := tracker.assemblies[key]; ok != tc.kept {
+			t.Errorf("%d: assembly in progress kept %v, want %v", tc.status, ok, tc.kept)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// canary is a credential that must never appear in anything the proxy
+// produces once it's been redacted
+const canary = "canary-5d0c7e2b9a41f3"
+
+// recorder is a server that keeps everything it's sent
+type recorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []string // request headers and bodies, or webhook payloads
+}
+
+func newRecorder(t *testing.T) *recorder {
+	t.Helper()
+	rec := &recorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var dump strings.Builder
+		r.Header.Write(&dump)
+		dump.Write(body)
+		rec.mu.Lock()
+		rec.received = append(rec.received, dump.String())
+		rec.mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *recorder) all() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.received...)
+}
+
+// assertNoCanary fails if what an output produced contains the canary
+func assertNoCanary(t *testing.T, output, produced string) {
+	t.Helper()
+	if strings.Contains(produced, canary) {
+		t.Errorf("%s leaked the canary: %s", output, produced)
+	}
+}
+
+// TestRedactedCanaryLeaksNowhere logs requests carrying a credential in
+// redacted headers and checks every output built from entries: the API,
+// the stream, replays, composed requests, the aggregator, webhooks and the
+// log on disk. New outputs belong here.
+func TestRedactedCanaryLeaksNowhere(t *testing.T) {
+	t.Setenv("CANARY_TOKEN", canary)
+	hook := newRecorder(t)
+	origin := newRecorder(t)
+	s := startServer(t, "-replay-env=X-Replay-Token=CANARY_TOKEN@127.0.0.1", "-webhook="+hook.URL, "-webhook-events=filter_match")
+	stream, stop := s.pipeline.Subscribe()
+	defer stop()
+
+	// An alerting filter sends every entry's match to the webhook
+	status, body := apiRequest(t, s, http.MethodPost, "/api/filters", `{"name": "all", "expression": "path = /canary", "alert": true}`, nil)
+	if status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("saving the filter: %d %s", status, body)
+	}
+
+	// Proxied, with the canary in every header redacted by default
+	req := newRequest(t, http.MethodPost, origin.URL+"/canary", `{"ok": true}`)
+	req.Header.Set("Authorization", "Bearer "+canary)
+	req.Header.Set("X-Api-Key", canary)
+	req.Header.Set("Api-Key", canary)
+	fetch(t, proxiedClient(t, s), req)
+	entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/canary" && e.ClientDoneAt != nil })
+
+	// Composed, with the canary read from the environment into a header
+	template := `{"method": "POST", "url": "` + origin.URL + `/canary", "headers": {"X-Replay-Token": "{{env:CANARY_TOKEN}}"}}`
+	status, body = compose(t, s, template)
+	if status != http.StatusOK {
+		t.Fatalf("compose: %d %s", status, body)
+	}
+	assertNoCanary(t, "POST /api/compose", body)
+
+	// Replayed: the redacted headers aren't restored, so the origin only
+	// gets the canary where -replay-env maps it in
+	before := len(origin.all())
+	status, body = apiRequest(t, s, http.MethodPost, "/api/requests/"+entry.ID+"/replay", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("replay: %d %s", status, body)
+	}
+	assertNoCanary(t, "POST /api/requests/{id}/replay", body)
+	for _, got := range origin.all()[before:] {
+		for _, line := range strings.Split(got, "\r\n") {
+			if !strings.HasPrefix(line, "X-Replay-Token: ") {
+				assertNoCanary(t, "the replayed request", line)
+			}
+		}
+	}
+
+	waitFor(t, "all three entries to be enriched", func() bool { return s.pipeline.Status().Processed == 3 })
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-stream:
+			assertNoCanary(t, "/api/stream", mustJSON(t, e))
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing a streamed entry")
+		}
+	}
+
+	// Every read of the API
+	for _, e := range s.Logger().GetRequests() {
+		_, body := apiRequest(t, s, http.MethodGet, "/api/requests/"+e.ID, "", nil)
+		assertNoCanary(t, "GET /api/requests/"+e.ID, body)
+	}
+	for _, path := range []string{"/api/requests", "/api/events", "/api/stats", "/api/policy/suggest", "/api/hosts/" + entry.Domain + "/capabilities"} {
+		_, body := apiRequest(t, s, http.MethodGet, path, "", nil)
+		assertNoCanary(t, "GET "+path, body)
+	}
+
+	// The aggregator's view of the same instance
+	peers, err := ParsePeers("local=http://"+s.WebAddr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewAggregator(peers, "", "").Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregator := httptest.NewServer(handler)
+	defer aggregator.Close()
+	for _, path := range []string{"/api/requests", "/api/requests/local:" + entry.ID, "/api/events"} {
+		resp, err := http.Get(aggregator.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assertNoCanary(t, "aggregated GET "+path, string(data))
+	}
+
+	// Webhook deliveries
+	waitFor(t, "filter_match deliveries", func() bool { return len(hook.all()) > 0 })
+	for _, got := range hook.all() {
+		assertNoCanary(t, "the webhook", got)
+	}
+
+	// And the log itself, once everything's flushed
+	s.Shutdown(time.Second)
+	files, _ := filepath.Glob(filepath.Join(s.cfg.LogsDir, "*"))
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			assertNoCanary(t, filepath.Base(path), scanner.Text())
+		}
+		f.Close()
+	}
+}
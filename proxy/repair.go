@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runRepair implements `proxy repair`. The proxy must not be running
+// against the same logs directory while it runs.
+func runRepair(args []string) int {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	logsDir := fs.String("logs", "/logs", "Directory containing requests.jsonl")
+	fs.Parse(args)
+
+	if _, err := repairLogs(*logsDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Repair failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// repairResult counts what repairLogs did with the records it read
+type repairResult struct {
+	Kept        int // entries written back
+	Merged      int // records folded into a kept entry or run marker
+	Quarantined int // lines moved to requests.jsonl.rej
+}
+
+// repairLogs rewrites requests.jsonl keeping only valid entries, one line per
+// ID, and moves unparseable lines into requests.jsonl.rej
+func repairLogs(logsDir string) (repairResult, error) {
+	logPath := filepath.Join(logsDir, "requests.jsonl")
+	rejPath := logPath + ".rej"
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		return repairResult{}, fmt.Errorf("failed to read log file: %w", err)
+	}
+
+	entries, runs, skipped := parseLogLines(data)
+
+	records := 0
+	for _, line := range splitLines(data) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			records++
+		}
+	}
+	for _, s := range skipped {
+		if s.Reason != "truncated record" {
+			records--
+		}
+	}
+
+	// Quarantine bad lines before rewriting so they survive a crash mid-repair
+	if len(skipped) > 0 {
+		rej, err := os.OpenFile(rejPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return repairResult{}, fmt.Errorf("failed to open reject file: %w", err)
+		}
+		for _, s := range skipped {
+			if _, err := rej.Write(append(s.Raw, '\n')); err != nil {
+				rej.Close()
+				return repairResult{}, fmt.Errorf("failed to write reject file: %w", err)
+			}
+		}
+		if err := rej.Sync(); err != nil {
+			rej.Close()
+			return repairResult{}, fmt.Errorf("failed to sync reject file: %w", err)
+		}
+		if err := rej.Close(); err != nil {
+			return repairResult{}, fmt.Errorf("failed to close reject file: %w", err)
+		}
+	}
+
+	// Keep the latest run marker so the next run's epoch stays monotonic
+	var buf bytes.Buffer
+	markers := 0
+	if len(runs) > 0 {
+		markers = 1
+		line, err := json.Marshal(runs[len(runs)-1])
+		if err != nil {
+			return repairResult{}, fmt.Errorf("failed to marshal run marker: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return repairResult{}, fmt.Errorf("failed to marshal entry %s: %w", entry.ID, err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(logPath, buf.Bytes(), 0o644); err != nil {
+		return repairResult{}, fmt.Errorf("failed to rewrite log file: %w", err)
+	}
+	// The stats checkpoint points into the old file; the next run rebuilds it
+	if err := os.Remove(countersStatePath(logsDir)); err != nil && !os.IsNotExist(err) {
+		return repairResult{}, fmt.Errorf("failed to remove stats checkpoint: %w", err)
+	}
+
+	result := repairResult{Kept: len(entries), Merged: records - len(entries) - markers, Quarantined: len(skipped)}
+	fmt.Printf("Repaired %s: kept %d entries, merged %d records, quarantined %d lines\n",
+		logPath, result.Kept, result.Merged, result.Quarantined)
+	for _, s := range skipped {
+		fmt.Printf("  line %d: %s\n", s.Line, s.Reason)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("Rejected lines appended to %s\n", rejPath)
+	}
+	return result, nil
+}
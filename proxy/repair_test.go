@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairCounts(t *testing.T) {
+	logsDir := t.TempDir()
+	log := `{"type":"run_start","epoch":1,"started_at":"2026-01-01T00:00:00Z","pid":100}
+{"id":"a","timestamp":"2026-01-01T00:00:01Z","method":"GET","path":"/a","headers":{},"pcap_file":"","epoch":1}
+{"type":"response","id":"a","response_status":200}
+{"type":"run_start","epoch":2,"started_at":"2026-01-02T00:00:00Z","pid":200}
+{"id":"b","timestamp":"2026-01-02T00:00:01Z","method":"GET","path":"/b","headers":{},"pcap_file":"","epoch":2}
+{"id":"b","timestamp":"2026-01-02T00:00:01Z","method":"GET","path":"/b","headers":{},"pcap_file":"","epoch":2,"response_status":204}
+not json
+{"type":"run_start","epoch":3,"started_at":"2026-01-03T00:00:00Z","pid":300}
+`
+	logPath := filepath.Join(logsDir, "requests.jsonl")
+	if err := os.WriteFile(logPath, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := repairLogs(logsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a's response and b's second record fold into their entries, and only
+	// the last of the three run markers is written back
+	if want := (repairResult{Kept: 2, Merged: 4, Quarantined: 1}); result != want {
+		t.Errorf("repair reported %+v, want %+v", result, want)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, runs, skipped := parseLogLines(data)
+	if len(entries) != 2 || len(runs) != 1 || runs[0].Epoch != 3 || len(skipped) != 0 {
+		t.Errorf("repaired log has %d entries, run markers %+v, %d bad lines", len(entries), runs, len(skipped))
+	}
+	if rej, err := os.ReadFile(logPath + ".rej"); err != nil || string(rej) != "not json\n" {
+		t.Errorf("reject file has %q (%v)", rej, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// replayTimeout bounds a single replayed exchange
+const replayTimeout = 60 * time.Second
+
+var (
+	errReplayNotFound = errors.New("request not found")
+	errReplayInvalid  = errors.New("entry cannot be replayed") // can't be replayed faithfully
+)
+
+// hopHeaders are connection-level headers that must not be copied into a replay
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Upgrade",
+}
+
+// ReplayTransforms freshen a captured request before it is sent again
+type ReplayTransforms struct {
+	RegenerateDate bool                 // replace Date with the current time
+	NewIdempotency bool                 // replace Idempotency-Key with a fresh value
+	Strip          []string             // headers to remove
+	EnvHeaders     map[string]EnvHeader // header -> where to read its value at replay time
+}
+
+// EnvHeader is a header value read from the environment, and the hosts it
+// may be sent to. The value never goes to any other host.
+type EnvHeader struct {
+	Env   string   `yaml:"var"`
+	Hosts []string `yaml:"hosts"` // path.Match patterns
+}
+
+// allows reports whether the value may be sent to host
+func (h EnvHeader) allows(host string) bool {
+	for _, pattern := range h.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEnvHeaders parses "Header=ENV_VAR@host|*.host,Other=OTHER_VAR@host".
+// Every mapping must name the hosts its value may be sent to.
+func ParseEnvHeaders(list string) (map[string]EnvHeader, error) {
+	m := make(map[string]EnvHeader)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		header, target, ok := strings.Cut(item, "=")
+		env, hosts, hasHosts := strings.Cut(target, "@")
+		header, env = strings.TrimSpace(header), strings.TrimSpace(env)
+		if !ok || !validHeaderName(header) || !envVarPattern.MatchString(env) {
+			return nil, fmt.Errorf("invalid Header=ENV_VAR@hosts mapping %q", item)
+		}
+		if !hasHosts || strings.TrimSpace(hosts) == "" {
+			return nil, fmt.Errorf("mapping %q must list the hosts it may be sent to, e.g. %s=%s@api.example.com", item, header, env)
+		}
+		h := EnvHeader{Env: env}
+		for _, host := range strings.Split(hosts, "|") {
+			host = strings.TrimSpace(host)
+			if _, err := path.Match(host, ""); err != nil || host == "" {
+				return nil, fmt.Errorf("invalid host pattern %q in %q", host, item)
+			}
+			h.Hosts = append(h.Hosts, host)
+		}
+		m[http.CanonicalHeaderKey(header)] = h
+	}
+	return m, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Apply rewrites req in place and returns a description of each transform applied
+func (t ReplayTransforms) Apply(req *http.Request) []string {
+	var applied []string
+
+	for _, name := range t.Strip {
+		name = http.CanonicalHeaderKey(name)
+		if req.Header.Get(name) != "" {
+			req.Header.Del(name)
+			applied = append(applied, "strip:"+name)
+		}
+	}
+
+	// Credentials are resolved from the environment on every replay and never
+	// stored, and only sent to the hosts their mapping lists
+	for name, h := range t.EnvHeaders {
+		if !h.allows(req.URL.Hostname()) {
+			applied = append(applied, "env-refused:"+name+"<-"+h.Env)
+			continue
+		}
+		value, ok := os.LookupEnv(h.Env)
+		if !ok {
+			applied = append(applied, "env-missing:"+name+"<-"+h.Env)
+			continue
+		}
+		req.Header.Set(name, value)
+		applied = append(applied, "env:"+name+"<-"+h.Env)
+	}
+
+	// Redacted values are useless upstream; drop any that weren't substituted
+	for name, values := range req.Header {
+		if len(values) > 0 && values[0] == "[REDACTED]" {
+			req.Header.Del(name)
+			applied = append(applied, "drop-redacted:"+name)
+		}
+	}
+
+	if t.RegenerateDate && req.Header.Get("Date") != "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		applied = append(applied, "date:regenerated")
+	}
+
+	if t.NewIdempotency && req.Header.Get("Idempotency-Key") != "" {
+		req.Header.Set("Idempotency-Key", uuid.New().String())
+		applied = append(applied, "idempotency-key:regenerated")
+	}
+
+	// Expired JWTs can't be refreshed here, but flag them so a failed
+	// replay is easy to explain
+	for name, values := range req.Header {
+		if len(values) > 0 && jwtExpired(values[0]) {
+			applied = append(applied, "jwt-expired:"+name)
+		}
+	}
+
+	return applied
+}
+
+// jwtExpired reports whether value contains a JWT whose exp claim is in the past
+func jwtExpired(value string) bool {
+	token := strings.TrimSpace(strings.TrimPrefix(value, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return false
+	}
+	return time.Unix(int64(*claims.Exp), 0).Before(time.Now())
+}
+
+// Replayer re-sends captured requests through the proxy's gate and
+// upstream transport
+type Replayer struct {
+	logger     *Logger
+	gate       *Gate
+	tracing    *TraceConfig
+	pipeline   *EnrichPipeline
+	transport  http.RoundTripper
+	transforms ReplayTransforms // flag defaults; the rules file's replay section overrides them
+	rules      *RuleStore
+}
+
+// NewReplayer creates a replayer that logs and enriches replayed exchanges
+// like any other entry
+func NewReplayer(logger *Logger, gate *Gate, tracing *TraceConfig, pipeline *EnrichPipeline, transport http.RoundTripper, transforms ReplayTransforms, rules *RuleStore) *Replayer {
+	return &Replayer{
+		logger:     logger,
+		gate:       gate,
+		tracing:    tracing,
+		pipeline:   pipeline,
+		transport:  transport,
+		transforms: transforms,
+		rules:      rules,
+	}
+}
+
+// Replay re-sends the entry with the given ID and returns the new entry
+func (r *Replayer) Replay(id string) (RequestLog, error) {
+	orig, ok := r.logger.GetRequest(id)
+	if !ok {
+		return RequestLog{}, fmt.Errorf("%w: %s", errReplayNotFound, id)
+	}
+	if strings.HasSuffix(orig.Body, "... [truncated]") {
+		return RequestLog{}, fmt.Errorf("%w: request body was truncated when captured", errReplayInvalid)
+	}
+	if orig.CaptureSkipped != "" {
+		return RequestLog{}, fmt.Errorf("%w: bodies weren't captured (%s)", errReplayInvalid, orig.CaptureSkipped)
+	}
+	if orig.QueryTruncated {
+		return RequestLog{}, fmt.Errorf("%w: query string was truncated when captured", errReplayInvalid)
+	}
+
+	scheme := orig.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+
+	target := scheme + "://" + orig.Domain + orig.Path
+	if orig.Query != "" {
+		target += "?" + orig.Query
+	}
+	req, err := http.NewRequestWithContext(ctx, orig.Method, target, bytes.NewReader([]byte(orig.Body)))
+	if err != nil {
+		return RequestLog{}, fmt.Errorf("%w: %v", errReplayInvalid, err)
+	}
+	for name, value := range orig.Headers {
+		req.Header.Set(name, value)
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+
+	transforms := r.rules.Get().replayTransforms(r.transforms)
+	applied := transforms.Apply(req)
+
+	var substituted []string
+	for name := range transforms.EnvHeaders {
+		substituted = append(substituted, name)
+	}
+	trace := r.tracing.Start(req)
+	decision := r.gate.Check(req, trace)
+	entry := r.logger.LogRequest(req, LogOptions{
+		Trace:         trace,
+		Redact:        substituted,
+		ReplayOf:      orig.ID,
+		ReplayApplied: applied,
+		Policy:        decision.Policy,
+	})
+	fmt.Printf("[%s] replay of %s: %s %s%s\n", entry.ID, orig.ID, req.Method, req.Host, req.URL.Path)
+
+	// A replayed LLM call counts against the budget like the original did
+	if refusal := decision.Refuse(r.logger, entry.ID, req); refusal != nil {
+		r.logger.LogResponse(entry.ID, refusal)
+		io.Copy(io.Discard, refusal.Body)
+		refusal.Body.Close()
+		r.pipeline.Submit(entry.ID, refusal)
+		refused, _ := r.logger.GetRequest(entry.ID)
+		return refused, decision.Err()
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		r.logger.LogError(entry.ID, "upstream_error: "+err.Error())
+		r.pipeline.Submit(entry.ID, nil)
+		failed, _ := r.logger.GetRequest(entry.ID)
+		return failed, fmt.Errorf("replay failed: %w", err)
+	}
+	r.logger.LogResponse(entry.ID, resp)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	r.pipeline.Submit(entry.ID, resp)
+
+	replayed, _ := r.logger.GetRequest(entry.ID)
+	return replayed, nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesVersion is the only rules file schema version understood so far
+const rulesVersion = 1
+
+// envVarPattern matches a valid environment variable name
+var envVarPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Rules is the parsed rules file: one section per subsystem. A missing
+// section leaves that subsystem on its defaults (or its flags).
+type Rules struct {
+	Version int          `yaml:"version"`
+	Redact  RedactRules  `yaml:"redact"`
+	Capture CaptureRules `yaml:"capture"`
+	Replay  *ReplayRules `yaml:"replay"`
+	Verify  VerifyRules  `yaml:"verify"`
+	LLM     LLMRules     `yaml:"llm"`
+	Policy  *PolicyRules `yaml:"policy"`
+}
+
+// RedactRules lists headers redacted in addition to the built-in ones
+type RedactRules struct {
+	Headers []string `yaml:"headers"`
+}
+
+// CaptureRules controls which bodies are captured and how much of them,
+// and how much of each query string is kept
+type CaptureRules struct {
+	BodyMethods   []string `yaml:"body_methods"`
+	MaxBodyBytes  int      `yaml:"max_body_bytes"`
+	MaxQueryBytes int      `yaml:"max_query_bytes"`
+}
+
+// ReplayRules overrides the -replay-* flags
+type ReplayRules struct {
+	Strip             []string             `yaml:"strip"`
+	Env               map[string]EnvHeader `yaml:"env"`
+	RegenerateDate    *bool                `yaml:"regenerate_date"`
+	NewIdempotencyKey *bool                `yaml:"new_idempotency_key"`
+}
+
+// defaultRules are used when no rules file is given
+func defaultRules() *Rules {
+	return &Rules{
+		Version: rulesVersion,
+		Capture: CaptureRules{
+			BodyMethods:   []string{"POST", "PUT", "PATCH"},
+			MaxBodyBytes:  10 * 1024,
+			MaxQueryBytes: 2 * 1024,
+		},
+	}
+}
+
+// capturesBody reports whether request bodies are captured for method
+func (c CaptureRules) capturesBody(method string) bool {
+	for _, m := range c.BodyMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigError is a problem at a specific place in a config file
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// rulesParser collects every error in a rules file rather than stopping at the first
+type rulesParser struct {
+	file string
+	errs []error
+}
+
+func (p *rulesParser) errorf(node *yaml.Node, format string, args ...interface{}) {
+	err := &ConfigError{File: p.file, Msg: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	p.errs = append(p.errs, err)
+}
+
+// mapping checks node is a mapping with only the allowed keys and returns its
+// values by key
+func (p *rulesParser) mapping(node *yaml.Node, where string, allowed ...string) map[string]*yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "%s must be a mapping", where)
+		return nil
+	}
+
+	values := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		known := false
+		for _, a := range allowed {
+			if key.Value == a {
+				known = true
+			}
+		}
+		if !known {
+			p.errorf(key, "unknown %s %q (expected one of: %s)", where, key.Value, strings.Join(allowed, ", "))
+			continue
+		}
+		if _, dup := values[key.Value]; dup {
+			p.errorf(key, "duplicate key %q in %s", key.Value, where)
+			continue
+		}
+		values[key.Value] = value
+	}
+	return values
+}
+
+// decode decodes node into out, recording type errors at their positions
+func (p *rulesParser) decode(node *yaml.Node, out interface{}) {
+	if err := node.Decode(out); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, msg := range typeErr.Errors {
+				p.errorf(nodeForTypeError(node, msg), "%s", typeErrorMessage(msg))
+			}
+			return
+		}
+		p.errorf(node, "%v", err)
+	}
+}
+
+// typeErrorLine matches the "line N: " prefix yaml.v3 puts on type errors
+var typeErrorLine = regexp.MustCompile(`^line (\d+): `)
+
+// typeErrorMessage strips the line prefix, since ConfigError reports the position
+func typeErrorMessage(msg string) string {
+	return typeErrorLine.ReplaceAllString(msg, "")
+}
+
+// nodeForTypeError finds the node a yaml.v3 type error refers to, so it can
+// be reported with a column as well as a line
+func nodeForTypeError(node *yaml.Node, msg string) *yaml.Node {
+	m := typeErrorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return node
+	}
+	line, _ := strconv.Atoi(m[1])
+	if found := findNodeAtLine(node, line); found != nil {
+		return found
+	}
+	return node
+}
+
+func findNodeAtLine(node *yaml.Node, line int) *yaml.Node {
+	if node.Line == line && node.Kind == yaml.ScalarNode {
+		return node
+	}
+	for _, child := range node.Content {
+		if found := findNodeAtLine(child, line); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// ParseRules parses and validates a rules file, returning every problem found
+func ParseRules(file string, data []byte) (*Rules, []error) {
+	p := &rulesParser{file: file}
+	rules := defaultRules()
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		p.errs = append(p.errs, &ConfigError{File: file, Msg: err.Error()})
+		return nil, p.errs
+	}
+	if len(doc.Content) == 0 {
+		p.errorf(nil, "file is empty")
+		return nil, p.errs
+	}
+
+	sections := p.mapping(doc.Content[0], "section", "version", "redact", "capture", "replay", "verify", "llm", "policy")
+	if sections == nil {
+		return nil, p.errs
+	}
+
+	if node, ok := sections["version"]; !ok {
+		p.errorf(doc.Content[0], "missing version (current version is %d)", rulesVersion)
+	} else {
+		p.decode(node, &rules.Version)
+		if rules.Version != rulesVersion {
+			p.errorf(node, "unsupported version %d (current version is %d)", rules.Version, rulesVersion)
+		}
+	}
+
+	if node, ok := sections["redact"]; ok {
+		p.parseRedact(node, &rules.Redact)
+	}
+	if node, ok := sections["capture"]; ok {
+		p.parseCapture(node, &rules.Capture)
+	}
+	if node, ok := sections["replay"]; ok {
+		rules.Replay = &ReplayRules{}
+		p.parseReplay(node, rules.Replay)
+	}
+	if node, ok := sections["verify"]; ok {
+		p.parseVerify(node, &rules.Verify)
+	}
+	if node, ok := sections["llm"]; ok {
+		p.parseLLM(node, &rules.LLM)
+	}
+	if node, ok := sections["policy"]; ok {
+		rules.Policy = &PolicyRules{}
+		p.parsePolicy(node, rules.Policy)
+	}
+
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	return rules, nil
+}
+
+func (p *rulesParser) parseRedact(node *yaml.Node, r *RedactRules) {
+	keys := p.mapping(node, "redact key", "headers")
+	if n, ok := keys["headers"]; ok {
+		p.decode(n, &r.Headers)
+		p.checkHeaderNames(n, r.Headers)
+	}
+}
+
+func (p *rulesParser) parseCapture(node *yaml.Node, c *CaptureRules) {
+	keys := p.mapping(node, "capture key", "body_methods", "max_body_bytes", "max_query_bytes")
+	if n, ok := keys["body_methods"]; ok {
+		c.BodyMethods = nil
+		p.decode(n, &c.BodyMethods)
+		for i, m := range c.BodyMethods {
+			if m == "" || strings.ToUpper(m) != m {
+				p.errorf(itemNode(n, i), "method %q must be an upper-case HTTP method", m)
+			}
+		}
+	}
+	if n, ok := keys["max_body_bytes"]; ok {
+		p.decode(n, &c.MaxBodyBytes)
+		if c.MaxBodyBytes <= 0 {
+			p.errorf(n, "max_body_bytes must be positive")
+		}
+	}
+	if n, ok := keys["max_query_bytes"]; ok {
+		p.decode(n, &c.MaxQueryBytes)
+		if c.MaxQueryBytes <= 0 {
+			p.errorf(n, "max_query_bytes must be positive")
+		}
+	}
+}
+
+func (p *rulesParser) parseReplay(node *yaml.Node, r *ReplayRules) {
+	keys := p.mapping(node, "replay key", "strip", "env", "regenerate_date", "new_idempotency_key")
+	if n, ok := keys["strip"]; ok {
+		p.decode(n, &r.Strip)
+		p.checkHeaderNames(n, r.Strip)
+	}
+	if n, ok := keys["env"]; ok && n.Kind == yaml.MappingNode {
+		r.Env = make(map[string]EnvHeader)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			header, value := n.Content[i], n.Content[i+1]
+			if !validHeaderName(header.Value) {
+				p.errorf(header, "invalid header name %q", header.Value)
+			}
+			// Credentials are tied to the hosts they may be sent to
+			keys := p.mapping(value, "replay env key", "var", "hosts")
+			if keys == nil {
+				continue
+			}
+			var h EnvHeader
+			if v, ok := keys["var"]; ok {
+				p.decode(v, &h.Env)
+				if !envVarPattern.MatchString(h.Env) {
+					p.errorf(v, "invalid environment variable name %q", h.Env)
+				}
+			} else {
+				p.errorf(value, "replay env for %s must set var", header.Value)
+			}
+			if v, ok := keys["hosts"]; ok {
+				p.decode(v, &h.Hosts)
+				for j, host := range h.Hosts {
+					if _, err := path.Match(host, ""); err != nil || host == "" {
+						p.errorf(itemNode(v, j), "invalid host pattern %q", host)
+					}
+				}
+			}
+			if len(h.Hosts) == 0 {
+				p.errorf(value, "replay env for %s must list the hosts it may be sent to", header.Value)
+			}
+			r.Env[header.Value] = h
+		}
+	} else if ok {
+		p.errorf(n, "replay env must be a mapping of header to {var, hosts}")
+	}
+	if n, ok := keys["regenerate_date"]; ok {
+		p.decode(n, &r.RegenerateDate)
+	}
+	if n, ok := keys["new_idempotency_key"]; ok {
+		p.decode(n, &r.NewIdempotencyKey)
+	}
+}
+
+func (p *rulesParser) parseLLM(node *yaml.Node, r *LLMRules) {
+	keys := p.mapping(node, "llm key", "hosts", "prices")
+	if n, ok := keys["hosts"]; ok {
+		p.decode(n, &r.Hosts)
+		for i, host := range r.Hosts {
+			if _, err := path.Match(host, ""); err != nil || host == "" {
+				p.errorf(itemNode(n, i), "invalid host pattern %q", host)
+			}
+		}
+	}
+	if n, ok := keys["prices"]; ok && n.Kind == yaml.MappingNode {
+		r.Prices = make(map[string]LLMPrice)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			model, value := n.Content[i], n.Content[i+1]
+			if _, err := path.Match(model.Value, ""); err != nil || model.Value == "" {
+				p.errorf(model, "invalid model pattern %q", model.Value)
+			}
+			keys := p.mapping(value, "price key", "input", "output")
+			var price LLMPrice
+			for name, target := range map[string]*float64{"input": &price.Input, "output": &price.Output} {
+				if v, ok := keys[name]; ok {
+					p.decode(v, target)
+					if *target < 0 {
+						p.errorf(v, "%s price must not be negative", name)
+					}
+				}
+			}
+			r.Prices[model.Value] = price
+		}
+	} else if ok {
+		p.errorf(n, "llm prices must be a mapping of model to {input, output}")
+	}
+}
+
+func (p *rulesParser) checkHeaderNames(node *yaml.Node, names []string) {
+	for i, name := range names {
+		if !validHeaderName(name) {
+			p.errorf(itemNode(node, i), "invalid header name %q", name)
+		}
+	}
+}
+
+// itemNode returns the i-th item of a sequence node, or the node itself
+func itemNode(node *yaml.Node, i int) *yaml.Node {
+	if node.Kind == yaml.SequenceNode && i < len(node.Content) {
+		return node.Content[i]
+	}
+	return node
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadRules reads and parses a rules file
+func LoadRules(path string) (*Rules, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to read rules file: %w", err)}
+	}
+	return ParseRules(path, data)
+}
+
+// RuleStore holds the active rules and swaps them atomically on reload
+type RuleStore struct {
+	path    string
+	current atomic.Pointer[Rules]
+}
+
+// NewRuleStore loads the rules file at path. An empty path uses the defaults.
+func NewRuleStore(path string) (*RuleStore, []error) {
+	s := &RuleStore{path: path}
+	if path == "" {
+		s.current.Store(defaultRules())
+		return s, nil
+	}
+	rules, errs := LoadRules(path)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	s.current.Store(rules)
+	return s, nil
+}
+
+// Get returns the active rules
+func (s *RuleStore) Get() *Rules {
+	return s.current.Load()
+}
+
+// Reload re-reads the rules file. On error the active rules are kept.
+func (s *RuleStore) Reload() []error {
+	if s.path == "" {
+		return nil
+	}
+	rules, errs := LoadRules(s.path)
+	if len(errs) > 0 {
+		return errs
+	}
+	s.current.Store(rules)
+	return nil
+}
+
+// reloadRules reloads the rules file and records the outcome as an event
+func reloadRules(rules *RuleStore, events *EventLog) {
+	if rules.path == "" {
+		fmt.Println("SIGHUP received but no -rules file is configured")
+		return
+	}
+
+	errs := rules.Reload()
+	if len(errs) == 0 {
+		fmt.Printf("Reloaded rules from %s\n", rules.path)
+		events.Emit("rules_reloaded", map[string]string{"file": rules.path})
+		return
+	}
+
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+		fmt.Printf("Rules reload failed: %v\n", err)
+	}
+	fmt.Println("Keeping previous rules")
+	events.Emit("rules_reload_failed", map[string]interface{}{"file": rules.path, "errors": msgs})
+}
+
+// redactHeaders returns the extra header names to redact, canonicalized
+func (r *Rules) redactHeaders() []string {
+	headers := make([]string, len(r.Redact.Headers))
+	for i, h := range r.Redact.Headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	return headers
+}
+
+// replayTransforms applies the replay section, if any, on top of the flag defaults
+func (r *Rules) replayTransforms(base ReplayTransforms) ReplayTransforms {
+	if r.Replay == nil {
+		return base
+	}
+	t := base
+	if r.Replay.Strip != nil {
+		t.Strip = r.Replay.Strip
+	}
+	if r.Replay.Env != nil {
+		t.EnvHeaders = make(map[string]EnvHeader, len(r.Replay.Env))
+		for header, h := range r.Replay.Env {
+			t.EnvHeaders[http.CanonicalHeaderKey(header)] = h
+		}
+	}
+	if r.Replay.RegenerateDate != nil {
+		t.RegenerateDate = *r.Replay.RegenerateDate
+	}
+	if r.Replay.NewIdempotencyKey != nil {
+		t.NewIdempotency = *r.Replay.NewIdempotencyKey
+	}
+	return t
+}
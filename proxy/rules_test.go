@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ruleErrors parses a rules file and returns its errors as strings
+func ruleErrors(t *testing.T, data string) []string {
+	t.Helper()
+	rules, errs := ParseRules("rules.yaml", []byte(data))
+	if (rules == nil) != (len(errs) > 0) {
+		t.Fatalf("got rules %v with errors %v", rules != nil, errs)
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+func TestParseRulesCollectsEveryError(t *testing.T) {
+	// One of each kind of mistake, none of which stops the parse
+	data := `version: 1
+redact:
+  headers: [X-Ok, "Bad Header"]
+capture:
+  body_methods: [POST, get]
+  max_body_bytes: -1
+  max_query_bytes: lots
+replay:
+  strip: [Date]
+  env:
+    Authorization: {var: 1TOKEN}
+  regenerate_dates: true
+verify:
+  targets:
+    - host: "[bad"
+      path: relative
+    - path: /no/host
+  on_mismatch: ignore
+llm:
+  prices:
+    "gpt-*": {input: -1, output: 2}
+policy:
+  mode: audit
+  allow:
+    - methods: [GET]
+`
+	want := []string{
+		`rules.yaml:3:19: invalid header name "Bad Header"`,
+		`rules.yaml:5:24: method "get" must be an upper-case HTTP method`,
+		`rules.yaml:6:19: max_body_bytes must be positive`,
+		"rules.yaml:7:20: cannot unmarshal !!str `lots` into int",
+		`rules.yaml:12:3: unknown replay key "regenerate_dates" (expected one of: strip, env, regenerate_date, new_idempotency_key)`,
+		`rules.yaml:11:26: invalid environment variable name "1TOKEN"`,
+		`rules.yaml:11:20: replay env for Authorization must list the hosts it may be sent to`,
+		`rules.yaml:15:13: invalid host pattern "[bad"`,
+		`rules.yaml:16:13: invalid path pattern "relative" (must start with /)`,
+		`rules.yaml:17:7: target is missing host`,
+		`rules.yaml:18:16: on_mismatch must be flag or block, not "ignore"`,
+		`rules.yaml:21:22: input price must not be negative`,
+		`rules.yaml:23:9: mode must be monitor or enforce, not "audit"`,
+		`rules.yaml:25:7: allow rule is missing host`,
+	}
+	if got := ruleErrors(t, data); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestParseRulesStructure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"valid", "version: 1\n", nil},
+		{"empty", "", []string{"rules.yaml: file is empty"}},
+		{"not yaml", "version: [1\n", []string{"rules.yaml: yaml: line 1: did not find expected ',' or ']'"}},
+		{"not a mapping", "- version: 1\n", []string{"rules.yaml:1:1: section must be a mapping"}},
+		{"missing version", "redact:\n  headers: [X-Key]\n", []string{"rules.yaml:1:1: missing version (current version is 1)"}},
+		{"future version", "version: 2\n", []string{"rules.yaml:1:10: unsupported version 2 (current version is 1)"}},
+		{"old version", "version: 0\n", []string{"rules.yaml:1:10: unsupported version 0 (current version is 1)"}},
+		{"version not a number", "version: one\n", []string{"rules.yaml:1:10: cannot unmarshal !!str `one` into int"}},
+		{"unknown section", "version: 1\nredaction:\n  headers: [X-Key]\n", []string{
+			`rules.yaml:2:1: unknown section "redaction" (expected one of: version, redact, capture, replay, verify, llm, policy)`,
+		}},
+		{"every unknown section", "version: 1\nfoo: 1\nbar: 2\n", []string{
+			`rules.yaml:2:1: unknown section "foo" (expected one of: version, redact, capture, replay, verify, llm, policy)`,
+			`rules.yaml:3:1: unknown section "bar" (expected one of: version, redact, capture, replay, verify, llm, policy)`,
+		}},
+		{"unknown key in a section", "version: 1\ncapture:\n  max_bytes: 10\n", []string{
+			`rules.yaml:3:3: unknown capture key "max_bytes" (expected one of: body_methods, max_body_bytes, max_query_bytes)`,
+		}},
+		{"section not a mapping", "version: 1\nredact: [X-Key]\n", []string{"rules.yaml:2:9: redact key must be a mapping"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ruleErrors(t, tc.data)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got errors\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(tc.want, "\n\t"))
+			}
+		})
+	}
+
+	// Positioned errors carry their line and column
+	_, errs := ParseRules("rules.yaml", []byte("version: 1\ncapture:\n  max_body_bytes: 0\n"))
+	var cerr *ConfigError
+	if len(errs) != 1 || !errors.As(errs[0], &cerr) || cerr.Line != 3 || cerr.Column != 19 {
+		t.Errorf("got %v, want a ConfigError at 3:19", errs)
+	}
+}
+
+// validateConfig runs "proxy validate-config" and returns its exit code and
+// what it printed to stderr
+func validateConfig(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	code := runValidateConfig(args)
+	os.Stderr = saved
+
+	out, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(out)
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(valid, []byte("version: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invalid, []byte("version: 2\nfoo: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, out := validateConfig(t, "-rules="+valid); code != 0 || out != "" {
+		t.Errorf("valid rules: exit %d, stderr %q", code, out)
+	}
+	if code, out := validateConfig(t); code != 0 || out != "" {
+		t.Errorf("no rules: exit %d, stderr %q", code, out)
+	}
+
+	// Every error is listed, from the flags and the rules file alike
+	code, out := validateConfig(t, "-rules="+invalid, "-slow-client-factor=-1")
+	if code != 1 {
+		t.Errorf("invalid rules: exit %d, want 1", code)
+	}
+	for _, want := range []string{
+		invalid + ":1:10: unsupported version 2",
+		invalid + `:2:1: unknown section "foo"`,
+		"-slow-client-factor",
+		"3 error(s) found",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stderr doesn't mention %q:\n%s", want, out)
+		}
+	}
+
+	if code, out := validateConfig(t, "-rules="+filepath.Join(dir, "missing.yaml")); code != 1 || !strings.Contains(out, "failed to read rules file") {
+		t.Errorf("missing rules file: exit %d, stderr %q", code, out)
+	}
+	if code, _ := validateConfig(t, "-no-such-flag"); code != 2 {
+		t.Errorf("unknown flag: exit %d, want 2", code)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSavedFilters caps how many filters one token (or the shared set) can store
+const maxSavedFilters = 100
+
+var validFilterName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var (
+	errFilterInvalid   = errors.New("invalid filter")
+	errFilterExists    = errors.New("filter already exists")
+	errFilterNotFound  = errors.New("no saved filter")
+	errFilterForbidden = errors.New("shared filters can only be changed with the admin token")
+)
+
+// SavedFilter is a named filter expression. Personal filters belong to the
+// token that created them; shared ones are visible to every token.
+type SavedFilter struct {
+	Name       string    `json:"name"`
+	Expression string    `json:"expression"`
+	Shared     bool      `json:"shared,omitempty"`
+	Alert      bool      `json:"alert,omitempty"` // emit filter_match events for matching responses
+	Owner      string    `json:"owner,omitempty"` // fingerprint of the creating token
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	filter *Filter
+}
+
+// FilterMatch is the data of a filter_match event
+type FilterMatch struct {
+	Filter string `json:"filter"`
+	Shared bool   `json:"shared,omitempty"`
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FilterStore persists saved filters in the logs dir
+type FilterStore struct {
+	path     string
+	readOnly bool // the logs directory can't be written; keep filters in memory
+	events   *EventLog
+	mu       sync.Mutex
+	filters  []*SavedFilter
+}
+
+// tokenFingerprint identifies a token without storing it
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// NewFilterStore loads saved filters from the logs directory
+func NewFilterStore(logsDir string, readOnly bool, events *EventLog) (*FilterStore, error) {
+	s := &FilterStore{
+		path:     filepath.Join(logsDir, "filters.json"),
+		readOnly: readOnly,
+		events:   events,
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read saved filters: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.filters); err != nil {
+		return nil, fmt.Errorf("failed to parse saved filters: %w", err)
+	}
+	for _, f := range s.filters {
+		if f.filter, err = ParseFilter(f.Expression); err != nil {
+			fmt.Printf("Warning: saved filter %q no longer parses and won't match anything: %v\n", f.Name, err)
+		}
+	}
+	return s, nil
+}
+
+// find returns the index of the named filter in the personal (owner) or
+// shared set. Callers must hold s.mu.
+func (s *FilterStore) find(owner, name string, shared bool) int {
+	for i, f := range s.filters {
+		if f.Name == name && f.Shared == shared && (shared || f.Owner == owner) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Visible returns the caller's own filters and the shared ones, by name
+func (s *FilterStore) Visible(owner string) []SavedFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []SavedFilter{}
+	for _, f := range s.filters {
+		if f.Shared || f.Owner == owner {
+			result = append(result, *f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return !result[i].Shared // personal first
+	})
+	return result
+}
+
+// Get returns one filter from the personal or shared set
+func (s *FilterStore) Get(owner, name string, shared bool) (SavedFilter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.find(owner, name, shared); i >= 0 {
+		return *s.filters[i], true
+	}
+	return SavedFilter{}, false
+}
+
+// Lookup resolves a filter name for the caller, preferring their own
+// filter over a shared one with the same name
+func (s *FilterStore) Lookup(owner, name string) (*Filter, error) {
+	f, ok := s.Get(owner, name, false)
+	if !ok {
+		f, ok = s.Get(owner, name, true)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w named %q", errFilterNotFound, name)
+	}
+	if f.filter == nil {
+		return nil, fmt.Errorf("%w: saved filter %q no longer parses", errFilterInvalid, name)
+	}
+	return f.filter, nil
+}
+
+// Put validates and stores a filter. With create set, an existing filter
+// of the same name is an error rather than replaced.
+func (s *FilterStore) Put(owner string, admin bool, f SavedFilter, create bool) (SavedFilter, error) {
+	if !validFilterName.MatchString(f.Name) {
+		return SavedFilter{}, fmt.Errorf("%w: name %q must be 1-64 lower-case letters, digits, '-' or '_'", errFilterInvalid, f.Name)
+	}
+	parsed, err := ParseFilter(f.Expression)
+	if err != nil {
+		return SavedFilter{}, fmt.Errorf("%w: %v", errFilterInvalid, err)
+	}
+	if f.Shared && !admin {
+		return SavedFilter{}, errFilterForbidden
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	f.filter = parsed
+	f.Owner = owner
+	if f.Shared {
+		f.Owner = ""
+	}
+	f.CreatedAt = now
+	f.UpdatedAt = now
+
+	prev := append([]*SavedFilter(nil), s.filters...)
+	if i := s.find(owner, f.Name, f.Shared); i >= 0 {
+		if create {
+			return SavedFilter{}, fmt.Errorf("%w: %q", errFilterExists, f.Name)
+		}
+		f.CreatedAt = s.filters[i].CreatedAt
+		s.filters[i] = &f
+	} else {
+		count := 0
+		for _, existing := range s.filters {
+			if existing.Shared == f.Shared && existing.Owner == f.Owner {
+				count++
+			}
+		}
+		if count >= maxSavedFilters {
+			return SavedFilter{}, fmt.Errorf("%w: at most %d filters can be saved", errFilterInvalid, maxSavedFilters)
+		}
+		s.filters = append(s.filters, &f)
+	}
+
+	if err := s.save(); err != nil {
+		s.filters = prev // keep memory consistent with what's on disk
+		return SavedFilter{}, err
+	}
+	return f, nil
+}
+
+// Delete removes a filter from the personal or shared set
+func (s *FilterStore) Delete(owner string, admin bool, name string, shared bool) error {
+	if shared && !admin {
+		return errFilterForbidden
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(owner, name, shared)
+	if i < 0 {
+		return fmt.Errorf("%w named %q", errFilterNotFound, name)
+	}
+	prev := append([]*SavedFilter(nil), s.filters...)
+	s.filters = append(s.filters[:i:i], s.filters[i+1:]...)
+	if err := s.save(); err != nil {
+		s.filters = prev
+		return err
+	}
+	return nil
+}
+
+// save writes the filters to disk. Callers must hold s.mu.
+func (s *FilterStore) save() error {
+	data, err := json.MarshalIndent(s.filters, "", "  ")
+	if err == nil && !s.readOnly {
+		err = writeFileAtomic(s.path, data, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save filters: %w", err)
+	}
+	return nil
+}
+
+// Alerting reports whether any filter has alerts enabled, so callers can
+// skip looking up entries when none do
+func (s *FilterStore) Alerting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.filters {
+		if f.Alert && f.filter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert emits a filter_match event for each alerting filter the entry matches
+func (s *FilterStore) Alert(entry RequestLog) {
+	s.mu.Lock()
+	var matched []*SavedFilter
+	for _, f := range s.filters {
+		if f.Alert && f.filter != nil && f.filter.Match(&entry) {
+			matched = append(matched, f)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, f := range matched {
+		s.events.Emit("filter_match", FilterMatch{
+			Filter: f.Name,
+			Shared: f.Shared,
+			ID:     entry.ID,
+			Method: entry.Method,
+			Domain: entry.Domain,
+			Path:   entry.Path,
+			Status: entry.ResponseStatus,
+			Error:  entry.Error,
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/apart-work-test/proxy/version"
+)
+
+// apiSchemaVersion is bumped whenever the API contract changes incompatibly.
+// The UI embeds the version it was written against and warns on mismatch.
+const apiSchemaVersion = 1
+
+// apiRoute describes one API endpoint; the same table registers the
+// handlers and is served by /api/schema
+type apiRoute struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	handler     http.HandlerFunc
+}
+
+func (w *WebServer) apiRoutes() []apiRoute {
+	return []apiRoute{
+		{"/api/requests", []string{"GET"}, "List logged requests, newest first (filtered by ?q=, ?filter_name= and per-field parameters)", w.handleRequests},
+		{"/api/requests/{id}", []string{"GET"}, "Get one request, including its decision trace", w.handleRequestDetail},
+		{"/api/requests/{id}/replay", []string{"POST"}, "Replay a request through the upstream transport", nil}, // served by handleRequestDetail
+		{"/api/compose", []string{"POST"}, "Send a request built from a template with {{variables}}", w.handleCompose},
+		{"/api/filter/validate", []string{"GET"}, "Parse the filter expression in ?q= and return its tree or error position", w.handleFilterValidate},
+		{"/api/filters", []string{"GET", "POST"}, "List or create saved filters", w.handleFilters},
+		{"/api/filters/{name}", []string{"GET", "PUT", "DELETE"}, "Get, replace or delete a saved filter (?shared=true for a shared one)", w.handleFilterDetail},
+		{"/api/pcap/{file}", []string{"GET"}, "Download a PCAP file", w.handlePcapDownload},
+		{"/api/pcap-list", []string{"GET"}, "List PCAP files", w.handlePcapList},
+		{"/api/stats", []string{"GET"}, "Per-domain request counts and timing (filters as for /api/requests)", w.handleStats},
+		{"/api/hosts/{domain}/capabilities", []string{"GET"}, "Allowed methods, CORS policy and rate limits a host has advertised", w.handleHostCapabilities},
+		{"/api/hosts/{domain}/certificates", []string{"GET"}, "Upstream certificates that served a host, with SANs and provider", nil}, // served by handleHostCapabilities
+		{"/api/capture-budget", []string{"GET"}, "Memory used by capture buffers and how many captures were skipped", w.handleCaptureBudget},
+		{"/api/budget", []string{"GET"}, "Estimated LLM spend, remaining budget and spend per model", w.handleLLMBudget},
+		{"/api/budget/reset", []string{"POST"}, "Reset LLM spend (?scope=run or total; admin token required if configured, otherwise loopback only)", w.handleLLMBudgetReset},
+		{"/api/policy/suggest", []string{"GET"}, "Rules file with a policy allowing the logged traffic (?diff=true compares it with the loaded policy)", w.handlePolicySuggest},
+		{"/api/stream", []string{"GET"}, "Server-sent event per completed request once it's enriched (filters as for /api/requests)", w.handleStream},
+		{"/api/enrichment", []string{"GET"}, "Enrichment queue depth, dropped entries and per-enricher timing", w.handleEnrichment},
+		{"/api/events", []string{"GET"}, "Recent proxy events (shutdown, rate_limit_low, ...)", w.handleEvents},
+		{"/api/inflight", []string{"GET"}, "Requests whose response hasn't been fully relayed to the client yet, oldest first", w.handleInFlight},
+		{"/api/preferences", []string{"GET", "PUT"}, "Get or replace stored UI preferences", w.handlePreferences},
+		{"/api/version", []string{"GET"}, "Build and environment fingerprint", w.handleVersion},
+		{"/api/health", []string{"GET"}, "Liveness check (no token required)", w.handleHealth},
+		{"/api/schema", []string{"GET"}, "This description of the API", w.handleSchema},
+	}
+}
+
+// muxPattern converts a documented path like /api/requests/{id} to the
+// prefix pattern the handler is registered under
+func (r apiRoute) muxPattern() string {
+	if i := strings.Index(r.Path, "{"); i >= 0 {
+		return r.Path[:i]
+	}
+	return r.Path
+}
+
+// schemaField describes one RequestLog JSON field
+type schemaField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional"`
+}
+
+// apiSchema is the response of /api/schema
+type apiSchema struct {
+	SchemaVersion int             `json:"schema_version"`
+	Build         version.Info    `json:"build"`
+	Endpoints     []apiRoute      `json:"endpoints"`
+	RequestFields []schemaField   `json:"request_fields"`
+	Features      map[string]bool `json:"features"`
+}
+
+func (w *WebServer) handleSchema(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	schema := apiSchema{
+		SchemaVersion: apiSchemaVersion,
+		Build:         version.Get(),
+		Endpoints:     w.apiRoutes(),
+		RequestFields: describeFields(reflect.TypeOf(RequestLog{})),
+		Features:      w.features(),
+	}
+
+	if err := json.NewEncoder(rw).Encode(schema); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// describeFields lists the JSON fields of a struct type
+func describeFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, schemaField{
+			Name:     name,
+			Type:     jsonType(f.Type),
+			Optional: strings.Contains(opts, "omitempty"),
+		})
+	}
+	return fields
+}
+
+// jsonType maps a Go type to the JSON type it encodes as
+func jsonType(t reflect.Type) string {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return "any"
+	}
+	if t.PkgPath() == "time" && t.Name() == "Time" {
+		return "string (RFC 3339)"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonType(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array of " + jsonType(t.Elem())
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// schemeRoute is how the proxy handles a request's URL scheme
+type schemeRoute int
+
+const (
+	routeHTTP        schemeRoute = iota // forwarded upstream
+	routeWebSocket                      // ws:// and wss:// absolute-form requests, relayed as upgrades
+	routeUnsupported                    // answered with 501
+)
+
+// routeForScheme picks the route for an absolute-form request's scheme.
+// url.Parse lower-cases schemes, so no folding is needed.
+func routeForScheme(scheme string) schemeRoute {
+	switch scheme {
+	case "http", "https":
+		return routeHTTP
+	case "ws", "wss":
+		return routeWebSocket
+	default:
+		return routeUnsupported
+	}
+}
+
+// upgradeScheme is the scheme a ws:// or wss:// request is sent upstream with
+func upgradeScheme(scheme string) string {
+	if scheme == "wss" {
+		return "https"
+	}
+	return "http"
+}
+
+// unsupportedScheme answers a request whose scheme the proxy can't forward
+func unsupportedScheme(req *http.Request, reason string) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotImplemented,
+		fmt.Sprintf("%s\n", reason))
+}
+
+// schemeError explains why a request on route can't be forwarded
+func schemeError(route schemeRoute, scheme string) string {
+	if route == routeWebSocket {
+		return fmt.Sprintf("scheme %q is only supported for upgrade requests (Connection: upgrade, Upgrade: websocket)", scheme)
+	}
+	return fmt.Sprintf("scheme %q is not supported by this proxy; only http and https are forwarded", scheme)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Server is the proxy and its web UI, built from a validated Config.
+// main runs one until it's signalled; embedding it runs the proxy in
+// process, e.g. on ephemeral ports ("127.0.0.1:0") whose addresses
+// ProxyAddr and WebAddr report. Servers share no state, so several can run
+// side by side with their own logs directories.
+type Server struct {
+	cfg      *Config
+	ca       *CAConfig
+	rules    *RuleStore
+	events   *EventLog
+	logger   *Logger
+	pipeline *EnrichPipeline
+	inflight *InFlight
+
+	proxyServer   *http.Server
+	webServer     *http.Server
+	proxyListener net.Listener
+	webListener   net.Listener
+	closers       []func() error // in the order they were opened
+}
+
+// NewServer sets up everything the proxy needs and binds its listeners,
+// but doesn't serve until Serve is called
+func NewServer(cfg *Config) (_ *Server, err error) {
+	s := &Server{cfg: cfg}
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+
+	tracing := &TraceConfig{Always: cfg.DebugTrace, Clients: cfg.traceClients}
+
+	rules, ruleErrs := NewRuleStore(cfg.RulesFile)
+	if len(ruleErrs) > 0 {
+		for _, err := range ruleErrs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return nil, fmt.Errorf("invalid rules file (%d errors)", len(ruleErrs))
+	}
+
+	// Ensure logs directory exists and is writable, or run without persistence
+	var degraded []string // reported by /api/health
+	readOnly := false     // nothing is written to the logs directory
+	if err := checkLogsDir(cfg.LogsDir); err != nil {
+		if !cfg.AllowReadonlyLogs {
+			return nil, fmt.Errorf("%w; pass -allow-readonly-logs to run without persistence", err)
+		}
+		readOnly = true
+		degraded = append(degraded, "persistence disabled: "+err.Error())
+		fmt.Printf("Warning: %v\n", err)
+		fmt.Println("Warning: -allow-readonly-logs: running without persistence; requests, events and state are kept in memory and lost on exit")
+	}
+
+	// Load or create CA
+	ca, err := LoadOrCreateCA(cfg.LogsDir, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load/create CA: %w", err)
+	}
+	if ca.Ephemeral {
+		// Nothing else can pick the CA up from the logs directory
+		degraded = append(degraded, "CA certificate generated in memory; clients must be given it out-of-band")
+		fmt.Printf("Warning: generated a CA certificate in memory; it isn't saved to %s and is replaced on every restart, so its trust must be distributed to clients out-of-band:\n%s", cfg.LogsDir, ca.CertPEM)
+	}
+	fmt.Println("CA certificate ready")
+
+	// Record the environment this run is captured in
+	fingerprint := CaptureFingerprint(cfg, ca)
+	if err := SaveFingerprint(cfg.LogsDir, readOnly, fingerprint); err != nil {
+		fmt.Printf("Warning: failed to save environment fingerprint: %v\n", err)
+	}
+	fmt.Printf("Proxy version %s\n", fingerprint.Build)
+
+	events, err := NewEventLog(cfg.LogsDir, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event log: %w", err)
+	}
+	s.closers = append(s.closers, events.Close)
+
+	// Estimated LLM spend, charged as responses are logged
+	llm, err := NewLLMBudget(cfg.LogsDir, readOnly, cfg.llmLimits, cfg.LLMBudgetWarn, cfg.LLMBudgetEnforce, cfg.LLMUnknownCost, events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load LLM budget: %w", err)
+	}
+	if cfg.LLMBudget != "" {
+		fmt.Printf("LLM budget: %s (enforced: %v)\n", cfg.LLMBudget, cfg.LLMBudgetEnforce)
+	}
+
+	// Create logger
+	budget := cfg.captureBudget()
+	usage := budget.Usage()
+	fmt.Printf("Capture budget: %d bytes (%s)\n", usage.LimitBytes, usage.Source)
+	logger, err := NewLogger(cfg.LogsDir, readOnly, cfg.SlowClientFactor, rules, budget, llm, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create logger: %w", err)
+	}
+	s.closers = append(s.closers, logger.Close)
+	stopCheckpoints, checkpointed := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(checkpointed)
+		logger.CheckpointCounters(cfg.StatsCheckpoint, stopCheckpoints)
+	}()
+	s.closers = append(s.closers, func() error {
+		close(stopCheckpoints)
+		<-checkpointed
+		return nil
+	})
+
+	if cfg.Webhook != "" {
+		webhook := NewWebhook(cfg.Webhook, splitList(cfg.WebhookEvents))
+		events.Subscribe(webhook.Notify)
+	}
+
+	// Per-host capability inventory, seeded from the entries already logged
+	caps := NewCapabilities(events, cfg.RateLimitLow)
+	caps.Rebuild(logger.GetRequests())
+
+	certs, err := NewCertInventory(cfg.LogsDir, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate inventory: %w", err)
+	}
+
+	// Saved filters; those marked for alerts are checked against each response
+	filters, err := NewFilterStore(cfg.LogsDir, readOnly, events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saved filters: %w", err)
+	}
+
+	// Completed entries are enriched off the request path, then streamed.
+	// LLM spend is charged inline instead: budgets can't lose a call to a
+	// full queue.
+	pipeline := NewEnrichPipeline(logger, cfg.EnrichWorkers, cfg.EnrichQueue)
+	forwarded := func(e *RequestLog, done Completion) bool {
+		return done.Header != nil && !strings.HasPrefix(e.Error, "unsupported_scheme")
+	}
+	pipeline.Register(Enricher{Name: "capabilities", Priority: 10, Enrich: func(e *RequestLog, done Completion) bool {
+		if forwarded(e, done) {
+			caps.Observe(e.Domain, e.Path, done.Header)
+		}
+		return false
+	}})
+	pipeline.Register(Enricher{Name: "certificates", Priority: 10, Enrich: func(e *RequestLog, done Completion) bool {
+		if forwarded(e, done) {
+			certs.Observe(e.Domain, done.TLS)
+		}
+		return false
+	}})
+	pipeline.Register(Enricher{Name: "secrets", Priority: 20, Enrich: func(e *RequestLog, done Completion) bool {
+		secret := findSecret(*e)
+		changed := secret != e.Secret
+		e.Secret = secret
+		return changed
+	}})
+	// Last, so alert filters can match what the other enrichers found
+	pipeline.Register(Enricher{Name: "filter_alerts", Priority: 100, Enrich: func(e *RequestLog, done Completion) bool {
+		if filters.Alerting() {
+			filters.Alert(*e)
+		}
+		return false
+	}})
+	pipeline.Start()
+	s.closers = append(s.closers, func() error {
+		pipeline.Close(context.Background())
+		return nil
+	})
+
+	inflight := NewInFlight()
+	gate := NewGate(rules, llm)
+
+	// Create proxy
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Verbose = false
+
+	// Set up MITM for HTTPS
+	tlsCert, err := tls.X509KeyPair(ca.CertPEM, ca.KeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS cert: %w", err)
+	}
+
+	// Clients that reject the MITM certificate only show up in goproxy's
+	// log; the monitor records them as entries
+	handshakes := NewHandshakeMonitor(proxy.Logger, logger, pipeline, events, cfg.HandshakeHint)
+	proxy.Logger = handshakes
+	mitmTLS := handshakes.TLSConfig(goproxy.TLSConfigFromCA(&tlsCert))
+
+	// Handle CONNECT requests (HTTPS) by MITM'ing them with this server's
+	// CA, rather than through goproxy's global ConnectActions, which every
+	// Server in the process would share
+	mitm := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: mitmTLS}
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	}))
+
+	// Requests that fail upstream never reach the response handler on the
+	// MITM path, so record the failure here; otherwise they'd stay pending
+	upstream := goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		// goproxy drops hop-by-hop headers; an upgrade being relayed needs
+		// Connection back for the transport and origin to switch protocols
+		if upgradeWriterFor(req) != nil && req.Header.Get("Upgrade") != "" {
+			req.Header.Set("Connection", "Upgrade")
+		}
+		resp, err := proxy.Tr.RoundTrip(req)
+		if err != nil {
+			if requestID, ok := ctx.UserData.(string); ok {
+				logger.LogError(requestID, "upstream_error: "+err.Error())
+				inflight.Done(requestID)
+				pipeline.Submit(requestID, nil)
+			}
+		}
+		return resp, err
+	})
+
+	// Log all requests
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		trace := tracing.Start(req)
+		route := routeForScheme(req.URL.Scheme)
+		protocol := upgradeProtocol(req.Header)
+		if route == routeWebSocket && protocol == "" {
+			route = routeUnsupported
+		}
+		if route == routeUnsupported {
+			trace.Add("scheme", req.URL.Scheme, true, "rejected")
+		}
+
+		// Upgrades are relayed when the proxy owns the client connection,
+		// i.e. for absolute-form requests; refused ones go out as HTTP/1.1
+		relay := upgradeWriterFor(req)
+		var refused string
+		if protocol != "" {
+			refused = refuseUpgrade(req.Header, relay != nil)
+			if refused != "" {
+				trace.Add("upgrade", protocol, false, refused)
+			} else {
+				trace.Add("upgrade", protocol, true, "relayed")
+			}
+		}
+
+		var decision GateDecision
+		if route != routeUnsupported {
+			decision = gate.Check(req, trace)
+		}
+
+		injected := cfg.GenerateTrace && route != routeUnsupported && injectTraceparent(req)
+		entry := logger.LogRequest(req, LogOptions{Trace: trace, RefuseUpgrade: refused, TraceInjected: injected, Policy: decision.Policy})
+		ctx.UserData = entry.ID // Store request ID for response handler
+		fmt.Printf("[%s] %s %s%s\n", entry.ID, req.Method, req.Host, req.URL.Path)
+
+		// Absolute-form requests (ftp://, ...) can't go through the HTTP
+		// transport; answer them here so they're logged with a reason
+		if route == routeUnsupported {
+			reason := schemeError(routeForScheme(req.URL.Scheme), req.URL.Scheme)
+			logger.LogError(entry.ID, "unsupported_scheme: "+req.URL.Scheme)
+			fmt.Printf("[%s] %s\n", entry.ID, reason)
+			return req, unsupportedScheme(req, reason)
+		}
+		if resp := decision.Refuse(logger, entry.ID, req); resp != nil {
+			return req, resp
+		}
+		if route == routeWebSocket {
+			req.URL.Scheme = upgradeScheme(req.URL.Scheme)
+		}
+
+		switch {
+		case refused != "":
+			stripUpgrade(req)
+			fmt.Printf("[%s] %s\n", entry.ID, refused)
+		case relay != nil:
+			// Hide the upgrade from goproxy's own WebSocket handling, which
+			// doesn't log the connection; the upstream transport restores it
+			req.Header.Del("Connection")
+		}
+
+		ctx.RoundTripper = upstream
+		inflight.Add(entry.ID, entry.Domain)
+		return req, nil
+	})
+
+	// Log all responses
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if requestID, ok := ctx.UserData.(string); ok {
+			logger.LogResponse(requestID, resp)
+			if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+				if relay := upgradeWriterFor(ctx.Req); relay != nil {
+					resp = relaySwitch(relay, resp, ctx.Req, requestID, logger)
+				}
+			}
+			if resp != nil && ctx.Req.URL.Scheme == "http" {
+				if _, ok := resp.Body.(*verifyBody); ok {
+					resp.Body = abortOnBlock{resp.Body}
+				}
+			}
+			// The request stays in flight until its body has been relayed;
+			// goproxy closes the body whether or not the client took it all.
+			// Only then is the entry complete, with its content check and
+			// delivery recorded, and handed to the enrichers.
+			switch {
+			case resp != nil && resp.Body != nil:
+				completed := resp
+				resp.Body = inflight.DoneOnClose(requestID, resp.Body, func() { pipeline.Submit(requestID, completed) })
+			case resp != nil:
+				pipeline.Submit(requestID, resp)
+				inflight.Done(requestID)
+			default:
+				inflight.Done(requestID)
+			}
+		}
+		return resp
+	})
+
+	// Load persisted UI preferences
+	prefs, err := NewPreferencesStore(cfg.LogsDir, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load preferences: %w", err)
+	}
+
+	// Bind the listeners now, so ephemeral ports are known to the composer
+	if s.proxyListener, err = net.Listen("tcp", cfg.ProxyAddr); err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.ProxyAddr, err)
+	}
+	s.closers = append(s.closers, s.proxyListener.Close)
+	if s.webListener, err = net.Listen("tcp", cfg.WebAddr); err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.WebAddr, err)
+	}
+	s.closers = append(s.closers, s.webListener.Close)
+
+	// Replays and composed requests pass the same gate, go out through the
+	// same upstream transport and are enriched like proxied traffic
+	replayer := NewReplayer(logger, gate, tracing, pipeline, proxy.Tr, cfg.replayTransforms(), rules)
+	composer := NewComposer(logger, gate, tracing, pipeline, proxy.Tr, cfg.replayTransforms(), rules, s.ProxyAddr(), s.WebAddr())
+
+	// What the rules file turns on follows reloads
+	features := func() map[string]bool {
+		current := rules.Get()
+		return map[string]bool{
+			"debug_trace":          tracing.Always || len(tracing.Clients) > 0,
+			"replay":               true,
+			"compose":              true,
+			"llm_budget":           len(cfg.llmLimits) > 0,
+			"llm_budget_enforce":   len(cfg.llmLimits) > 0 && cfg.LLMBudgetEnforce,
+			"policy":               current.Policy != nil,
+			"policy_enforce":       current.Policy != nil && current.Policy.Mode == "enforce",
+			"verify":               len(current.Verify.Targets) > 0,
+			"generate_traceparent": cfg.GenerateTrace,
+			"readonly_logs":        readOnly,
+			"web_tokens":           cfg.WebToken != "" || cfg.WebAdminToken != "",
+			"webhook":              cfg.Webhook != "",
+		}
+	}
+	webServer := NewWebServer(logger, prefs, replayer, composer, events, caps, certs, handshakes, filters, pipeline, inflight, fingerprint, features, degraded, cfg.LogsDir,
+		cfg.WebToken, cfg.WebAdminToken)
+
+	handler, err := webServer.Handler()
+	if err != nil {
+		return nil, err
+	}
+
+	s.ca, s.rules, s.events, s.logger, s.pipeline, s.inflight = ca, rules, events, logger, pipeline, inflight
+	s.proxyServer = &http.Server{Handler: handleUpgrades(proxy), MaxHeaderBytes: cfg.MaxHeaderBytes}
+	s.webServer = &http.Server{Handler: handler}
+	return s, nil
+}
+
+// ProxyAddr is the address the proxy listens on
+func (s *Server) ProxyAddr() string {
+	return s.proxyListener.Addr().String()
+}
+
+// WebAddr is the address the web UI and API listen on
+func (s *Server) WebAddr() string {
+	return s.webListener.Addr().String()
+}
+
+// browseAddr is how to reach a listener from this machine
+func browseAddr(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		return net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+	}
+	return addr.String()
+}
+
+// CACert is the PEM-encoded CA certificate clients must trust for
+// MITM'd HTTPS
+func (s *Server) CACert() []byte {
+	return s.ca.CertPEM
+}
+
+// Logger is the request log, for reading back what the proxy recorded
+func (s *Server) Logger() *Logger {
+	return s.logger
+}
+
+// Serve serves the proxy and the web UI until either fails or Shutdown is
+// called, when it returns http.ErrServerClosed
+func (s *Server) Serve() error {
+	webErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Web UI available at http://%s\n", browseAddr(s.webListener.Addr()))
+		webErr <- s.webServer.Serve(s.webListener)
+	}()
+
+	proxyErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Proxy listening on %s\n", s.ProxyAddr())
+		proxyErr <- s.proxyServer.Serve(s.proxyListener)
+	}()
+
+	select {
+	case err := <-proxyErr:
+		return err
+	case err := <-webErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return <-proxyErr
+		}
+		return fmt.Errorf("web server failed: %w", err)
+	}
+}
+
+// ReloadRules rereads the rules file, keeping the current rules if it's invalid
+func (s *Server) ReloadRules() {
+	reloadRules(s.rules, s.events)
+}
+
+// Shutdown drains in-flight requests for up to grace (see
+// drainAndShutdown), stops the web UI and closes the logs
+func (s *Server) Shutdown(grace time.Duration) ShutdownSummary {
+	fmt.Printf("Shutting down, waiting up to %s for %d in-flight requests...\n", grace, s.inflight.Len())
+	summary := drainAndShutdown(s.proxyServer, s.inflight, s.logger, s.pipeline, s.events, grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.webServer.Shutdown(ctx); err != nil {
+		s.webServer.Close()
+	}
+	s.close()
+	return summary
+}
+
+// close releases what NewServer opened, most recent first
+func (s *Server) close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestServersRunSideBySide(t *testing.T) {
+	origin := newOrigin(t, false)
+	// Let the origin's and earlier tests' goroutines settle before counting
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	a := newServer(t, t.TempDir())
+	b := newServer(t, t.TempDir())
+	if bytes.Equal(a.CACert(), b.CACert()) {
+		t.Fatal("servers with their own logs directories share a CA")
+	}
+
+	// Each server MITMs with its own CA and logs only its own traffic
+	for _, s := range []*Server{a, b} {
+		client := proxiedClient(t, s)
+		resp, _ := fetch(t, client, newRequest(t, http.MethodGet, origin.URL+"/echo?from="+s.ProxyAddr(), ""))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request through %s: %d", s.ProxyAddr(), resp.StatusCode)
+		}
+		client.CloseIdleConnections()
+	}
+	for _, s := range []*Server{a, b} {
+		entry := waitForEntry(t, s, func(e RequestLog) bool { return e.Path == "/echo" && e.ResponseStatus == http.StatusOK })
+		if entry.Query != "from="+s.ProxyAddr() {
+			t.Errorf("%s logged %q, want its own request", s.ProxyAddr(), entry.Query)
+		}
+		if n := len(s.Logger().GetRequests()); n != 1 {
+			t.Errorf("%s logged %d entries, want 1", s.ProxyAddr(), n)
+		}
+	}
+
+	for _, s := range []*Server{a, b} {
+		if summary := s.Shutdown(time.Second); summary.Aborted != 0 {
+			t.Errorf("%s aborted %d requests on shutdown", s.ProxyAddr(), summary.Aborted)
+		}
+		for _, addr := range []string{s.ProxyAddr(), s.WebAddr()} {
+			if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+				conn.Close()
+				t.Errorf("%s still accepts connections after shutdown", addr)
+			}
+		}
+	}
+
+	// Workers, checkpointing and the listeners' goroutines are all gone
+	origin.CloseClientConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines left running after shutdown, %d before:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestSchemaReportsFeatures(t *testing.T) {
+	features := func(s *Server, header http.Header) map[string]bool {
+		t.Helper()
+		status, body := apiRequest(t, s, http.MethodGet, "/api/schema", "", header)
+		var schema apiSchema
+		if err := json.Unmarshal([]byte(body), &schema); status != http.StatusOK || err != nil {
+			t.Fatalf("GET /api/schema: %d %v", status, err)
+		}
+		return schema.Features
+	}
+
+	plain := features(startServer(t), nil)
+	for name, on := range plain {
+		if on != (name == "replay" || name == "compose") {
+			t.Errorf("%s is %v with no flags or rules", name, on)
+		}
+	}
+
+	rulesPath := writeRules(t, "version: 1\npolicy:\n  mode: enforce\n  allow:\n    - host: 127.0.0.1\nverify:\n  targets:\n    - host: 127.0.0.1\n")
+	s := startServerWithTokens(t, "token", "", "-rules="+rulesPath, "-llm-budget=run=1", "-llm-budget-enforce",
+		"-generate-traceparent", "-webhook=http://127.0.0.1:1/hook", "-debug-trace")
+	auth := http.Header{"Authorization": {"Bearer token"}}
+	configured := features(s, auth)
+	for _, name := range []string{"debug_trace", "llm_budget", "llm_budget_enforce", "policy", "policy_enforce", "verify", "generate_traceparent", "web_tokens", "webhook"} {
+		if !configured[name] {
+			t.Errorf("%s not reported as enabled: %v", name, configured)
+		}
+	}
+	if configured["readonly_logs"] {
+		t.Error("readonly_logs reported for a writable logs directory")
+	}
+
+	// Features from the rules file follow a reload
+	if err := os.WriteFile(rulesPath, []byte("version: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadRules()
+	reloaded := features(s, auth)
+	for _, name := range []string{"policy", "policy_enforce", "verify"} {
+		if reloaded[name] {
+			t.Errorf("%s still reported after the rules dropped it", name)
+		}
+	}
+	if !reloaded["llm_budget"] {
+		t.Error("llm_budget lost on a rules reload")
+	}
+}
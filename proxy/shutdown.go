@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShutdownSummary reports what happened to in-flight requests during shutdown
+type ShutdownSummary struct {
+	InFlight       int            `json:"in_flight"`
+	Completed      int            `json:"completed"`
+	Aborted        int            `json:"aborted"`
+	AbortedDomains map[string]int `json:"aborted_domains,omitempty"`
+	Unenriched     int            `json:"unenriched,omitempty"` // completed entries still waiting for enrichment when the grace period ran out
+}
+
+func (s ShutdownSummary) String() string {
+	msg := fmt.Sprintf("%d in flight, %d completed during draining, %d aborted", s.InFlight, s.Completed, s.Aborted)
+	if s.Unenriched > 0 {
+		msg += fmt.Sprintf(", %d left unenriched", s.Unenriched)
+	}
+	if len(s.AbortedDomains) == 0 {
+		return msg
+	}
+
+	domains := make([]string, 0, len(s.AbortedDomains))
+	for domain := range s.AbortedDomains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for i, domain := range domains {
+		domains[i] = fmt.Sprintf("%s=%d", domain, s.AbortedDomains[domain])
+	}
+	return msg + " (" + strings.Join(domains, ", ") + ")"
+}
+
+// drainAndShutdown stops the proxy from accepting connections, waits up to
+// grace for in-flight requests to finish, and marks the rest as aborted.
+// MITM'd connections are hijacked, so server.Shutdown doesn't wait for
+// them; the in-flight registry covers those. Whatever is left of grace then
+// goes to enriching the entries that completed.
+func drainAndShutdown(server *http.Server, inflight *InFlight, logger *Logger, pipeline *EnrichPipeline, events *EventLog, grace time.Duration) ShutdownSummary {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	summary := ShutdownSummary{InFlight: inflight.StartDraining()}
+
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+	}
+
+	completed, remaining := inflight.Wait(ctx)
+	summary.Completed = completed
+	summary.Aborted = len(remaining)
+
+	for _, entry := range remaining {
+		logger.LogError(entry.ID, "shutdown_aborted")
+		if summary.AbortedDomains == nil {
+			summary.AbortedDomains = make(map[string]int)
+		}
+		summary.AbortedDomains[entry.Domain]++
+	}
+	summary.Unenriched = pipeline.Close(ctx)
+
+	events.Emit("shutdown", summary)
+	return summary
+}
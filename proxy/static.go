@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticAssets serves the embedded UI. Assets are served under content-hashed
+// names with far-future caching, and index.html (never cached) references
+// them by those names, so an upgraded binary can't run against stale JS.
+type staticAssets struct {
+	fsys   fs.FS
+	hashed map[string]string // hashed name -> embedded file name
+	index  []byte            // index.html with asset references rewritten
+}
+
+func newStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	a := &staticAssets{
+		fsys:   fsys,
+		hashed: make(map[string]string),
+	}
+
+	index, err := fs.ReadFile(fsys, "index.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index.html: %w", err)
+	}
+
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || name == "index.html" {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		hashedName := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+		a.hashed[hashedName] = name
+
+		index = bytes.ReplaceAll(index, []byte(`"`+name+`"`), []byte(`"`+hashedName+`"`))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash static files: %w", err)
+	}
+
+	a.index = index
+	return a, nil
+}
+
+func (a *staticAssets) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+
+	if name == "" || name == "index.html" {
+		rw.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(rw, r, "index.html", time.Time{}, bytes.NewReader(a.index))
+		return
+	}
+
+	if orig, ok := a.hashed[name]; ok {
+		data, err := fs.ReadFile(a.fsys, orig)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(rw, r, orig, time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	// Unhashed names still work, but must be revalidated
+	rw.Header().Set("Cache-Control", "no-cache")
+	http.FileServer(http.FS(a.fsys)).ServeHTTP(rw, r)
+}
@@ -0,0 +1,349 @@
+// API schema version this UI was written against; see apiSchemaVersion in schema.go
+const UI_SCHEMA_VERSION = 1;
+
+let requests = [];
+let expandedDomains = new Set();
+let expandedPaths = new Set();
+let expandedRequests = new Set();
+
+async function fetchRequests() {
+    try {
+        const response = await fetch('/api/requests');
+        requests = await response.json();
+        render();
+        updateStats();
+    } catch (error) {
+        console.error('Failed to fetch requests:', error);
+    }
+}
+
+function groupByDomain(requests) {
+    const groups = {};
+    for (const req of requests) {
+        if (!groups[req.domain]) {
+            groups[req.domain] = {};
+        }
+        if (!groups[req.domain][req.path]) {
+            groups[req.domain][req.path] = [];
+        }
+        groups[req.domain][req.path].push(req);
+    }
+    return groups;
+}
+
+function render() {
+    const container = document.getElementById('requests-container');
+    
+    if (requests.length === 0) {
+        container.innerHTML = `
+            <div class="empty-state">
+                <h2>No requests logged yet</h2>
+                <p>Requests made through the proxy will appear here</p>
+            </div>
+        `;
+        return;
+    }
+
+    const grouped = groupByDomain(requests);
+    const sortedDomains = Object.keys(grouped).sort();
+    
+    let html = '';
+    for (const domain of sortedDomains) {
+        const paths = grouped[domain];
+        const pathKeys = Object.keys(paths).sort();
+        const totalRequests = pathKeys.reduce((sum, p) => sum + paths[p].length, 0);
+        const isDomainExpanded = expandedDomains.has(domain);
+        
+        html += `
+            <div class="domain-group">
+                <div class="domain-header ${isDomainExpanded ? 'expanded' : ''}" onclick="toggleDomain('${escapeHtml(domain)}')">
+                    <span class="expand-icon ${isDomainExpanded ? 'expanded' : ''}">▶</span>
+                    <span class="domain-name">${escapeHtml(domain)}</span>
+                    <span class="domain-count">${totalRequests} request${totalRequests !== 1 ? 's' : ''}</span>
+                </div>
+                <div class="domain-content ${isDomainExpanded ? 'visible' : ''}">
+        `;
+        
+        for (const path of pathKeys) {
+            const pathRequests = paths[path];
+            const pathKey = `${domain}::${path}`;
+            const isPathExpanded = expandedPaths.has(pathKey);
+            
+            html += `
+                <div class="path-group">
+                    <div class="path-header ${isPathExpanded ? 'expanded' : ''}" onclick="togglePath('${escapeHtml(pathKey)}')">
+                        <span class="expand-icon ${isPathExpanded ? 'expanded' : ''}">▶</span>
+                        <span class="path-name" title="${escapeHtml(path)}">${escapeHtml(path) || '/'}</span>
+                        <span class="path-count">${pathRequests.length}</span>
+                    </div>
+                    <div class="path-content ${isPathExpanded ? 'visible' : ''}">
+            `;
+            
+            // Sort requests by timestamp descending (newest first)
+            const sortedRequests = [...pathRequests].sort((a, b) => 
+                new Date(b.timestamp) - new Date(a.timestamp)
+            );
+            
+            for (const req of sortedRequests) {
+                const isReqExpanded = expandedRequests.has(req.id);
+                const time = new Date(req.timestamp).toLocaleTimeString();
+                
+                html += `
+                    <div class="request-item ${isReqExpanded ? 'expanded' : ''}" onclick="toggleRequest('${req.id}')">
+                        <span class="method method-${req.method}">${req.method}</span>
+                        <span class="request-time">${time}</span>
+                        ${req.response_status ? `<span class="status-code status-${Math.floor(req.response_status/100)}xx">${req.response_status}</span>`
+                            : req.error ? `<span class="status-code status-error" title="${escapeHtml(req.error)}">error</span>`
+                            : `<span class="status-code status-pending">pending</span>`}
+                        <span class="request-id">${req.id}</span>
+                    </div>
+                    <div class="request-details ${isReqExpanded ? 'visible' : ''}" id="details-${req.id}">
+                        <div class="details-grid">
+                            <div class="details-section">
+                                <h3>Headers</h3>
+                                <div class="details-list">
+                                    ${renderHeaders(req.headers)}
+                                </div>
+                            </div>
+                            <div class="details-section">
+                                <h3>Request Info</h3>
+                                <div class="details-list">
+                                    <div class="detail-item">
+                                        <span class="detail-key">Full URL</span>
+                                        <span class="detail-value">${escapeHtml(req.domain)}${escapeHtml(req.path)}${req.query ? '?' + escapeHtml(req.query) : ''}</span>
+                                    </div>
+                                    ${req.query_truncated ? `<div class="detail-item">
+                                        <span class="detail-key">Query</span>
+                                        <span class="detail-value">truncated (${req.query_length} bytes)</span>
+                                    </div>` : ''}
+                                    ${req.upgrade ? `<div class="detail-item">
+                                        <span class="detail-key">Upgrade</span>
+                                        <span class="detail-value">${escapeHtml(req.upgrade.protocol)}${req.upgrade.refused ? ' refused: ' + escapeHtml(req.upgrade.refused) : ''}${req.upgrade.closed_by ? ` closed by ${escapeHtml(req.upgrade.closed_by)} after ${req.upgrade.duration_ms || 0}ms (${req.upgrade.bytes_to_upstream || 0} bytes up, ${req.upgrade.bytes_to_client || 0} down)` : (req.upgraded ? ' (open)' : '')}</span>
+                                    </div>` : ''}
+                                    ${req.range ? `<div class="detail-item">
+                                        <span class="detail-key">Range</span>
+                                        <span class="detail-value">${escapeHtml(req.range.requested || '')}${req.range.content_range ? ' → ' + escapeHtml(req.range.content_range) : ''}${req.range.ignored ? ' (ignored, full body sent)' : ''}</span>
+                                    </div>` : ''}
+                                    ${req.llm ? `<div class="detail-item">
+                                        <span class="detail-key">LLM</span>
+                                        <span class="detail-value">${escapeHtml(req.llm.model || 'unknown model')}: ${req.llm.input_tokens || 0} in, ${req.llm.output_tokens || 0} out, $${req.llm.cost_usd.toFixed(4)}${req.llm.estimated ? ` (estimated: ${escapeHtml(req.llm.estimated)})` : ''}${req.llm.budget_warning ? ` — budget ${escapeHtml(req.llm.budget_warning.join(', '))}` : ''}</span>
+                                    </div>` : ''}
+                                    ${req.server ? `<div class="detail-item">
+                                        <span class="detail-key">Server</span>
+                                        <span class="detail-value">${escapeHtml(req.server.matched_san || 'no SAN matches host')} (${escapeHtml(req.server.provider)})</span>
+                                    </div>` : ''}
+                                    ${req.policy ? `<div class="detail-item">
+                                        <span class="detail-key">Policy</span>
+                                        <span class="detail-value">${req.policy === 'blocked' ? 'refused: not in the allowlist' : 'outside the allowlist (monitor mode)'}</span>
+                                    </div>` : ''}
+                                    ${req.secret ? `<div class="detail-item">
+                                        <span class="detail-key">Secret</span>
+                                        <span class="detail-value">carries ${escapeHtml(req.secret)}</span>
+                                    </div>` : ''}
+                                    ${req.handshake ? `<div class="detail-item">
+                                        <span class="detail-key">Handshake</span>
+                                        <span class="detail-value">client ${escapeHtml(req.handshake.client || 'unknown')}${req.handshake.sni ? ' (SNI ' + escapeHtml(req.handshake.sni) + ')' : ''} failed: ${escapeHtml(req.handshake.error)}${req.handshake.missing_ca ? ' — the client likely doesn\'t trust the proxy CA' : ''}</span>
+                                    </div>` : ''}
+                                    ${req.capture_skipped ? `<div class="detail-item">
+                                        <span class="detail-key">Bodies</span>
+                                        <span class="detail-value">not captured (${escapeHtml(req.capture_skipped)})</span>
+                                    </div>` : ''}
+                                    ${req.instance ? `<div class="detail-item">
+                                        <span class="detail-key">Instance</span>
+                                        <span class="detail-value">${escapeHtml(req.instance)}</span>
+                                    </div>` : ''}
+                                    <div class="detail-item">
+                                        <span class="detail-key">Timestamp</span>
+                                        <span class="detail-value">${new Date(req.timestamp).toISOString()}</span>
+                                    </div>
+                                    <div class="detail-item">
+                                        <span class="detail-key">PCAP File</span>
+                                        <span class="detail-value">${escapeHtml(req.pcap_file)}</span>
+                                    </div>
+                                </div>
+                                <div class="pcap-download">
+                                    <a class="btn" href="/api/pcap/${encodeURIComponent(req.pcap_file)}" download onclick="event.stopPropagation()">Download PCAP</a>
+                                </div>
+                            </div>
+                            ${req.body ? `
+                            <div class="details-section body-section">
+                                <h3>Request Body</h3>
+                                <div class="body-content">${formatBody(req.body)}</div>
+                            </div>
+                            ` : ''}
+                            ${req.response_status ? `
+                            <div class="details-section">
+                                <h3>Response (${req.response_status})</h3>
+                                <div class="details-list">
+                                    ${renderHeaders(req.response_headers)}
+                                </div>
+                            </div>
+                            ` : ''}
+                            ${req.response_body ? `
+                            <div class="details-section body-section">
+                                <h3>Response Body</h3>
+                                <div class="body-content">${formatBody(req.response_body)}</div>
+                            </div>
+                            ` : ''}
+                        </div>
+                    </div>
+                `;
+            }
+            
+            html += `
+                    </div>
+                </div>
+            `;
+        }
+        
+        html += `
+                </div>
+            </div>
+        `;
+    }
+    
+    container.innerHTML = html;
+}
+
+function escapeHtml(str) {
+    if (!str) return '';
+    return str.replace(/&/g, '&amp;')
+              .replace(/</g, '&lt;')
+              .replace(/>/g, '&gt;')
+              .replace(/"/g, '&quot;')
+              .replace(/'/g, '&#039;');
+}
+
+function renderHeaders(headers) {
+    if (!headers || Object.keys(headers).length === 0) {
+        return '<div class="detail-item"><span class="detail-value">No headers</span></div>';
+    }
+    
+    return Object.entries(headers)
+        .map(([key, value]) => `
+            <div class="detail-item">
+                <span class="detail-key">${escapeHtml(key)}</span>
+                <span class="detail-value">${escapeHtml(value)}</span>
+            </div>
+        `).join('');
+}
+
+function formatBody(body) {
+    if (!body) return '';
+    // Try to parse and pretty-print JSON
+    try {
+        const parsed = JSON.parse(body);
+        return escapeHtml(JSON.stringify(parsed, null, 2));
+    } catch {
+        return escapeHtml(body);
+    }
+}
+
+function toggleDomain(domain) {
+    if (expandedDomains.has(domain)) {
+        expandedDomains.delete(domain);
+    } else {
+        expandedDomains.add(domain);
+    }
+    render();
+}
+
+function togglePath(pathKey) {
+    event.stopPropagation();
+    if (expandedPaths.has(pathKey)) {
+        expandedPaths.delete(pathKey);
+    } else {
+        expandedPaths.add(pathKey);
+    }
+    render();
+}
+
+function toggleRequest(id) {
+    event.stopPropagation();
+    if (expandedRequests.has(id)) {
+        expandedRequests.delete(id);
+    } else {
+        expandedRequests.add(id);
+    }
+    render();
+}
+
+function collapseAll() {
+    expandedDomains.clear();
+    expandedPaths.clear();
+    expandedRequests.clear();
+    render();
+}
+
+function expandAllDomains() {
+    const grouped = groupByDomain(requests);
+    for (const domain of Object.keys(grouped)) {
+        expandedDomains.add(domain);
+    }
+    render();
+}
+
+function updateStats() {
+    document.getElementById('request-count').textContent = requests.length;
+    const domains = new Set(requests.map(r => r.domain));
+    document.getElementById('domain-count').textContent = domains.size;
+}
+
+function refreshRequests() {
+    fetchRequests();
+}
+
+// Preferences are stored server-side so they follow the logs dir, not the browser
+async function loadPreferences() {
+    try {
+        const response = await fetch('/api/preferences');
+        const prefs = await response.json();
+        if (typeof prefs.auto_refresh === 'boolean') {
+            document.getElementById('auto-refresh').checked = prefs.auto_refresh;
+        }
+    } catch (error) {
+        console.error('Failed to load preferences:', error);
+    }
+}
+
+async function savePreferences() {
+    try {
+        const response = await fetch('/api/preferences');
+        const prefs = await response.json();
+        prefs.auto_refresh = document.getElementById('auto-refresh').checked;
+        await fetch('/api/preferences', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(prefs)
+        });
+    } catch (error) {
+        console.error('Failed to save preferences:', error);
+    }
+}
+
+document.getElementById('auto-refresh').addEventListener('change', savePreferences);
+
+// Warn if this (possibly cached) UI doesn't match the running proxy's API
+async function checkSchema() {
+    try {
+        const response = await fetch('/api/schema');
+        const schema = await response.json();
+        if (schema.schema_version !== UI_SCHEMA_VERSION) {
+            console.warn(`UI was built for API schema v${UI_SCHEMA_VERSION} but proxy ${schema.build.version} serves v${schema.schema_version}; try a hard refresh`);
+        }
+    } catch (error) {
+        console.error('Failed to fetch API schema:', error);
+    }
+}
+
+// Initial load
+checkSchema();
+loadPreferences();
+fetchRequests();
+
+// Auto-refresh
+setInterval(() => {
+    if (document.getElementById('auto-refresh').checked) {
+        fetchRequests();
+    }
+}, 5000);
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DomainStats aggregates the requests logged for one domain
+type DomainStats struct {
+	Domain            string  `json:"domain"`
+	Requests          int     `json:"requests"`
+	Completed         int     `json:"completed"`
+	Errors            int     `json:"errors"`
+	AvgOriginMs       float64 `json:"avg_origin_ms"`
+	AvgClientDrainMs  float64 `json:"avg_client_drain_ms"`
+	MaxClientDrainMs  int64   `json:"max_client_drain_ms"`
+	SlowClients       int     `json:"slow_clients"`
+	ContentMismatches int     `json:"content_mismatches"`
+	Bytes             int64   `json:"bytes"`              // delivered to clients
+	Instance          string  `json:"instance,omitempty"` // set by the aggregator
+
+	ServedBy []ProviderStats `json:"served_by,omitempty"` // certificate identities of TLS responses, by provider
+}
+
+// sortDomainStats orders stats busiest first
+func sortDomainStats(stats []DomainStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Domain < stats[j].Domain
+	})
+}
+
+func (w *WebServer) handleStats(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	filter, status, err := w.requestFilter(r)
+	if err != nil {
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	// The running counters cover the whole log; filtered stats can only
+	// be computed over the entries held in memory
+	var domains []DomainStats
+	var since time.Time
+	if filter == nil {
+		domains, since = w.logger.Stats()
+	} else {
+		counters := newStatsCounters()
+		for _, entry := range w.logger.GetRequests() {
+			if filter.Match(&entry) {
+				counters.observeEntry(entry)
+			}
+		}
+		domains, since = counters.Stats(), counters.since
+	}
+	stats := struct {
+		Domains []DomainStats `json:"domains"`
+		Since   *time.Time    `json:"since,omitempty"` // earliest entry counted
+	}{
+		Domains: domains,
+	}
+	if !since.IsZero() {
+		stats.Since = &since
+	}
+
+	if err := json.NewEncoder(rw).Encode(stats); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
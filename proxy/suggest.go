@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxSuggestedPaths is how many path patterns a suggested rule lists
+// before it allows any path on its host instead
+const maxSuggestedPaths = 10
+
+// secretPatterns recognize credentials that shouldn't leave the sandbox.
+// Headers the proxy redacts never reach them.
+var secretPatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"an Anthropic API key", regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]{20,}`)},
+	{"an OpenAI API key", regexp.MustCompile(`sk-(proj-)?[A-Za-z0-9]{20,}`)},
+	{"a GitHub token", regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}`)},
+	{"an AWS access key", regexp.MustCompile(`(AKIA|ASIA)[0-9A-Z]{16}`)},
+	{"a Slack token", regexp.MustCompile(`xox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"a private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// privateSuffixes are names that only resolve inside a private network
+var privateSuffixes = []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"}
+
+// PolicySuggestion is what the observed traffic suggests the policy should
+// allow, host by host
+type PolicySuggestion struct {
+	Requests int         // entries the suggestion was built from
+	From, To time.Time   // when they were logged
+	Hosts    []*hostPlan // sorted by host
+}
+
+// hostPlan is the observed traffic to one host and the rule it suggests
+type hostPlan struct {
+	Host     string
+	Requests int            // allowed by the suggestion
+	Methods  map[string]int // of the allowed requests
+	Paths    map[string]int // path patterns of the allowed requests
+	Excluded map[string]int // flagged requests left out of the suggestion, by reason
+	Rule     *PolicyRule    // nil if every request was flagged
+
+	currentDenies int // allowed requests the loaded policy doesn't allow
+}
+
+// entryHost is the hostname an entry went to, without its port
+func entryHost(e RequestLog) string {
+	if host, _, err := net.SplitHostPort(e.Domain); err == nil {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(e.Domain)
+}
+
+// privateHost reports whether host names a loopback, private or link-local
+// address rather than a service on the internet. Names aren't resolved.
+func privateHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+	}
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return true
+	}
+	for _, suffix := range privateSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// findSecret names the first credential found in the parts of an entry the
+// agent controls, and where it was found
+func findSecret(e RequestLog) string {
+	parts := []struct{ where, value string }{{"path", e.Path}, {"query", e.Query}, {"body", e.Body}}
+	for name, value := range e.Headers {
+		parts = append(parts, struct{ where, value string }{name + " header", value})
+	}
+	for _, part := range parts {
+		for _, s := range secretPatterns {
+			if s.pattern.MatchString(part.value) {
+				return s.name + " in the " + part.where
+			}
+		}
+	}
+	return ""
+}
+
+// flagEntry returns why an entry shouldn't justify an allow rule, or ""
+func flagEntry(e RequestLog) string {
+	switch host := entryHost(e); {
+	case e.Handshake != nil:
+		return "client TLS handshake failed, so no request was seen"
+	case privateHost(host):
+		return "private network address"
+	case strings.HasPrefix(e.Error, "unsupported_scheme"):
+		return "unsupported scheme"
+	case strings.HasPrefix(e.Error, "upstream_error"):
+		return "origin unreachable"
+	}
+	if secret := findSecret(e); secret != "" {
+		return "carries what looks like " + secret
+	}
+	if e.Content != nil && e.Content.Action != "" {
+		return "content verification " + e.Content.Result
+	}
+	if e.Server != nil && e.Server.MatchedSAN == "" {
+		return "upstream certificate doesn't cover the host"
+	}
+	return ""
+}
+
+// idSegment reports whether a path segment is an identifier rather than
+// part of an endpoint's name: a number, UUID, hex digest or opaque token
+func idSegment(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	var digits, letters, hex int
+	for _, c := range seg {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			hex++
+		case c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F':
+			letters++
+			hex++
+		case c >= 'g' && c <= 'z' || c >= 'G' && c <= 'Z':
+			letters++
+		case c != '-' && c != '_':
+			return false
+		}
+	}
+	switch {
+	case digits == len(seg):
+		return true
+	case len(seg) >= 8 && digits > 0 && hex == len(seg)-strings.Count(seg, "-"):
+		return true
+	default:
+		return len(seg) >= 20 && digits > 0 && letters > 0
+	}
+}
+
+// globEscaper quotes the characters path.Match treats specially
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// pathPattern turns an observed path into the pattern a rule allows it by,
+// with identifier segments matched by "*"
+func pathPattern(p string) string {
+	p = normalizePath(p)
+	if strings.HasSuffix(p, "...") {
+		// Cut short by normalizePath; allow everything below what's left
+		p = p[:strings.LastIndexByte(p, '/')] + "/**"
+		if p == "/**" {
+			return p
+		}
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "**" && i == len(segs)-1:
+		case idSegment(seg):
+			segs[i] = "*"
+		default:
+			segs[i] = globEscaper.Replace(seg)
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// SuggestPolicy builds an allowlist from observed traffic. Flagged entries
+// are left out, and counted against their host by reason. current, if not
+// nil, is checked against the allowed traffic for the diff.
+func SuggestPolicy(entries []RequestLog, current *PolicyRules) *PolicySuggestion {
+	s := &PolicySuggestion{}
+	plans := make(map[string]*hostPlan)
+	for _, e := range entries {
+		host := entryHost(e)
+		if host == "" {
+			continue
+		}
+		s.Requests++
+		if s.From.IsZero() || e.Timestamp.Before(s.From) {
+			s.From = e.Timestamp
+		}
+		if e.Timestamp.After(s.To) {
+			s.To = e.Timestamp
+		}
+
+		plan, ok := plans[host]
+		if !ok {
+			plan = &hostPlan{Host: host, Methods: make(map[string]int), Paths: make(map[string]int), Excluded: make(map[string]int)}
+			plans[host] = plan
+		}
+		if reason := flagEntry(e); reason != "" {
+			plan.Excluded[reason]++
+			continue
+		}
+		plan.Requests++
+		plan.Methods[e.Method]++
+		plan.Paths[pathPattern(e.Path)]++
+		if current.decide(e.Method, host, e.Path) != "" {
+			plan.currentDenies++
+		}
+	}
+
+	for _, plan := range plans {
+		if plan.Requests > 0 {
+			plan.Rule = &PolicyRule{Host: globEscaper.Replace(plan.Host), Methods: sortedKeys(plan.Methods)}
+			if len(plan.Paths) <= maxSuggestedPaths {
+				plan.Rule.Paths = sortedKeys(plan.Paths)
+			}
+		}
+		s.Hosts = append(s.Hosts, plan)
+	}
+	sort.Slice(s.Hosts, func(i, j int) bool { return s.Hosts[i].Host < s.Hosts[j].Host })
+	return s
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countsByKey formats counts like "GET 40, POST 2", largest first
+func countsByKey(m map[string]int) string {
+	keys := sortedKeys(m)
+	sort.SliceStable(keys, func(i, j int) bool { return m[keys[i]] > m[keys[j]] })
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s %d", k, m[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reasonCounts formats exclusion reasons like "origin unreachable (3)"
+func reasonCounts(m map[string]int) string {
+	keys := sortedKeys(m)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s (%d)", k, m[k])
+	}
+	return strings.Join(parts, "; ")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// justification is the comment explaining a suggested rule
+func (h *hostPlan) justification() string {
+	comment := fmt.Sprintf("%s (%s)", plural(h.Requests, "request"), countsByKey(h.Methods))
+	if h.Rule.Paths == nil {
+		comment += fmt.Sprintf(" to %s; paths not restricted", plural(len(h.Paths), "endpoint"))
+	}
+	if len(h.Excluded) > 0 {
+		comment += "; excluded: " + reasonCounts(h.Excluded)
+	}
+	return comment
+}
+
+// scalar and sequence build the YAML nodes of a rules file
+func scalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+}
+
+func sequence(values []string) *yaml.Node {
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+	for _, v := range values {
+		seq.Content = append(seq.Content, scalar(v))
+	}
+	return seq
+}
+
+// policyNode renders the suggestion as a policy section in monitor mode,
+// with each rule's traffic and the excluded hosts as comments
+func (s *PolicySuggestion) policyNode() *yaml.Node {
+	allow := &yaml.Node{Kind: yaml.SequenceNode}
+	var excluded []string
+	for _, h := range s.Hosts {
+		if h.Rule == nil {
+			excluded = append(excluded, fmt.Sprintf("  %s: %s", h.Host, reasonCounts(h.Excluded)))
+			continue
+		}
+		rule := &yaml.Node{Kind: yaml.MappingNode, HeadComment: h.justification()}
+		rule.Content = append(rule.Content, scalar("host"), scalar(h.Rule.Host))
+		rule.Content = append(rule.Content, scalar("methods"), sequence(h.Rule.Methods))
+		if h.Rule.Paths != nil {
+			rule.Content = append(rule.Content, scalar("paths"), sequence(h.Rule.Paths))
+		}
+		allow.Content = append(allow.Content, rule)
+	}
+	if len(allow.Content) == 0 {
+		allow.Style = yaml.FlowStyle
+	}
+
+	mode := scalar("mode")
+	mode.HeadComment = "monitor flags requests outside the allowlist; switch to enforce to refuse them"
+	policy := &yaml.Node{Kind: yaml.MappingNode}
+	policy.Content = append(policy.Content, mode, scalar("monitor"), scalar("allow"), allow)
+	if len(excluded) > 0 {
+		policy.FootComment = "Hosts left out because all their requests were flagged:\n" + strings.Join(excluded, "\n")
+	}
+	return policy
+}
+
+// RulesFile renders the suggestion as a rules file: the loaded rules file
+// with its policy section replaced, or a new one if file is empty. The
+// result is checked to load, so it can be passed to -rules as is.
+func (s *PolicySuggestion) RulesFile(file string) ([]byte, error) {
+	var doc yaml.Node
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse rules file: %w", err)
+		}
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+		root := doc.Content[0]
+		root.Content = append(root.Content, scalar("version"), scalar(fmt.Sprint(rulesVersion)))
+	}
+
+	root := doc.Content[0]
+	replaced := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "policy" {
+			root.Content[i+1] = s.policyNode()
+			replaced = true
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, scalar("policy"), s.policyNode())
+	}
+
+	header := fmt.Sprintf("Policy suggested from %s", plural(s.Requests, "logged request"))
+	if s.Requests > 0 {
+		header += fmt.Sprintf(" between %s and %s", s.From.Format(time.RFC3339), s.To.Format(time.RFC3339))
+	}
+	header += "; review it before loading with -rules"
+	if doc.HeadComment != "" {
+		header += "\n\n" + doc.HeadComment
+	}
+	doc.HeadComment = header
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to render rules file: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to render rules file: %w", err)
+	}
+	// Relative paths in the file, like a verify allowlist, resolve as before
+	name := file
+	if name == "" {
+		name = "suggestion"
+	}
+	if _, errs := ParseRules(name, buf.Bytes()); len(errs) > 0 {
+		return nil, fmt.Errorf("suggested rules don't load: %v", errs[0])
+	}
+	return buf.Bytes(), nil
+}
+
+// PolicyDomain is the suggestion for one observed host, compared with the
+// loaded policy
+type PolicyDomain struct {
+	Host          string         `json:"host"`
+	Requests      int            `json:"requests"`           // allowed by the suggestion
+	Methods       map[string]int `json:"methods,omitempty"`  // of the allowed requests
+	Excluded      map[string]int `json:"excluded,omitempty"` // flagged requests, by reason
+	Decision      string         `json:"decision"`           // "allow", or "exclude" if every request was flagged
+	Suggested     *PolicyRule    `json:"suggested,omitempty"`
+	Current       []PolicyRule   `json:"current,omitempty"`        // loaded rules whose host pattern matches
+	Change        string         `json:"change"`                   // "added", "changed", "unchanged", "covered" (by a wider loaded rule) or "excluded"
+	CurrentDenies int            `json:"current_denies,omitempty"` // allowed requests the loaded policy doesn't allow
+}
+
+// PolicyDiff compares a suggestion with the loaded policy
+type PolicyDiff struct {
+	PolicyLoaded bool           `json:"policy_loaded"`
+	Mode         string         `json:"mode,omitempty"` // of the loaded policy
+	Requests     int            `json:"requests"`
+	Domains      []PolicyDomain `json:"domains"`
+	Unused       []PolicyRule   `json:"unused,omitempty"` // loaded rules no observed host matches
+}
+
+// sameRule reports whether two rules allow the same methods and paths
+func sameRule(a, b PolicyRule) bool {
+	return a.Host == b.Host && sameSet(a.Methods, b.Methods) && sameSet(a.Paths, b.Paths)
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, v := range a {
+		seen[v] = true
+	}
+	for _, v := range b {
+		if !seen[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares the suggestion with current, the loaded policy (nil if none)
+func (s *PolicySuggestion) Diff(current *PolicyRules) PolicyDiff {
+	diff := PolicyDiff{PolicyLoaded: current != nil, Requests: s.Requests, Domains: []PolicyDomain{}}
+	var loaded []PolicyRule
+	if current != nil {
+		diff.Mode = current.Mode
+		loaded = current.Allow
+	}
+	used := make([]bool, len(loaded))
+
+	for _, h := range s.Hosts {
+		d := PolicyDomain{Host: h.Host, Requests: h.Requests, Suggested: h.Rule, Decision: "allow", CurrentDenies: h.currentDenies}
+		if h.Requests > 0 {
+			d.Methods = h.Methods
+		}
+		if len(h.Excluded) > 0 {
+			d.Excluded = h.Excluded
+		}
+		var exact *PolicyRule
+		for i, r := range loaded {
+			if ok, _ := path.Match(r.Host, h.Host); ok {
+				d.Current = append(d.Current, r)
+				used[i] = true
+				if h.Rule != nil && r.Host == h.Rule.Host {
+					exact = &loaded[i]
+				}
+			}
+		}
+
+		switch {
+		case h.Rule == nil:
+			d.Decision, d.Change = "exclude", "excluded"
+		case exact != nil && sameRule(*exact, *h.Rule):
+			d.Change = "unchanged"
+		case exact != nil:
+			d.Change = "changed"
+		case len(d.Current) > 0 && h.currentDenies == 0:
+			d.Change = "covered"
+		default:
+			d.Change = "added"
+		}
+		diff.Domains = append(diff.Domains, d)
+	}
+
+	for i, r := range loaded {
+		if !used[i] {
+			diff.Unused = append(diff.Unused, r)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// debugHeader lets an allowlisted client request a decision trace for one request
+const debugHeader = "X-Proxy-Debug"
+
+// maxTraceSteps caps how many steps a single trace records
+const maxTraceSteps = 64
+
+// TraceStep is one decision made by a proxy subsystem about a request
+type TraceStep struct {
+	Subsystem string `json:"subsystem"`
+	Rule      string `json:"rule,omitempty"`
+	Matched   bool   `json:"matched"`
+	Action    string `json:"action,omitempty"`
+}
+
+// DecisionTrace is the ordered list of decisions made about a request.
+// A nil trace records nothing, so callers don't need to check if tracing is on.
+type DecisionTrace struct {
+	Steps   []TraceStep `json:"steps"`
+	Dropped int         `json:"dropped,omitempty"` // steps not recorded due to the cap
+}
+
+// Add records a step
+func (t *DecisionTrace) Add(subsystem, rule string, matched bool, action string) {
+	if t == nil {
+		return
+	}
+	if len(t.Steps) >= maxTraceSteps {
+		t.Dropped++
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{
+		Subsystem: subsystem,
+		Rule:      rule,
+		Matched:   matched,
+		Action:    action,
+	})
+}
+
+// Clone returns a copy that's safe to use outside the logger's lock
+func (t *DecisionTrace) Clone() *DecisionTrace {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Steps = append([]TraceStep(nil), t.Steps...)
+	return &c
+}
+
+// TraceConfig decides which requests get a decision trace
+type TraceConfig struct {
+	Always  bool         // trace every request
+	Clients []*net.IPNet // clients allowed to opt in via X-Proxy-Debug
+}
+
+// ParseTraceClients parses a comma-separated list of IPs and CIDRs
+func ParseTraceClients(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", item)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Start returns a trace for req, or nil if tracing isn't enabled for it.
+// The debug header is always removed so it never reaches the upstream.
+func (c *TraceConfig) Start(req *http.Request) *DecisionTrace {
+	requested := req.Header.Get(debugHeader) != ""
+	req.Header.Del(debugHeader)
+
+	if c.Always {
+		t := &DecisionTrace{}
+		t.Add("debug", "global", true, "trace enabled")
+		return t
+	}
+	if !requested {
+		return nil
+	}
+	if !c.clientAllowed(req.RemoteAddr) {
+		return nil
+	}
+
+	t := &DecisionTrace{}
+	t.Add("debug", debugHeader, true, "trace enabled for "+req.RemoteAddr)
+	return t
+}
+
+func (c *TraceConfig) clientAllowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.Clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// traceContext is a parsed W3C traceparent header
+type traceContext struct {
+	TraceID string
+	SpanID  string // the caller's span, which upstream spans become children of
+	Sampled bool
+}
+
+// parseTraceparent parses version-traceid-parentid-flags. Unknown future
+// versions are accepted as long as the fields this version defines parse.
+func parseTraceparent(value string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return traceContext{}, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(spanID, 16) || !isLowerHex(flags, 2) {
+		return traceContext{}, false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return traceContext{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return traceContext{TraceID: traceID, SpanID: spanID, Sampled: flagBits[0]&1 == 1}, true
+}
+
+func isLowerHex(s string, size int) bool {
+	if len(s) != size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// injectTraceparent starts a sampled trace for a request that doesn't carry
+// a traceparent header, leaving tracestate and baggage alone. It reports
+// whether a header was added; an invalid inbound header is left in place.
+func injectTraceparent(req *http.Request) bool {
+	if _, ok := req.Header["Traceparent"]; ok {
+		return false
+	}
+	var ids [24]byte
+	if _, err := rand.Read(ids[:]); err != nil {
+		return false
+	}
+	req.Header.Set("Traceparent", "00-"+hex.EncodeToString(ids[:16])+"-"+hex.EncodeToString(ids[16:])+"-01")
+	return true
+}
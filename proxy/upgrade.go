@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// UpgradeInfo describes a request that asked to switch protocols (101)
+type UpgradeInfo struct {
+	Protocol        string     `json:"protocol"`                    // from the Upgrade header
+	Refused         string     `json:"refused,omitempty"`           // why the proxy forwarded it without the upgrade
+	ClosedAt        *time.Time `json:"closed_at,omitempty"`         // when the relay ended
+	ClosedBy        string     `json:"closed_by,omitempty"`         // "client" or "upstream", whichever side ended first
+	DurationMs      int64      `json:"duration_ms,omitempty"`       // from the 101 to the end of the relay
+	BytesToUpstream int64      `json:"bytes_to_upstream,omitempty"` // relayed after the 101
+	BytesToClient   int64      `json:"bytes_to_client,omitempty"`
+	Error           string     `json:"error,omitempty"` // why the relay failed or ended abnormally
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeProtocol returns the protocol a request or response switches to,
+// or "" if it isn't an upgrade
+func upgradeProtocol(h http.Header) string {
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.TrimSpace(h.Get("Upgrade"))
+}
+
+// refuseUpgrade returns why an upgrade request can't be relayed, or "" if
+// it can. relayable is false inside CONNECT tunnels, where the proxy
+// doesn't own the client connection.
+func refuseUpgrade(h http.Header, relayable bool) string {
+	switch {
+	case headerHasToken(h, "Upgrade", "h2c"):
+		// Relaying h2c would hide every request multiplexed over the
+		// upgraded connection from the log; HTTP/1.1 keeps them visible
+		return "h2c upgrade refused: requests multiplexed over HTTP/2 would bypass logging; continuing over HTTP/1.1"
+	case !relayable && !headerHasToken(h, "Upgrade", "websocket"):
+		return "upgrade refused: only WebSocket upgrades can be relayed inside CONNECT tunnels"
+	}
+	return ""
+}
+
+// stripUpgrade removes the upgrade headers from a request so the origin
+// answers it as plain HTTP/1.1
+func stripUpgrade(req *http.Request) {
+	req.Header.Del("Upgrade")
+	req.Header.Del("Connection")
+	req.Header.Del("HTTP2-Settings")
+}
+
+type upgradeKey struct{}
+
+// upgradeWriter is the client connection of an upgrade request, carried in
+// the request context so a 101 response can take it over. Once hijacked,
+// further writes from goproxy are dropped.
+type upgradeWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (w *upgradeWriter) WriteHeader(code int) {
+	if !w.hijacked {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *upgradeWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// handleUpgrades makes the client connection of absolute-form upgrade
+// requests available to the relay. CONNECT tunnels are hijacked by goproxy
+// before any request inside them is read, so they never get one.
+func handleUpgrades(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect && upgradeProtocol(r.Header) != "" {
+			if _, ok := w.(http.Hijacker); ok {
+				uw := &upgradeWriter{ResponseWriter: w}
+				r = r.WithContext(context.WithValue(r.Context(), upgradeKey{}, uw))
+				w = uw
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// upgradeWriterFor returns the relayable client connection of req, or nil
+func upgradeWriterFor(req *http.Request) *upgradeWriter {
+	uw, _ := req.Context().Value(upgradeKey{}).(*upgradeWriter)
+	return uw
+}
+
+// relayUpgrade writes a 101 response to the client and copies bytes both
+// ways until either side closes, then closes both. It blocks for the life
+// of the upgraded connection. The client connection must come from
+// handleUpgrades.
+func relayUpgrade(uw *upgradeWriter, resp *http.Response, protocol string) UpgradeInfo {
+	info := UpgradeInfo{Protocol: protocol}
+	started := time.Now()
+	finish := func(err error) UpgradeInfo {
+		closed := time.Now().UTC()
+		info.ClosedAt = &closed
+		info.DurationMs = closed.Sub(started).Milliseconds()
+		if err != nil {
+			info.Error = err.Error()
+		}
+		return info
+	}
+
+	// Transport only makes the body writable for a well-formed switch
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return finish(errors.New("upstream 101 response isn't a protocol switch (missing Connection: upgrade)"))
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := uw.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return finish(fmt.Errorf("failed to take over client connection: %w", err))
+	}
+	uw.hijacked = true
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	head := *resp
+	head.Body = nil
+	head.ContentLength = 0
+	if err := head.Write(conn); err != nil {
+		return finish(fmt.Errorf("failed to write 101 to client: %w", err))
+	}
+
+	type result struct {
+		side string // the side whose reads ended
+		n    int64
+		err  error
+	}
+	done := make(chan result, 2)
+	go func() {
+		// buffered holds anything the client sent right after the request
+		n, err := io.Copy(upstream, buffered.Reader)
+		done <- result{"client", n, err}
+	}()
+	go func() {
+		n, err := io.Copy(conn, upstream)
+		done <- result{"upstream", n, err}
+	}()
+
+	// Either side closing ends the relay; closing both unblocks the other copy
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		r := <-done
+		if i == 0 {
+			info.ClosedBy = r.side
+			firstErr = r.err
+			conn.Close()
+			upstream.Close()
+		}
+		if r.side == "client" {
+			info.BytesToUpstream = r.n
+		} else {
+			info.BytesToClient = r.n
+		}
+	}
+	if errors.Is(firstErr, net.ErrClosed) {
+		firstErr = nil
+	}
+	return finish(firstErr)
+}
+
+// relaySwitch relays the connection of a 101 response and logs how the
+// relay ended. It returns what goproxy should finish the request with:
+// nothing is left to write once the client connection has been taken
+// over, and a 502 if it couldn't be.
+func relaySwitch(uw *upgradeWriter, resp *http.Response, req *http.Request, requestID string, logger *Logger) *http.Response {
+	protocol := upgradeProtocol(resp.Header)
+	if protocol == "" {
+		protocol = req.Header.Get("Upgrade")
+	}
+	fmt.Printf("[%s] Switched protocols to %s\n", requestID, protocol)
+
+	info := relayUpgrade(uw, resp, protocol)
+	logger.LogUpgrade(requestID, info)
+	if !uw.hijacked {
+		logger.LogError(requestID, "upgrade_failed: "+info.Error)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, info.Error+"\n")
+	}
+
+	fmt.Printf("[%s] %s connection closed by %s after %dms (%d bytes up, %d down)\n",
+		requestID, protocol, info.ClosedBy, info.DurationMs, info.BytesToUpstream, info.BytesToClient)
+	resp.Body = http.NoBody
+	return resp
+}
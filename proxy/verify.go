@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// verifyChunkSize is how much of a verified body is read from upstream at a
+// time. One chunk is always held back until the next arrives, so a blocked
+// download never reaches the client in full.
+const verifyChunkSize = 32 * 1024
+
+// errContentBlocked aborts the relay of a body whose hash isn't allowed
+var errContentBlocked = errors.New("response body blocked: sha256 not in allowlist")
+
+// errRangeBlocked refuses a byte range that can't be hashed as part of its
+// resource, which would let a blocked artifact through piecewise
+var errRangeBlocked = errors.New("response body blocked: byte range can't be verified against the allowlist")
+
+// VerifyRules selects responses whose bodies are hashed while streaming
+type VerifyRules struct {
+	Targets    []VerifyTarget `yaml:"targets"`
+	Allowlist  string         `yaml:"allowlist"`   // file of known-good sha256 hashes
+	OnMismatch string         `yaml:"on_mismatch"` // "flag" (default) or "block"
+
+	allowed map[string]bool // nil without an allowlist
+}
+
+// VerifyTarget is a host/path pattern. Patterns use path.Match syntax, and
+// a path ending in "/**" also matches everything below it.
+type VerifyTarget struct {
+	Host string `yaml:"host"`
+	Path string `yaml:"path"`
+}
+
+// ContentCheck is the verification outcome recorded on an entry
+type ContentCheck struct {
+	SHA256   string `json:"sha256,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	Partial  bool   `json:"partial,omitempty"`
+	Result   string `json:"result"`             // "recorded", "allowed", "mismatch", "partial", "range_pending" or "range_unverifiable"
+	Action   string `json:"action,omitempty"`   // "flagged" or "blocked" on mismatch or an unverifiable range
+	Segments int    `json:"segments,omitempty"` // responses the hash was assembled from, when more than one
+	Error    string `json:"error,omitempty"`    // why a range couldn't be placed within its resource
+}
+
+// matches reports whether a response for host and urlPath should be verified
+func (v *VerifyRules) matches(host, urlPath string) bool {
+	for _, t := range v.Targets {
+		if ok, _ := path.Match(t.Host, host); !ok {
+			continue
+		}
+		if t.Path == "" || matchPath(t.Path, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern, urlPath string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if ok, _ := path.Match(dir, urlPath); ok {
+			return true
+		}
+		// Match the pattern against each ancestor of urlPath
+		for p := path.Dir(urlPath); p != "/" && p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(dir, p); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(pattern, urlPath)
+	return ok
+}
+
+// judge classifies a completed body's hash
+func (v *VerifyRules) judge(sum string) (result, action string) {
+	if v.allowed == nil {
+		return "recorded", ""
+	}
+	if v.allowed[sum] {
+		return "allowed", ""
+	}
+	if v.OnMismatch == "block" {
+		return "mismatch", "blocked"
+	}
+	return "mismatch", "flagged"
+}
+
+// unplaced classifies a ranged body that can't be hashed as part of its
+// resource. With an allowlist it's treated like a mismatch.
+func (v *VerifyRules) unplaced() (result, action string) {
+	if v.allowed == nil {
+		return "range_unverifiable", ""
+	}
+	if v.OnMismatch == "block" {
+		return "range_unverifiable", "blocked"
+	}
+	return "range_unverifiable", "flagged"
+}
+
+func (p *rulesParser) parseVerify(node *yaml.Node, v *VerifyRules) {
+	keys := p.mapping(node, "verify key", "targets", "allowlist", "on_mismatch")
+
+	if n, ok := keys["targets"]; ok {
+		if n.Kind != yaml.SequenceNode {
+			p.errorf(n, "targets must be a list")
+		} else {
+			for _, item := range n.Content {
+				fields := p.mapping(item, "target key", "host", "path")
+				var t VerifyTarget
+				if h, ok := fields["host"]; ok {
+					p.decode(h, &t.Host)
+					if _, err := path.Match(t.Host, ""); err != nil || t.Host == "" {
+						p.errorf(h, "invalid host pattern %q", t.Host)
+					}
+				} else if fields != nil {
+					p.errorf(item, "target is missing host")
+				}
+				if pn, ok := fields["path"]; ok {
+					p.decode(pn, &t.Path)
+					if _, err := path.Match(strings.TrimSuffix(t.Path, "/**"), ""); err != nil || !strings.HasPrefix(t.Path, "/") {
+						p.errorf(pn, "invalid path pattern %q (must start with /)", t.Path)
+					}
+				}
+				v.Targets = append(v.Targets, t)
+			}
+		}
+	}
+
+	v.OnMismatch = "flag"
+	if n, ok := keys["on_mismatch"]; ok {
+		p.decode(n, &v.OnMismatch)
+		if v.OnMismatch != "flag" && v.OnMismatch != "block" {
+			p.errorf(n, "on_mismatch must be flag or block, not %q", v.OnMismatch)
+		}
+	}
+
+	if n, ok := keys["allowlist"]; ok {
+		p.decode(n, &v.Allowlist)
+		allowlist := v.Allowlist
+		if !filepath.IsAbs(allowlist) {
+			allowlist = filepath.Join(filepath.Dir(p.file), allowlist)
+		}
+		allowed, errs := loadAllowlist(allowlist)
+		if errs == nil {
+			v.allowed = allowed
+		}
+		for _, err := range errs {
+			if ce, ok := err.(*ConfigError); ok {
+				p.errs = append(p.errs, ce)
+			} else {
+				p.errorf(n, "%v", err)
+			}
+		}
+	}
+}
+
+// loadAllowlist reads known-good hashes, one per line in sha256sum format
+// ("<hex>  <name>") or bare. Blank lines and # comments are ignored.
+func loadAllowlist(file string) (map[string]bool, []error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to read allowlist: %w", err)}
+	}
+
+	allowed := make(map[string]bool)
+	var errs []error
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum := strings.ToLower(strings.Fields(line)[0])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			errs = append(errs, &ConfigError{File: file, Line: n, Column: 1, Msg: fmt.Sprintf("invalid sha256 %q", sum)})
+			continue
+		}
+		allowed[sum] = true
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return allowed, nil
+}
+
+// verifyBody relays a response body from upstream while hashing it. The
+// last chunk read is held back until the body is known to be allowed. A
+// ranged body extends the hash of the ranges before it and is judged once
+// the resource is complete.
+type verifyBody struct {
+	src      io.ReadCloser
+	rules    *VerifyRules
+	assembly *rangeAssembly // hash of the resource up to offset; nil if the body can't be placed
+	offset   int64          // where the body starts within its resource
+	maxKeep  int
+	kept     []byte // first maxKeep bytes, for the logged body
+
+	ready     []byte // bytes released to the client
+	held      []byte // most recent chunk, released once the next arrives
+	err       error  // returned once ready is drained
+	total     int64  // bytes read from upstream
+	delivered int64  // bytes handed to the relay
+
+	upstreamDone time.Time
+	check        ContentCheck
+	once         sync.Once
+	onDone       func(body *verifyBody, complete bool)
+}
+
+// newVerifyBody wraps src for verification. assembly is where the body
+// sits within its resource, as found by rangeTracker.locate; a body that
+// couldn't be placed (placeErr) is relayed unhashed, or refused when
+// unverifiable ranges are blocked.
+func newVerifyBody(src io.ReadCloser, rules *VerifyRules, assembly *rangeAssembly, placeErr error, maxKeep int, onDone func(body *verifyBody, complete bool)) *verifyBody {
+	b := &verifyBody{
+		src:     src,
+		rules:   rules,
+		maxKeep: maxKeep,
+		onDone:  onDone,
+	}
+	if placeErr != nil {
+		b.check.Result, b.check.Action = rules.unplaced()
+		b.check.Error = placeErr.Error()
+		if b.check.Action == "blocked" {
+			b.err = errRangeBlocked
+		}
+		return b
+	}
+	b.assembly = assembly
+	b.offset = assembly.next
+	assembly.segments++
+	return b
+}
+
+func (b *verifyBody) Read(p []byte) (int, error) {
+	for len(b.ready) == 0 {
+		if b.err != nil {
+			b.finish()
+			return 0, b.err
+		}
+		b.fill()
+	}
+	n := copy(p, b.ready)
+	if b.assembly != nil {
+		// Hashing what's delivered keeps the hash resumable from exactly
+		// where the client got to
+		b.assembly.hash.Write(p[:n])
+	}
+	b.ready = b.ready[n:]
+	b.delivered += int64(n)
+	return n, nil
+}
+
+// fill reads the next chunk from upstream, releasing the previously held one
+func (b *verifyBody) fill() {
+	buf := make([]byte, verifyChunkSize)
+	n, err := b.src.Read(buf)
+	if n > 0 {
+		b.total += int64(n)
+		if keep := b.maxKeep - len(b.kept); keep > 0 {
+			b.kept = append(b.kept, buf[:min(n, keep)]...)
+		}
+		b.ready, b.held = b.held, buf[:n]
+	}
+	if err == nil {
+		return
+	}
+
+	b.upstreamDone = time.Now().UTC()
+	if err != io.EOF {
+		b.ready, b.held = append(b.ready, b.held...), nil
+		b.err = err
+		return
+	}
+
+	if b.assembly == nil {
+		b.ready, b.held = append(b.ready, b.held...), nil
+		b.err = io.EOF
+		return
+	}
+	if size := b.assembly.size; size >= 0 && b.offset+b.total < size {
+		// The rest of the resource is still to come, and a hash of part of
+		// it would be mistaken for the whole
+		b.check.Result = "range_pending"
+		b.ready, b.held = append(b.ready, b.held...), nil
+		b.err = io.EOF
+		return
+	}
+
+	// The hash so far covers what's been delivered; add what's left
+	sum := cloneHash(b.assembly.hash)
+	sum.Write(b.ready)
+	sum.Write(b.held)
+	b.check.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	b.check.Result, b.check.Action = b.rules.judge(b.check.SHA256)
+	if b.assembly.segments > 1 {
+		b.check.Segments = b.assembly.segments
+	}
+	if b.check.Action == "blocked" {
+		b.held = nil
+		b.err = errContentBlocked
+		return
+	}
+	b.ready, b.held = append(b.ready, b.held...), nil
+	b.err = io.EOF
+}
+
+// Close records a partial download if the relay gave up before EOF
+func (b *verifyBody) Close() error {
+	b.finish()
+	return b.src.Close()
+}
+
+func (b *verifyBody) finish() {
+	b.once.Do(func() {
+		complete := b.err == io.EOF && b.delivered == b.total
+		b.check.Bytes = b.delivered
+		if !complete && b.check.Action != "blocked" {
+			// A hash of the bytes the client didn't fully get would be misleading
+			if b.assembly == nil && b.check.Result != "" {
+				b.check.Partial = true
+			} else {
+				b.check = ContentCheck{Bytes: b.delivered, Partial: true, Result: "partial"}
+			}
+		}
+		if b.upstreamDone.IsZero() {
+			b.upstreamDone = time.Now().UTC()
+		}
+		b.onDone(b, complete)
+	})
+}
+
+// resumable returns the assembly a range request for the rest of the
+// resource can continue: the hash of everything the client has received,
+// or nil if the resource is complete or its size isn't known
+func (b *verifyBody) resumable() *rangeAssembly {
+	a := b.assembly
+	if a == nil || a.size < 0 || b.check.Action == "blocked" {
+		return nil
+	}
+	a.next = b.offset + b.delivered
+	if a.next >= a.size {
+		return nil
+	}
+	return a
+}
+
+// abortOnBlock aborts the client connection when a blocked body is relayed
+// on the plain HTTP path. There goproxy copies into an http.ResponseWriter
+// that would otherwise end the chunked response cleanly, leaving the client
+// with a truncated body it believes is complete. MITM'd connections are
+// written directly and already stop without a terminating chunk.
+type abortOnBlock struct {
+	io.ReadCloser
+}
+
+func (b abortOnBlock) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, errContentBlocked) || errors.Is(err, errRangeBlocked) {
+		b.ReadCloser.Close()
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
+
+// logContent records the verification outcome and delivery of a streamed body
+func (l *Logger) logContent(requestID string, started time.Time, body *verifyBody, complete bool) {
+	check := body.check
+	upstreamDone := body.upstreamDone
+
+	respBody := string(body.kept)
+	if body.total > int64(len(body.kept)) {
+		respBody += "... [truncated]"
+	}
+
+	switch {
+	case check.Action != "" && check.SHA256 == "":
+		fmt.Printf("[%s] content %s: byte range can't be verified against the allowlist\n", requestID, check.Action)
+	case check.Action != "":
+		fmt.Printf("[%s] content %s: sha256 %s not in allowlist\n", requestID, check.Action, check.SHA256)
+	}
+
+	l.mu.Lock()
+	l.writeUpdate(entryUpdate{
+		Type:           "content",
+		ID:             requestID,
+		ResponseBody:   respBody,
+		UpstreamDoneAt: &upstreamDone,
+		Content:        &check,
+	})
+	l.mu.Unlock()
+
+	l.logDelivery(requestID, started, upstreamDone, body.delivered, complete)
+}
@@ -0,0 +1,59 @@
+// Package version holds build metadata for the proxy binary.
+//
+// The variables are set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/apart-work-test/proxy/version.Version=1.2.0 \
+//		-X github.com/apart-work-test/proxy/version.Commit=$(git rev-parse HEAD)"
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Injected via -ldflags -X; left at their defaults for plain `go build`
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = ""
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build info, falling back to VCS data recorded by the Go
+// toolchain when the commit wasn't injected
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if info.Commit == "unknown" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "vcs.revision" {
+					info.Commit = s.Value
+				}
+			}
+		}
+	}
+
+	return info
+}
+
+// String returns a short human-readable version
+func (i Info) String() string {
+	commit := i.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	return i.Version + " (" + commit + ")"
+}
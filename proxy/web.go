@@ -1,14 +1,21 @@
 package main
 
 import (
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 //go:embed static/*
@@ -16,48 +23,164 @@ var staticFiles embed.FS
 
 // WebServer serves the web UI
 type WebServer struct {
-	logger  *Logger
-	logsDir string
+	logger      *Logger
+	prefs       *PreferencesStore
+	replayer    *Replayer
+	composer    *Composer
+	events      *EventLog
+	caps        *Capabilities
+	certs       *CertInventory
+	handshakes  *HandshakeMonitor
+	pipeline    *EnrichPipeline
+	inflight    *InFlight
+	fingerprint Fingerprint
+	features    func() map[string]bool // optional features, reported by /api/schema
+	degraded    []string               // what's running in a reduced mode, reported by /api/health
+	filters     *FilterStore
+	logsDir     string
+	token       string // if set, API calls must send "Authorization: Bearer <token>"
+	adminToken  string // also accepted; may change shared filters
 }
 
 // NewWebServer creates a new web server
-func NewWebServer(logger *Logger, logsDir string) *WebServer {
+func NewWebServer(logger *Logger, prefs *PreferencesStore, replayer *Replayer, composer *Composer, events *EventLog, caps *Capabilities, certs *CertInventory, handshakes *HandshakeMonitor, filters *FilterStore, pipeline *EnrichPipeline, inflight *InFlight, fingerprint Fingerprint, features func() map[string]bool, degraded []string, logsDir, token, adminToken string) *WebServer {
 	return &WebServer{
-		logger:  logger,
-		logsDir: logsDir,
+		logger:      logger,
+		prefs:       prefs,
+		replayer:    replayer,
+		composer:    composer,
+		events:      events,
+		caps:        caps,
+		certs:       certs,
+		handshakes:  handshakes,
+		filters:     filters,
+		pipeline:    pipeline,
+		inflight:    inflight,
+		fingerprint: fingerprint,
+		features:    features,
+		degraded:    degraded,
+		logsDir:     logsDir,
+		token:       token,
+		adminToken:  adminToken,
 	}
 }
 
-// Start starts the web server
-func (w *WebServer) Start(addr string) error {
+// Handler routes the API and serves the UI
+func (w *WebServer) Handler() (http.Handler, error) {
 	mux := http.NewServeMux()
 
 	// API endpoints
-	mux.HandleFunc("/api/requests", w.handleRequests)
-	mux.HandleFunc("/api/pcap/", w.handlePcapDownload)
-	mux.HandleFunc("/api/pcap-list", w.handlePcapList)
+	for _, route := range w.apiRoutes() {
+		if route.handler != nil {
+			mux.HandleFunc(route.muxPattern(), route.handler)
+		}
+	}
 
 	// Static files
 	staticFS, err := fs.Sub(staticFiles, "static")
 	if err != nil {
-		return fmt.Errorf("failed to get static files: %w", err)
+		return nil, fmt.Errorf("failed to get static files: %w", err)
 	}
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+	assets, err := newStaticAssets(staticFS)
+	if err != nil {
+		return nil, err
+	}
+	mux.Handle("/", assets)
 
-	fmt.Printf("Web UI available at http://localhost%s\n", addr)
-	return http.ListenAndServe(addr, mux)
+	return requireToken(mux, w.token, w.adminToken), nil
+}
+
+// requireToken rejects API calls without the configured bearer token (or
+// the admin token). The static UI stays public; it's useless without API access.
+func requireToken(next http.Handler, token, adminToken string) http.Handler {
+	if token == "" && adminToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/api/health" {
+			got := r.Header.Get("Authorization")
+			if !tokenMatches(got, token) && !tokenMatches(got, adminToken) {
+				http.Error(rw, "Missing or invalid API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// tokenMatches checks an Authorization header against a configured token
+func tokenMatches(header, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+token)) == 1
+}
+
+// caller identifies who is making an API call: the fingerprint of their
+// token, and whether it's the admin token. Without any tokens configured
+// everyone is the same anonymous admin.
+func (w *WebServer) caller(r *http.Request) (owner string, admin bool) {
+	if w.token == "" && w.adminToken == "" {
+		return "", true
+	}
+	header := r.Header.Get("Authorization")
+	return tokenFingerprint(strings.TrimPrefix(header, "Bearer ")), tokenMatches(header, w.adminToken)
+}
+
+// canResetBudget reports whether the caller may reset the LLM budget: with
+// tokens configured only the admin token may. Without them, everyone is
+// admin, so resets are limited to local callers.
+func (w *WebServer) canResetBudget(r *http.Request) bool {
+	if w.token != "" || w.adminToken != "" {
+		return tokenMatches(r.Header.Get("Authorization"), w.adminToken)
+	}
+	return localCaller(r)
+}
+
+// canSend reports whether the caller may have the proxy send a request on
+// its behalf, with the operator's credentials. With tokens configured,
+// requireToken has already checked the caller's; without them, only local
+// callers may.
+func (w *WebServer) canSend(r *http.Request) bool {
+	if w.token != "" || w.adminToken != "" {
+		return true
+	}
+	return localCaller(r)
+}
+
+// localCaller reports whether r comes from a loopback client and not from
+// another web page (browsers send Origin on cross-origin POSTs)
+func localCaller(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
 }
 
 func (w *WebServer) handleRequests(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
 
+	filter, status, err := w.requestFilter(r)
+	if err != nil {
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
 	requests := w.logger.GetRequests()
 
-	// Return in reverse order (newest first)
-	reversed := make([]RequestLog, len(requests))
-	for i, req := range requests {
-		reversed[len(requests)-1-i] = req
+	// Return in reverse order (newest first). Decision traces are only
+	// served by the detail endpoint to keep the list small.
+	reversed := make([]RequestLog, 0, len(requests))
+	for i := len(requests) - 1; i >= 0; i-- {
+		req := requests[i]
+		if filter != nil && !filter.Match(&req) {
+			continue
+		}
+		req.Debug = nil
+		reversed = append(reversed, req)
 	}
 
 	if err := json.NewEncoder(rw).Encode(reversed); err != nil {
@@ -65,6 +188,265 @@ func (w *WebServer) handleRequests(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// requestFilter builds the filter a list call asks for: ?q=, the simple
+// per-field parameters and ?filter_name=, all of which must match. It
+// returns nil if none are given, or the HTTP status to fail with.
+func (w *WebServer) requestFilter(r *http.Request) (*Filter, int, error) {
+	params := r.URL.Query()
+
+	var q *Filter
+	if expr := params.Get("q"); expr != "" {
+		var err error
+		if q, err = ParseFilter(expr); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("%w: %v", errFilterInvalid, err)
+		}
+	}
+
+	sugar, err := filterSugar(params)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("%w: %v", errFilterInvalid, err)
+	}
+
+	var saved *Filter
+	if name := params.Get("filter_name"); name != "" {
+		owner, _ := w.caller(r)
+		if saved, err = w.filters.Lookup(owner, name); err != nil {
+			status := http.StatusNotFound
+			if errors.Is(err, errFilterInvalid) {
+				status = http.StatusConflict
+			}
+			return nil, status, err
+		}
+	}
+
+	return combineFilters(q, sugar, saved), http.StatusOK, nil
+}
+
+// handleFilterValidate parses ?q= and reports the parse tree or the
+// position of the first error
+func (w *WebServer) handleFilterValidate(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var result struct {
+		Valid  bool        `json:"valid"`
+		AST    interface{} `json:"ast,omitempty"`
+		Error  string      `json:"error,omitempty"`
+		Column int         `json:"column,omitempty"`
+	}
+	filter, err := ParseFilter(r.URL.Query().Get("q"))
+	if err != nil {
+		var ferr *FilterError
+		if errors.As(err, &ferr) {
+			result.Error = ferr.Msg
+			result.Column = ferr.Column
+		} else {
+			result.Error = err.Error()
+		}
+	} else {
+		result.Valid = true
+		result.AST = filter.Describe()
+	}
+
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleRequestDetail(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/requests/")
+	if replayID, ok := strings.CutSuffix(id, "/replay"); ok && replayID != "" {
+		w.handleReplay(rw, r, replayID)
+		return
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if id == "" {
+		http.Error(rw, "No request ID specified", http.StatusBadRequest)
+		return
+	}
+
+	entry, ok := w.logger.GetRequest(id)
+	if !ok {
+		http.Error(rw, "Request not found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleReplay re-sends a captured request. Like compose, it may add the
+// operator's credentials, so it isn't open to other web pages.
+func (w *WebServer) handleReplay(rw http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.canSend(r) {
+		http.Error(rw, "Replaying requests requires an API token or a local client", http.StatusForbidden)
+		return
+	}
+
+	entry, err := w.replayer.Replay(id)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errReplayNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errReplayInvalid):
+			status = http.StatusConflict
+		case errors.Is(err, errPolicyDenied):
+			status = http.StatusForbidden
+		case errors.Is(err, errLLMBudgetExceeded):
+			status = http.StatusPaymentRequired
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCompose sends a request built from a template. Unlike read-only
+// endpoints it doesn't allow cross-origin use: a web page must not be able
+// to make the proxy send the operator's credentials.
+func (w *WebServer) handleCompose(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.canSend(r) {
+		http.Error(rw, "Composing requests requires an API token or a local client", http.StatusForbidden)
+		return
+	}
+	// Browsers only send JSON cross-origin after a preflight, which isn't answered
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(rw, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var template RequestTemplate
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTemplateSize)).Decode(&template); err != nil {
+		http.Error(rw, fmt.Sprintf("%v: %v", errComposeInvalid, err), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := w.composer.Compose(template)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errComposeInvalid):
+			status = http.StatusBadRequest
+		case errors.Is(err, errComposeLoop), errors.Is(err, errPolicyDenied):
+			status = http.StatusForbidden
+		case errors.Is(err, errLLMBudgetExceeded):
+			status = http.StatusPaymentRequired
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleFilters(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	owner, admin := w.caller(r)
+	switch r.Method {
+	case http.MethodGet:
+		if err := json.NewEncoder(rw).Encode(w.filters.Visible(owner)); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		w.putFilter(rw, r, owner, admin, "", true)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (w *WebServer) handleFilterDetail(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/filters/")
+	shared := r.URL.Query().Get("shared") == "true"
+	owner, admin := w.caller(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		f, ok := w.filters.Get(owner, name, shared)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("%v named %q", errFilterNotFound, name), http.StatusNotFound)
+			return
+		}
+		if err := json.NewEncoder(rw).Encode(f); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPut:
+		w.putFilter(rw, r, owner, admin, name, false)
+	case http.MethodDelete:
+		if err := w.filters.Delete(owner, admin, name, shared); err != nil {
+			http.Error(rw, err.Error(), filterErrorStatus(err))
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// putFilter creates (POST) or replaces (PUT) a saved filter from the body.
+// For PUT the name comes from the URL.
+func (w *WebServer) putFilter(rw http.ResponseWriter, r *http.Request, owner string, admin bool, name string, create bool) {
+	var f SavedFilter
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTemplateSize)).Decode(&f); err != nil {
+		http.Error(rw, fmt.Sprintf("%v: %v", errFilterInvalid, err), http.StatusBadRequest)
+		return
+	}
+	if name != "" {
+		f.Name = name
+	}
+
+	saved, err := w.filters.Put(owner, admin, f, create)
+	if err != nil {
+		http.Error(rw, err.Error(), filterErrorStatus(err))
+		return
+	}
+	if create {
+		rw.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(rw).Encode(saved); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func filterErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errFilterInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errFilterExists):
+		return http.StatusConflict
+	case errors.Is(err, errFilterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errFilterForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (w *WebServer) handlePcapDownload(rw http.ResponseWriter, r *http.Request) {
 	// Extract filename from path
 	filename := strings.TrimPrefix(r.URL.Path, "/api/pcap/")
@@ -115,3 +497,266 @@ func (w *WebServer) handlePcapList(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+func (w *WebServer) handleHostCapabilities(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	hostPath := strings.TrimPrefix(r.URL.Path, "/api/hosts/")
+	if domain, ok := strings.CutSuffix(hostPath, "/certificates"); ok && domain != "" {
+		w.handleHostCertificates(rw, domain)
+		return
+	}
+	domain, ok := strings.CutSuffix(hostPath, "/capabilities")
+	if !ok || domain == "" {
+		http.Error(rw, "Expected /api/hosts/{domain}/capabilities", http.StatusNotFound)
+		return
+	}
+
+	caps, ok := w.caps.Get(domain)
+	if !ok {
+		http.Error(rw, "No responses seen from host", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(caps); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleHostCertificates lists the upstream certificates that served a
+// host, with their full SAN lists
+func (w *WebServer) handleHostCertificates(rw http.ResponseWriter, domain string) {
+	certs := w.certs.ForHost(domain)
+	if len(certs) == 0 {
+		http.Error(rw, "No certificates seen from host", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(certs); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleEvents(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.events.Recent()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// streamKeepalive is how often /api/stream writes a comment when there are
+// no entries, so idle connections aren't closed by intermediaries
+const streamKeepalive = 15 * time.Second
+
+// handleStream sends each completed entry matching the request's filter,
+// once it's been enriched, as a server-sent event
+func (w *WebServer) handleStream(rw http.ResponseWriter, r *http.Request) {
+	filter, status, err := w.requestFilter(r)
+	if err != nil {
+		http.Error(rw, err.Error(), status)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	entries, unsubscribe := w.pipeline.Subscribe()
+	defer unsubscribe()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if filter != nil && !filter.Match(&entry) {
+				continue
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "id: %s\nevent: entry\ndata: %s\n\n", entry.ID, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (w *WebServer) handleEnrichment(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.pipeline.Status()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleCaptureBudget(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.logger.budget.Usage()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePolicySuggest serves a rules file whose policy allows the traffic
+// logged so far, or with ?diff=true how that compares to the loaded policy
+func (w *WebServer) handlePolicySuggest(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	rules := w.logger.rules
+	current := rules.Get().Policy
+	suggestion := SuggestPolicy(w.logger.History(), current)
+	if r.URL.Query().Get("diff") == "true" {
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(suggestion.Diff(current)); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := suggestion.RulesFile(rules.path)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/yaml")
+	rw.Write(data)
+}
+
+func (w *WebServer) handleLLMBudget(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.logger.llm.Status()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleLLMBudgetReset(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Resetting lifts a hard stop, so the agent being stopped mustn't be
+	// able to do it
+	if !w.canResetBudget(r) {
+		http.Error(rw, "Resetting the LLM budget requires the admin token, or without tokens a same-origin request from this machine", http.StatusForbidden)
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = "run"
+	}
+	if err := w.logger.llm.Reset(scope); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownScope) {
+			status = http.StatusBadRequest
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+	w.events.Emit("llm_budget_reset", map[string]string{"scope": scope})
+	if err := json.NewEncoder(rw).Encode(w.logger.llm.Status()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// A degraded proxy still serves traffic, so it's still "ok"
+	health := struct {
+		Status   string   `json:"status"`
+		InFlight int      `json:"in_flight"` // requests not yet relayed back to their client
+		Degraded []string `json:"degraded,omitempty"`
+		Hints    []string `json:"hints,omitempty"` // likely misconfigurations seen in recent traffic
+	}{Status: "ok", InFlight: w.inflight.Len(), Degraded: w.degraded}
+	if hint := w.handshakes.Hint(); hint != "" {
+		health.Hints = append(health.Hints, hint)
+	}
+	if err := json.NewEncoder(rw).Encode(health); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleInFlight(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.inflight.Snapshot()); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handleVersion(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if err := json.NewEncoder(rw).Encode(w.fingerprint); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (w *WebServer) handlePreferences(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	key := globalPreferencesKey
+	if owner, _ := w.caller(r); owner != "" {
+		key = owner
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		blob := w.prefs.Get(key)
+		if blob == nil {
+			blob = json.RawMessage("{}")
+		}
+		rw.Write(blob)
+	case http.MethodPut:
+		// Read one byte past the cap so oversized blobs are rejected, not truncated
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPreferencesSize+1))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := w.prefs.Put(key, body); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errInvalidPreferences) {
+				status = http.StatusBadRequest
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		rw.Write(body)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
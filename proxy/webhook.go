@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookQueueSize bounds how many events wait for delivery; beyond that
+// events are dropped rather than slowing down the proxy
+const webhookQueueSize = 64
+
+// Webhook POSTs selected events as JSON to a URL
+type Webhook struct {
+	url    string
+	types  map[string]bool
+	queue  chan Event
+	client *http.Client
+}
+
+// NewWebhook starts delivering events of the given types to url
+func NewWebhook(url string, types []string) *Webhook {
+	w := &Webhook{
+		url:    url,
+		types:  make(map[string]bool),
+		queue:  make(chan Event, webhookQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, t := range types {
+		w.types[t] = true
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues an event for delivery if it's of a selected type
+func (w *Webhook) Notify(event Event) {
+	if !w.types[event.Type] {
+		return
+	}
+	select {
+	case w.queue <- event:
+	default:
+		fmt.Printf("Webhook queue full, dropping %s event\n", event.Type)
+	}
+}
+
+func (w *Webhook) run() {
+	for event := range w.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			fmt.Printf("Failed to marshal %s event for webhook: %v\n", event.Type, err)
+			continue
+		}
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Printf("Webhook delivery of %s event failed: %v\n", event.Type, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Printf("Webhook delivery of %s event failed: %s\n", event.Type, resp.Status)
+		}
+	}
+}